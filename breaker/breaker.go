@@ -0,0 +1,334 @@
+// Package breaker implements a circuit breaker, which stops the calls to
+// a failing downstream rather than sending them at the full rate:
+//
+//	b := breaker.New(breaker.WithThreshold(0.5), breaker.WithOpenTimeout(30*time.Second))
+//	client := &http.Client{Transport: breaker.Transport(b, http.DefaultTransport)}
+//
+//	err := b.Do(func() error { return callDownstream() })
+//
+// The breaker is closed at first, the calls pass and their errors are
+// counted in a sliding window. It opens when the error rate in the window
+// reaches the threshold, and rejects the calls with ErrOpen. After the
+// open timeout it is half-open: the probe calls are metered by a
+// rateapi.Limiter, it closes after enough probes succeeded, or opens again
+// on a failed one.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/counter"
+	"github.com/hedzr/rate/rateapi"
+)
+
+// State is the state of a Breaker
+type State int
+
+const (
+	// Closed passes the calls and counts their errors
+	Closed State = iota
+	// Open rejects the calls until the open timeout passed
+	Open
+	// HalfOpen passes the probe calls metered by a limiter
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// ErrOpen is returned for the calls rejected by an open breaker, or by a
+// half-open one beyond its probes.
+var ErrOpen = errors.New("breaker: open")
+
+// StatusError is the failure of a response of status 5xx or 429, see
+// Transport.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("breaker: response status %d", e.StatusCode)
+}
+
+// Option configures a Breaker
+type Option func(b *Breaker)
+
+// WithWindow sets the sliding window of the error rate, it slides by
+// d/buckets. Default is 10s in 10 buckets.
+func WithWindow(d time.Duration, buckets int) Option {
+	return func(b *Breaker) {
+		if buckets < 1 {
+			buckets = 1
+		}
+		b.window, b.buckets = d, make([]bucket, buckets)
+	}
+}
+
+// WithThreshold sets the error rate in (0, 1] to open at, default is 0.5
+func WithThreshold(ratio float64) Option {
+	return func(b *Breaker) { b.threshold = ratio }
+}
+
+// WithMinRequests sets the least calls in the window to open at, so that
+// a few errors of the idle time do not open the breaker. Default is 20.
+func WithMinRequests(n int) Option {
+	return func(b *Breaker) { b.minRequests = n }
+}
+
+// WithOpenTimeout sets how long the breaker stays open before it probes
+// the downstream, default is 30s.
+func WithOpenTimeout(d time.Duration) Option {
+	return func(b *Breaker) { b.openTimeout = d }
+}
+
+// WithProbes meters the probe calls of the half-open state by limiter,
+// and closes the breaker after successes of them succeeded. Default is a
+// probe per second, and 3 successes.
+func WithProbes(limiter rateapi.Limiter, successes int) Option {
+	return func(b *Breaker) { b.probes, b.successes = limiter, successes }
+}
+
+// WithFailure tells whether an error of a call is a failure, the other
+// errors are not counted. Default is any error except context.Canceled,
+// which is of the caller rather than of the downstream.
+func WithFailure(isFailure func(err error) bool) Option {
+	return func(b *Breaker) { b.isFailure = isFailure }
+}
+
+// WithStateHook adds a hook called on the state changes. The hooks run
+// synchronously with the breaker locked, so they must be fast and must not
+// call the breaker.
+func WithStateHook(hook func(from, to State)) Option {
+	return func(b *Breaker) { b.hooks = append(b.hooks, hook) }
+}
+
+// New returns a closed breaker
+func New(opts ...Option) *Breaker {
+	b := &Breaker{
+		window:      10 * time.Second,
+		buckets:     make([]bucket, 10),
+		threshold:   0.5,
+		minRequests: 20,
+		openTimeout: 30 * time.Second,
+		successes:   3,
+		isFailure:   func(err error) bool { return !errors.Is(err, context.Canceled) },
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.window < time.Duration(len(b.buckets)) {
+		b.window = time.Duration(len(b.buckets))
+	}
+	if b.probes == nil {
+		b.probes = counter.New(1, time.Second)
+	}
+	return b
+}
+
+// Breaker is a circuit breaker, it is safe for concurrent use
+type Breaker struct {
+	window      time.Duration
+	threshold   float64
+	minRequests int
+	openTimeout time.Duration
+	probes      rateapi.Limiter
+	successes   int
+	isFailure   func(err error) bool
+	hooks       []func(from, to State)
+
+	rw         sync.Mutex
+	state      State
+	generation uint64 // of the state, the results of the calls of the former ones are ignored
+	buckets    []bucket
+	openedAt   time.Time
+	succeeded  int // the probes succeeded in the half-open state
+}
+
+// bucket counts the calls in a slot of the window
+type bucket struct {
+	slot            int64
+	total, failures int
+}
+
+// State returns the current state, an open breaker whose open timeout
+// passed is reported half-open.
+func (b *Breaker) State() State {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	b.expire(time.Now())
+	return b.state
+}
+
+// ErrorRate returns the calls and the failures in the window
+func (b *Breaker) ErrorRate() (total, failures int) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	return b.count(time.Now())
+}
+
+// Allow asks the breaker for a call. If allowed, done must be called with
+// the error of the call, nil for a success; otherwise err is ErrOpen.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	now := time.Now()
+	b.expire(now)
+	switch b.state {
+	case Open:
+		return nil, ErrOpen
+	case HalfOpen:
+		if !b.probes.Take(1) {
+			return nil, ErrOpen
+		}
+	}
+	generation := b.generation
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.done(generation, err) })
+	}, nil
+}
+
+// Do calls fn if the breaker allows, and counts its error
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+func (b *Breaker) done(generation uint64, err error) {
+	failed := err != nil && b.isFailure(err)
+	if err != nil && !failed {
+		return // not counted
+	}
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	if generation != b.generation {
+		return // of a former state
+	}
+	now := time.Now()
+	switch b.state {
+	case Closed:
+		bk := b.bucket(now)
+		bk.total++
+		if failed {
+			bk.failures++
+			total, failures := b.count(now)
+			if total >= b.minRequests && float64(failures) >= b.threshold*float64(total) {
+				b.setState(Open, now)
+			}
+		}
+	case HalfOpen:
+		if failed {
+			b.setState(Open, now)
+		} else if b.succeeded++; b.succeeded >= b.successes {
+			b.setState(Closed, now)
+		}
+	}
+}
+
+// expire turns an open breaker half-open after the open timeout
+func (b *Breaker) expire(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.openTimeout {
+		b.setState(HalfOpen, now)
+	}
+}
+
+func (b *Breaker) setState(state State, now time.Time) {
+	from := b.state
+	b.state = state
+	b.generation++
+	switch state {
+	case Open:
+		b.openedAt = now
+	case HalfOpen:
+		b.succeeded = 0
+	case Closed:
+		for i := range b.buckets {
+			b.buckets[i] = bucket{}
+		}
+	}
+	for _, hook := range b.hooks {
+		hook(from, state)
+	}
+}
+
+func (b *Breaker) slotOf(now time.Time) int64 {
+	return now.UnixNano() / int64(b.window/time.Duration(len(b.buckets)))
+}
+
+// bucket returns the bucket of now, it is reset if it was of an earlier
+// round of the window
+func (b *Breaker) bucket(now time.Time) *bucket {
+	slot := b.slotOf(now)
+	bk := &b.buckets[slot%int64(len(b.buckets))]
+	if bk.slot != slot {
+		*bk = bucket{slot: slot}
+	}
+	return bk
+}
+
+// count sums the buckets in the window of now
+func (b *Breaker) count(now time.Time) (total, failures int) {
+	slot := b.slotOf(now)
+	for _, bk := range b.buckets {
+		if bk.slot > slot-int64(len(b.buckets)) {
+			total += bk.total
+			failures += bk.failures
+		}
+	}
+	return
+}
+
+// Transport wraps next by b, such as the transport of an outbound limiter,
+// so that the requests stop while b is open. The errors and the responses
+// of status 5xx or 429 are the failures (see StatusError). A nil next is
+// http.DefaultTransport.
+func Transport(b *Breaker, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripper{b, next}
+}
+
+type roundTripper struct {
+	b    *Breaker
+	next http.RoundTripper
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	done, err := rt.b.Allow()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close() // a RoundTripper must close the body
+		}
+		return nil, fmt.Errorf("%v %v: %w", req.Method, req.URL, err)
+	}
+	resp, err := rt.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		done(err)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		done(&StatusError{resp.StatusCode})
+	default:
+		done(nil)
+	}
+	return resp, err
+}
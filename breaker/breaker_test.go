@@ -0,0 +1,137 @@
+package breaker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/breaker"
+	"github.com/hedzr/rate/counter"
+)
+
+var errDownstream = errors.New("downstream failed")
+
+func TestBreaker(t *testing.T) {
+	var changes []string
+	b := breaker.New(
+		breaker.WithMinRequests(4),
+		breaker.WithThreshold(0.5),
+		breaker.WithOpenTimeout(30*time.Millisecond),
+		breaker.WithProbes(counter.New(2, time.Hour), 2),
+		breaker.WithStateHook(func(from, to breaker.State) { changes = append(changes, from.String()+" > "+to.String()) }),
+	)
+	ok := func() error { return nil }
+	fail := func() error { return errDownstream }
+	_ = b.Do(ok)
+	_ = b.Do(ok)
+	_ = b.Do(fail)
+	if b.State() != breaker.Closed {
+		t.Fatal("the breaker should not open under the min requests")
+	}
+	// the canceled calls are of the callers, they are not counted
+	_ = b.Do(func() error { return context.Canceled })
+	if total, failures := b.ErrorRate(); total != 3 || failures != 1 {
+		t.Fatalf("unexpected error rate %v/%v", failures, total)
+	}
+	_ = b.Do(fail)
+	if b.State() != breaker.Open {
+		t.Fatal("the breaker should open at the error rate of 50%")
+	}
+	called := false
+	if err := b.Do(func() error { called = true; return nil }); !errors.Is(err, breaker.ErrOpen) || called {
+		t.Fatalf("an open breaker should reject the calls, got %v", err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if b.State() != breaker.HalfOpen {
+		t.Fatal("the breaker should be half-open after the open timeout")
+	}
+	done1, err1 := b.Allow()
+	done2, err2 := b.Allow()
+	if err1 != nil || err2 != nil {
+		t.Fatalf("2 probes should be allowed, got %v, %v", err1, err2)
+	}
+	if _, err := b.Allow(); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("the probes should be metered by the limiter, got %v", err)
+	}
+	done1(nil)
+	done1(errDownstream) // only the first result counts
+	done2(nil)
+	if b.State() != breaker.Closed {
+		t.Fatal("the breaker should close after the probes succeeded")
+	}
+	if total, _ := b.ErrorRate(); total != 0 {
+		t.Fatalf("the window should be reset on closing, got %v", total)
+	}
+	want := []string{"closed > open", "open > half-open", "half-open > closed"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("expecting %v, got %v", want, changes)
+	}
+}
+
+func TestHalfOpenFailure(t *testing.T) {
+	b := breaker.New(breaker.WithMinRequests(1), breaker.WithOpenTimeout(10*time.Millisecond))
+	stale, _ := b.Allow()
+	_ = b.Do(func() error { return errDownstream })
+	if b.State() != breaker.Open {
+		t.Fatal("the breaker should open")
+	}
+	time.Sleep(20 * time.Millisecond)
+	stale(nil) // the result of a call of the closed state is ignored
+	if err := b.Do(func() error { return errDownstream }); err != errDownstream {
+		t.Fatalf("the probe should be allowed, got %v", err)
+	}
+	if b.State() != breaker.Open {
+		t.Fatal("a failed probe should open the breaker again")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	b := breaker.New(breaker.WithMinRequests(3), breaker.WithWindow(40*time.Millisecond, 4))
+	_ = b.Do(func() error { return errDownstream })
+	_ = b.Do(func() error { return errDownstream })
+	time.Sleep(60 * time.Millisecond)
+	if total, failures := b.ErrorRate(); total != 0 || failures != 0 {
+		t.Fatalf("the failures should slide out of the window, got %v/%v", failures, total)
+	}
+	_ = b.Do(func() error { return errDownstream })
+	if b.State() != breaker.Closed {
+		t.Fatal("the failures out of the window should not open the breaker")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	b := breaker.New(breaker.WithMinRequests(3), breaker.WithOpenTimeout(time.Hour))
+	client := &http.Client{Transport: breaker.Transport(b, nil)}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("unexpected status %v", resp.StatusCode)
+		}
+	}
+	if b.State() != breaker.Open {
+		t.Fatal("the 503 responses should open the breaker")
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("expecting the request rejected, got %v", err)
+	}
+	if n := atomic.LoadInt64(&hits); n != 3 {
+		t.Fatalf("the downstream should not be hit while open, got %v hits", n)
+	}
+}
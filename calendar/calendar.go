@@ -0,0 +1,312 @@
+// Package calendar implements counter algorithm with calendar-aligned periods
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
+)
+
+// Unit represents the length of a calendar-aligned period
+type Unit int
+
+const (
+	// None means the period is not aligned to the calendar
+	None Unit = iota
+	// Minute resets at the beginning of each minute
+	Minute
+	// Hour resets at the beginning of each hour
+	Hour
+	// Day resets at midnight
+	Day
+	// Week resets at midnight of each monday, as ISO 8601 weeks do
+	Week
+	// Month resets at midnight of the first day of each month
+	Month
+	// Second resets at the beginning of each second
+	Second
+	// Year resets at midnight of the first day of each year
+	Year
+)
+
+var unitNames = map[Unit]string{
+	None:   "none",
+	Minute: "minute",
+	Hour:   "hour",
+	Day:    "day",
+	Week:   "week",
+	Month:  "month",
+	Second: "second",
+	Year:   "year",
+}
+
+func (u Unit) String() string {
+	if s, ok := unitNames[u]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unit(%d)", int(u))
+}
+
+// ParseUnit takes a unit name such as "day", "daily" and returns the Unit constant.
+func ParseUnit(s string) (Unit, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return None, nil
+	case "minute", "minutely":
+		return Minute, nil
+	case "hour", "hourly":
+		return Hour, nil
+	case "day", "daily":
+		return Day, nil
+	case "week", "weekly", "isoweek":
+		return Week, nil
+	case "month", "monthly":
+		return Month, nil
+	case "second", "secondly":
+		return Second, nil
+	case "year", "yearly", "annual":
+		return Year, nil
+	}
+	return None, fmt.Errorf("not a valid calendar unit: %q", s)
+}
+
+// Period is a calendar unit anchored in a time zone.
+// A nil Location means UTC.
+type Period struct {
+	Unit     Unit
+	Location *time.Location
+}
+
+func (p Period) String() string {
+	return fmt.Sprintf("%v@%v", p.Unit, p.location())
+}
+
+func (p Period) location() *time.Location {
+	if p.Location == nil {
+		return time.UTC
+	}
+	return p.Location
+}
+
+// Bounds returns the period [start, end) which contains t.
+//
+// The boundaries are computed from the wall clock in p.Location, so a
+// day lasts 23 or 25 hours across the DST transitions and a month has
+// its real length.
+func (p Period) Bounds(t time.Time) (start, end time.Time) {
+	t = t.In(p.location())
+	y, m, d := t.Date()
+	switch p.Unit {
+	case Second:
+		start = t.Add(-time.Duration(t.Nanosecond()))
+		end = start.Add(time.Second)
+	case Minute:
+		start = t.Add(-time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		end = start.Add(time.Minute)
+	case Hour:
+		start = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		end = start.Add(time.Hour)
+	case Day:
+		start = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		end = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	case Week:
+		d -= (int(t.Weekday()) + 6) % 7 // back to monday
+		start = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		end = time.Date(y, m, d+7, 0, 0, 0, 0, t.Location())
+	case Month:
+		start = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		end = time.Date(y, m+1, 1, 0, 0, 0, 0, t.Location())
+	case Year:
+		start = time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+		end = time.Date(y+1, 1, 1, 0, 0, 0, 0, t.Location())
+	default:
+		start, end = t, t
+	}
+	return
+}
+
+func (p Period) valid() bool { return p.Unit > None && p.Unit <= Year }
+
+// NewWithStore make a new instance of limiter whose state of key lives in s
+func NewWithStore(maxCount int64, p Period, s store.Store, key string) rateapi.Limiter {
+	alg := NewAlgorithm(maxCount, p)
+	if alg == nil {
+		return nil
+	}
+	return store.NewLimiter(s, key, alg)
+}
+
+// NewAlgorithm returns the calendar-aligned counter algorithm for
+// store.NewLimiter.
+//
+// The state Count is the requests in the period, Stamp is the end of the period.
+func NewAlgorithm(maxCount int64, p Period) store.Algorithm {
+	if !p.valid() {
+		logger.Errorf("calendar: the unit must be one of second, minute, hour, day, week, month and year, it's %v", p.Unit)
+		return nil
+	}
+	return algorithm{maxCount, p}
+}
+
+type algorithm struct {
+	maximal int64
+	period  Period
+}
+
+func (a algorithm) Capacity() int64 { return a.maximal }
+func (a algorithm) String() string  { return name }
+
+// current returns st reset to the period which contains now, if it has passed
+func (a algorithm) current(st store.State, exists bool, now int64) store.State {
+	if !exists || now >= st.Stamp {
+		_, end := a.period.Bounds(time.Unix(0, now))
+		return store.State{Count: 0, Stamp: end.UnixNano()}
+	}
+	return st
+}
+
+func (a algorithm) Decide(st store.State, exists bool, now int64, count int) (store.State, bool, time.Duration) {
+	st = a.current(st, exists, now)
+	if st.Count+int64(count) > a.maximal {
+		return st, false, time.Duration(st.Stamp - now) // a rejected request is not charged
+	}
+	st.Count += int64(count)
+	return st, true, 0
+}
+
+func (a algorithm) Available(st store.State, exists bool, now int64) int64 {
+	if r := a.maximal - a.current(st, exists, now).Count; r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (a algorithm) Reset(st store.State, exists bool, now int64) time.Duration {
+	return time.Duration(a.current(st, exists, now).Stamp - now)
+}
+
+// New make a new instance of limiter which allows maxCount requests in
+// each calendar period, such as 10000 per month in Asia/Shanghai.
+//
+// Unlike counter.New, the count resets at the boundaries of the period
+// rather than relative to the first request.
+func New(maxCount int64, p Period) rateapi.Limiter {
+	if !p.valid() {
+		logger.Errorf("calendar: the unit must be one of second, minute, hour, day, week, month and year, it's %v", p.Unit)
+		return nil
+	}
+	return &aligned{
+		enabled: true,
+		Maximal: maxCount,
+		period:  p,
+	}
+}
+
+type aligned struct {
+	enabled bool
+	Maximal int64
+	period  Period
+	rw      sync.Mutex
+	count   int64
+	start   int64 // in nanoseconds
+	tick    int64 // in nanoseconds
+}
+
+func (s *aligned) Enabled() bool     { return s.enabled }
+func (s *aligned) SetEnabled(b bool) { s.enabled = b }
+func (s *aligned) Close()            {}
+
+func (s *aligned) refresh(now time.Time) {
+	if n := now.UnixNano(); n >= s.tick || n < s.start {
+		start, end := s.period.Bounds(now)
+		s.count, s.start, s.tick = 0, start.UnixNano(), end.UnixNano()
+	}
+}
+
+func (s *aligned) take(count int) bool {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.refresh(time.Now())
+	if s.count+int64(count) > s.Maximal {
+		return false // a rejected request is not charged
+	}
+	s.count += int64(count)
+	return true
+}
+
+func (s *aligned) Take(count int) bool {
+	return s.take(count)
+}
+
+// TakeBlocked waits for the periods until count is allowed, it returns
+// the zero time at once if count exceeds Maximal, which would never be
+// allowed.
+func (s *aligned) TakeBlocked(count int) (requestAt time.Time) {
+	if int64(count) > s.Maximal {
+		logger.Errorf("calendar: taking %v exceeds the maximal %v", count, s.Maximal)
+		return time.Time{}
+	}
+	requestAt = time.Now().UTC()
+	for !s.take(count) {
+		time.Sleep(time.Until(s.Reset()) + time.Millisecond)
+	}
+	return
+}
+
+// Reset returns the end of current period, for 'X-RateLimit-Reset'
+func (s *aligned) Reset() time.Time { return time.Unix(0, s.Ticks()).In(s.period.location()) }
+
+func (s *aligned) Ticks() int64 {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.refresh(time.Now())
+	return s.tick
+}
+
+func (s *aligned) Count() int64 {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.refresh(time.Now())
+	return s.count
+}
+
+func (s *aligned) Available() int64 {
+	if r := s.Maximal - s.Count(); r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (s *aligned) Capacity() int64 { return s.Maximal }
+
+// name is the name of the algorithm in the snapshots
+const name = "calendar"
+
+// Snapshot implements rateapi.Snapshotter
+func (s *aligned) Snapshot() ([]byte, error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return store.MarshalStates(name, store.State{Count: s.count, Stamp: s.tick}), nil
+}
+
+// Restore implements rateapi.Snapshotter, the count in data goes on if
+// its period has not ended.
+func (s *aligned) Restore(data []byte) error {
+	st, exists, err := store.UnmarshalState(data, name)
+	if err != nil {
+		return err
+	}
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.count, s.start, s.tick = 0, 0, 0
+	if exists {
+		start, _ := s.period.Bounds(time.Unix(0, st.Stamp-1))
+		s.count, s.start, s.tick = st.Count, start.UnixNano(), st.Stamp
+	}
+	return nil
+}
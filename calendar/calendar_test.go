@@ -0,0 +1,127 @@
+package calendar_test
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // the zones used below must be available on any test host
+
+	"github.com/hedzr/rate/calendar"
+	"github.com/hedzr/rate/store"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestBounds(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	kolkata := mustLoad(t, "Asia/Kolkata")
+
+	for _, c := range []struct {
+		p          calendar.Period
+		at         time.Time
+		start, end string
+		length     time.Duration
+	}{
+		// spring forward, the day lasts 23 hours
+		{calendar.Period{calendar.Day, ny}, time.Date(2021, 3, 14, 12, 0, 0, 0, ny),
+			"2021-03-14T00:00:00-05:00", "2021-03-15T00:00:00-04:00", 23 * time.Hour},
+		// fall back, the day lasts 25 hours
+		{calendar.Period{calendar.Day, ny}, time.Date(2021, 11, 7, 1, 30, 0, 0, ny),
+			"2021-11-07T00:00:00-04:00", "2021-11-08T00:00:00-05:00", 25 * time.Hour},
+		// leap year
+		{calendar.Period{calendar.Month, nil}, time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC),
+			"2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z", 29 * 24 * time.Hour},
+		// the month contains a DST transition
+		{calendar.Period{calendar.Month, ny}, time.Date(2021, 3, 31, 23, 0, 0, 0, ny),
+			"2021-03-01T00:00:00-05:00", "2021-04-01T00:00:00-04:00", 31*24*time.Hour - time.Hour},
+		// a sunday belongs to the ISO week which starts on the previous monday
+		{calendar.Period{calendar.Week, nil}, time.Date(2021, 1, 3, 10, 0, 0, 0, time.UTC),
+			"2020-12-28T00:00:00Z", "2021-01-04T00:00:00Z", 7 * 24 * time.Hour},
+		{calendar.Period{calendar.Hour, kolkata}, time.Date(2021, 6, 1, 10, 45, 3, 0, kolkata),
+			"2021-06-01T10:00:00+05:30", "2021-06-01T11:00:00+05:30", time.Hour},
+		{calendar.Period{calendar.Minute, nil}, time.Date(2021, 6, 1, 10, 45, 3, 9, time.UTC),
+			"2021-06-01T10:45:00Z", "2021-06-01T10:46:00Z", time.Minute},
+		{calendar.Period{calendar.Year, nil}, time.Date(2024, 6, 1, 10, 45, 3, 9, time.UTC),
+			"2024-01-01T00:00:00Z", "2025-01-01T00:00:00Z", 366 * 24 * time.Hour},
+	} {
+		start, end := c.p.Bounds(c.at)
+		if s := start.Format(time.RFC3339); s != c.start {
+			t.Errorf("%v of %v: start is %v, expecting %v", c.p, c.at, s, c.start)
+		}
+		if e := end.Format(time.RFC3339); e != c.end {
+			t.Errorf("%v of %v: end is %v, expecting %v", c.p, c.at, e, c.end)
+		}
+		if l := end.Sub(start); l != c.length {
+			t.Errorf("%v of %v: length is %v, expecting %v", c.p, c.at, l, c.length)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	for s, u := range map[string]calendar.Unit{"daily": calendar.Day, "Month": calendar.Month, "isoweek": calendar.Week} {
+		if v, err := calendar.ParseUnit(s); err != nil || v != u {
+			t.Fatalf("parse %q got %v, %v", s, v, err)
+		}
+	}
+	if _, err := calendar.ParseUnit("fortnight"); err == nil {
+		t.Fatal("expecting an error")
+	}
+}
+
+func TestCalendarLimiter(t *testing.T) {
+	p := calendar.Period{Unit: calendar.Day, Location: mustLoad(t, "Asia/Shanghai")}
+	l := calendar.New(3, p)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if !l.Take(1) {
+			t.Fatalf("#%d should be allowed", i)
+		}
+	}
+	if l.Take(1) || l.Available() != 0 || l.Capacity() != 3 {
+		t.Fatalf("the quota should be exhausted, available: %v", l.Available())
+	}
+	if at := l.TakeBlocked(4); !at.IsZero() {
+		t.Fatalf("4 would never fit the quota, got %v", at)
+	}
+
+	_, end := p.Bounds(time.Now())
+	if reset := l.(interface{ Reset() time.Time }).Reset(); !reset.Equal(end) {
+		t.Fatalf("reset at %v, expecting the midnight %v", reset, end)
+	}
+
+	if l := calendar.New(3, calendar.Period{}); l != nil {
+		t.Fatal("expecting nil for an unaligned period")
+	}
+}
+
+func TestAlgorithm(t *testing.T) {
+	alg := calendar.NewAlgorithm(2, calendar.Period{Unit: calendar.Minute})
+	now := time.Date(2021, 6, 1, 10, 45, 50, 0, time.UTC).UnixNano()
+	var st store.State
+	var ok bool
+	var wait time.Duration
+	for i := 0; i < 2; i++ {
+		if st, ok, _ = alg.Decide(st, i > 0, now, 1); !ok {
+			t.Fatalf("take #%d should be allowed", i)
+		}
+	}
+	if st, ok, wait = alg.Decide(st, true, now, 1); ok || wait != 10*time.Second || st.Count != 2 {
+		t.Fatalf("the 3rd take should wait for the next minute without being charged, got %v, %v, %+v", ok, wait, st)
+	}
+	if r := alg.(store.Resetter).Reset(st, true, now); r != 10*time.Second {
+		t.Fatalf("expecting reset in 10s, got %v", r)
+	}
+	next := now + int64(10*time.Second)
+	if alg.Available(st, true, next) != 2 {
+		t.Fatal("the count should reset at the boundary")
+	}
+	if calendar.NewAlgorithm(2, calendar.Period{}) != nil {
+		t.Fatal("a period without unit should be rejected")
+	}
+}
@@ -0,0 +1,360 @@
+// Package cluster splits a global limit between N nodes without a
+// central store.
+//
+// Each node decides locally on its share of the global limit, capacity/N
+// at first. The nodes exchange their observed demand over HTTP
+// periodically, and every node recomputes its share in proportion to the
+// demand of the alive members. So the global limit is eventually
+// consistent: a busy node borrows the budget of the idle ones after a
+// round or two, and the survivors take over the budget of a dead node.
+//
+//	n := cluster.New("node-1", 1000, time.Second,
+//		cluster.WithPeers("http://node-2:7946", "http://node-3:7946"))
+//	defer n.Close()
+//	http.Handle(cluster.Path, n.Handler())
+//	...
+//	if n.Take(1) { ... }
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/store"
+)
+
+// Path is where Handler is expected to be mounted on the peers
+const Path = "/cluster/v1/gossip"
+
+// Option configures the Node built by New
+type Option func(n *Node)
+
+// WithPeers sets the base URLs of the other nodes, such as "http://10.0.0.2:7946"
+func WithPeers(urls ...string) Option {
+	return func(n *Node) {
+		for _, u := range urls {
+			n.peers = append(n.peers, strings.TrimRight(u, "/"))
+		}
+	}
+}
+
+// WithAlgorithm sets the local algorithm, which must support store.Algorithm.
+// Default is rate.TokenBucket.
+func WithAlgorithm(algorithm rate.Algorithm) Option {
+	return func(n *Node) { n.algorithm = algorithm }
+}
+
+// WithInterval sets how often the node gossips and rebalances, default
+// is 1s. A peer silent for 3 intervals is considered dead.
+func WithInterval(d time.Duration) Option {
+	return func(n *Node) { n.interval = d }
+}
+
+// WithMinShare sets the ratio of the global limit split equally between
+// the alive members regardless of demand, so that an idle node can still
+// serve a burst before the next rebalance. Default is 0.1.
+func WithMinShare(ratio float64) Option {
+	return func(n *Node) { n.minShare = ratio }
+}
+
+// WithHTTPClient sets the http.Client used to reach the peers, default
+// is a client with the timeout of one interval.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(n *Node) { n.hc = hc }
+}
+
+// Member is a node seen by the local one
+type Member struct {
+	ID string `json:"id"`
+	// Demand is the smoothed count of requested allows per interval
+	Demand float64 `json:"demand"`
+	// Share is the local limit reported by the member
+	Share    int64     `json:"share"`
+	LastSeen time.Time `json:"-"`
+}
+
+// New make a new instance of node which shares maxCount per d with its
+// peers, and starts gossiping in background.
+func New(id string, maxCount int64, d time.Duration, opts ...Option) *Node {
+	n := &Node{
+		id:        id,
+		enabled:   true,
+		global:    maxCount,
+		period:    d,
+		algorithm: rate.TokenBucket,
+		interval:  time.Second,
+		minShare:  0.1,
+		st:        store.NewMemory(),
+		members:   make(map[string]*Member),
+		exitCh:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.hc == nil {
+		n.hc = &http.Client{Timeout: n.interval}
+	}
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return nil
+	}
+	if rate := int64(d) / maxCount; rate < 1000 {
+		logger.Errorf("the rate cannot be less than 1000us, it's %v", rate)
+		return nil
+	}
+	if !n.setShare(maxCount / int64(len(n.peers)+1)) {
+		logger.Errorf("cluster: algorithm %q cannot be used in cluster mode", n.algorithm)
+		return nil
+	}
+	go n.looper()
+	return n
+}
+
+// Node is a member of the cluster, it implements rateapi.Limiter on its
+// share of the global limit.
+type Node struct {
+	id        string
+	enabled   bool
+	global    int64
+	period    time.Duration
+	algorithm rate.Algorithm
+	peers     []string
+	interval  time.Duration
+	minShare  float64
+	hc        *http.Client
+
+	st        *store.Memory
+	requested int64 // allows requested since the last rebalance
+
+	rw      sync.RWMutex
+	alg     store.Algorithm
+	share   int64
+	demand  float64
+	members map[string]*Member // the peers keyed by id
+
+	closeOnce sync.Once
+	exitCh    chan struct{}
+}
+
+const stateKey = "share"
+
+func (n *Node) Enabled() bool     { return n.enabled }
+func (n *Node) SetEnabled(b bool) { n.enabled = b }
+
+// Capacity returns the share of this node
+func (n *Node) Capacity() int64 {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	return n.share
+}
+
+// Global returns the limit shared by the cluster
+func (n *Node) Global() int64 { return n.global }
+
+// ID returns the id of this node
+func (n *Node) ID() string { return n.id }
+
+func (n *Node) Close() {
+	n.closeOnce.Do(func() {
+		close(n.exitCh)
+		n.hc.CloseIdleConnections()
+	})
+}
+
+func (n *Node) take(count int) (ok bool, wait time.Duration) {
+	atomic.AddInt64(&n.requested, int64(count))
+	n.rw.RLock()
+	alg := n.alg
+	n.rw.RUnlock()
+	now := time.Now().UnixNano()
+	_, _ = n.st.Update(stateKey, func(st store.State, exists bool) (next store.State) {
+		next, ok, wait = alg.Decide(st, exists, now, count)
+		return
+	})
+	return
+}
+
+func (n *Node) Take(count int) bool {
+	ok, _ := n.take(count)
+	return ok
+}
+
+// TakeBlocked waits until count is allowed by the share, it returns the
+// zero time at once if count exceeds the global limit, which no share
+// would ever allow.
+func (n *Node) TakeBlocked(count int) (requestAt time.Time) {
+	if int64(count) > n.global {
+		logger.Errorf("cluster: taking %v exceeds the global limit %v", count, n.global)
+		return time.Time{}
+	}
+	requestAt = time.Now().UTC()
+	for ok, wait := n.take(count); !ok; ok, wait = n.take(count) {
+		time.Sleep(wait)
+	}
+	return
+}
+
+func (n *Node) Available() int64 {
+	n.rw.RLock()
+	alg := n.alg
+	n.rw.RUnlock()
+	st, exists, _ := n.st.Load(stateKey)
+	return alg.Available(st, exists, time.Now().UnixNano())
+}
+
+// Members returns the alive members including this node, sorted by id
+func (n *Node) Members() []Member {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	return n.alive(time.Now())
+}
+
+// alive returns the alive members including this node, the caller must hold the lock
+func (n *Node) alive(now time.Time) []Member {
+	ms := []Member{{ID: n.id, Demand: n.demand, Share: n.share, LastSeen: now}}
+	for _, m := range n.members {
+		if now.Sub(m.LastSeen) <= 3*n.interval {
+			ms = append(ms, *m)
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms
+}
+
+// setShare swaps in the algorithm of share. The share is clamped to the
+// global limit, whose rate is validated by New, so that the rate of the
+// algorithm never rounds to zero.
+func (n *Node) setShare(share int64) bool {
+	if share < 1 {
+		share = 1
+	}
+	if share > n.global {
+		share = n.global
+	}
+	alg := rate.NewAlgorithm(n.algorithm, share, n.period)
+	if alg == nil {
+		return false
+	}
+	n.alg, n.share = alg, share
+	return true
+}
+
+func (n *Node) looper() {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.exitCh:
+			return
+		case <-ticker.C:
+			n.Rebalance()
+		}
+	}
+}
+
+// Rebalance measures the demand of this node, exchanges it with the
+// peers and recomputes the share. It runs every interval in background,
+// calling it is necessary only to speed up the convergence.
+func (n *Node) Rebalance() {
+	requested := float64(atomic.SwapInt64(&n.requested, 0))
+	n.rw.Lock()
+	n.demand = (n.demand + requested) / 2
+	self := Member{ID: n.id, Demand: n.demand, Share: n.share}
+	n.rw.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range n.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			m, err := n.exchange(peer, self)
+			if err != nil {
+				logger.Debugf("cluster: gossip with %v failed: %v", peer, err)
+				return
+			}
+			n.observe(m)
+		}(peer)
+	}
+	wg.Wait()
+
+	n.rw.Lock()
+	defer n.rw.Unlock()
+	n.setShare(n.shareOf(n.alive(time.Now())))
+}
+
+// shareOf computes the share of this node among the alive members: the
+// minimal share is split equally, and the rest in proportion to the
+// demands. Every node computes the same shares from the same view, so
+// the sum of them is the global limit.
+func (n *Node) shareOf(ms []Member) int64 {
+	var total float64
+	for _, m := range ms {
+		total += m.Demand
+	}
+	if total <= 0 {
+		return n.global / int64(len(ms))
+	}
+	floor := float64(n.global) * n.minShare / float64(len(ms))
+	rest := float64(n.global) - floor*float64(len(ms))
+	return int64(math.Floor(floor + rest*n.demand/total))
+}
+
+func (n *Node) observe(m Member) {
+	if m.ID == "" || m.ID == n.id {
+		return
+	}
+	m.LastSeen = time.Now()
+	n.rw.Lock()
+	defer n.rw.Unlock()
+	n.members[m.ID] = &m
+}
+
+func (n *Node) exchange(peer string, self Member) (m Member, err error) {
+	body, err := json.Marshal(self)
+	if err != nil {
+		return
+	}
+	resp, err := n.hc.Post(peer+Path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, errors.New(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	return
+}
+
+// Handler answers the gossip of the peers, it should be mounted at Path.
+func (n *Node) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var m Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.observe(m)
+
+		n.rw.RLock()
+		self := Member{ID: n.id, Demand: n.demand, Share: n.share}
+		n.rw.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(self)
+	})
+}
@@ -0,0 +1,132 @@
+package cluster_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/cluster"
+)
+
+// newCluster starts n nodes which know each other over loopback
+func newCluster(t *testing.T, n int, global int64, opts ...cluster.Option) ([]*cluster.Node, []*httptest.Server) {
+	nodes := make([]*cluster.Node, n)
+	servers := make([]*httptest.Server, n)
+	ready := make(chan struct{})
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-ready
+			nodes[i].Handler().ServeHTTP(w, r)
+		}))
+	}
+	for i := range nodes {
+		var peers []string
+		for j, s := range servers {
+			if j != i {
+				peers = append(peers, s.URL)
+			}
+		}
+		nodes[i] = cluster.New(string(rune('a'+i)), global, time.Minute, append(opts, cluster.WithPeers(peers...))...)
+	}
+	close(ready)
+	t.Cleanup(func() {
+		for i := range nodes {
+			nodes[i].Close()
+			servers[i].Close()
+		}
+	})
+	return nodes, servers
+}
+
+func rebalance(nodes ...*cluster.Node) {
+	for _, n := range nodes {
+		n.Rebalance()
+	}
+}
+
+func sum(nodes ...*cluster.Node) (s int64) {
+	for _, n := range nodes {
+		s += n.Capacity()
+	}
+	return
+}
+
+func TestInitialShares(t *testing.T) {
+	nodes, _ := newCluster(t, 3, 300, cluster.WithInterval(time.Hour))
+	for _, n := range nodes {
+		if n.Capacity() != 100 || n.Available() != 100 {
+			t.Fatalf("node %v: expecting the share 100, got %v", n.ID(), n.Capacity())
+		}
+	}
+	rebalance(nodes...)
+	if sum(nodes...) != 300 || len(nodes[0].Members()) != 3 {
+		t.Fatalf("an idle cluster should split equally, got %v, %v, %v", nodes[0].Capacity(), nodes[1].Capacity(), nodes[2].Capacity())
+	}
+}
+
+func TestRebalanceOnDemand(t *testing.T) {
+	nodes, _ := newCluster(t, 3, 300, cluster.WithInterval(time.Hour))
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			nodes[0].Take(1)
+		}
+		rebalance(nodes...)
+		rebalance(nodes...) // so that everyone sees the demands of the same round
+	}
+
+	busy, idle := nodes[0].Capacity(), nodes[1].Capacity()
+	if busy < 250 || idle > 25 || idle < 10 {
+		t.Fatalf("the busy node should borrow the budget of the idle ones, got %v, %v, %v", busy, idle, nodes[2].Capacity())
+	}
+	if s := sum(nodes...); s > 300 || s < 297 {
+		t.Fatalf("the shares should sum up to the global limit, got %v", s)
+	}
+	if nodes[0].Global() != 300 {
+		t.Fatal("the global limit should not change")
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	nodes, servers := newCluster(t, 3, 300, cluster.WithInterval(20*time.Millisecond))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(nodes[0].Members()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("the nodes should see each other")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	servers[2].Close()
+	nodes[2].Close()
+
+	for time.Now().Before(deadline) {
+		if len(nodes[0].Members()) == 2 && sum(nodes[0], nodes[1]) == 300 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the survivors should take over the budget, got %v, %v with %v members", nodes[0].Capacity(), nodes[1].Capacity(), len(nodes[0].Members()))
+}
+
+func TestLocalLimit(t *testing.T) {
+	n := cluster.New("solo", 10, time.Minute, cluster.WithInterval(time.Hour))
+	defer n.Close()
+	for i := 0; i < 10; i++ {
+		if !n.Take(1) {
+			t.Fatalf("take #%d should be allowed", i)
+		}
+	}
+	if n.Take(1) {
+		t.Fatal("the 11th take should be denied")
+	}
+	if at := n.TakeBlocked(11); !at.IsZero() {
+		t.Fatalf("11 would never fit the global limit, got %v", at)
+	}
+	if cluster.New("bad", 10, time.Minute, cluster.WithAlgorithm("nope")) != nil {
+		t.Fatal("an unknown algorithm should be rejected")
+	}
+	if cluster.New("bad", 100, 10*time.Nanosecond) != nil {
+		t.Fatal("a rate rounding to zero should be rejected")
+	}
+}
@@ -0,0 +1,30 @@
+module github.com/hedzr/rate/cmd/ratelimitd
+
+go 1.25.0
+
+replace github.com/hedzr/rate => ../..
+
+require (
+	github.com/envoyproxy/go-control-plane/envoy v1.39.0
+	github.com/hedzr/rate v0.0.0-00010101000000-000000000000
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/cncf/xds/go v0.0.0-20260202195803-dba9d589def2 // indirect
+	github.com/envoyproxy/protoc-gen-validate v1.3.3 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/planetscale/vtprotobuf v0.6.1-0.20240319094008-0393e58bdf10 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+require (
+	github.com/hedzr/rate/envoyrls v0.0.0-00010101000000-000000000000
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
+
+replace github.com/hedzr/rate/envoyrls => ../../envoyrls
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hedzr/rate/cmd/ratelimitd/ratelimitpb"
+	"github.com/hedzr/rate/ratesvc"
+)
+
+// grpcServer adapts ratesvc.Service to ratelimitpb.RateLimitServer
+type grpcServer struct {
+	ratelimitpb.UnimplementedRateLimitServer
+	svc *ratesvc.Service
+}
+
+func (s *grpcServer) Take(_ context.Context, req *ratelimitpb.Request) (*ratelimitpb.Decision, error) {
+	return reply(s.svc.Take(request(req)))
+}
+
+func (s *grpcServer) Reserve(ctx context.Context, req *ratelimitpb.Request) (*ratelimitpb.Decision, error) {
+	return reply(s.svc.Reserve(ctx, request(req)))
+}
+
+func (s *grpcServer) Status(_ context.Context, req *ratelimitpb.Request) (*ratelimitpb.Decision, error) {
+	return reply(s.svc.Status(request(req)))
+}
+
+func request(req *ratelimitpb.Request) ratesvc.Request {
+	return ratesvc.Request{
+		Limiter: req.GetLimiter(),
+		Key:     req.GetKey(),
+		Count:   int(req.GetCount()),
+		MaxWait: ratesvc.Duration(req.GetMaxWait().AsDuration()),
+	}
+}
+
+func reply(d ratesvc.Decision, err error) (*ratelimitpb.Decision, error) {
+	switch {
+	case errors.Is(err, ratesvc.ErrUnknownLimiter):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ratesvc.ErrBadRequest):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return nil, status.FromContextError(err).Err()
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &ratelimitpb.Decision{
+		Allowed:    d.Allowed,
+		Limit:      d.Limit,
+		Remaining:  d.Remaining,
+		ResetAfter: duration(d.Reset),
+		RetryAfter: duration(d.RetryAfter),
+	}, nil
+}
+
+func duration(d time.Duration) *durationpb.Duration {
+	if d <= 0 {
+		return nil
+	}
+	return durationpb.New(d)
+}
@@ -0,0 +1,152 @@
+// Command ratelimitd hosts the named limiters of a config file, and
+// answers the decisions over HTTP/JSON and gRPC, so that the services in
+// any language share the quotas.
+//
+//	ratelimitd -config limiters.json -http :8080 -grpc :8081
+//
+// See ratesvc.LoadConfig for the config file, ratesvc.NewHandler for the
+// HTTP/JSON API and ratelimitpb/ratelimit.proto for the gRPC one.
+//
+// With -envoy 'config/*.yaml', the gRPC listener serves the rate limit
+// service of Envoy too, the files are in the shape of lyft/ratelimit (see
+// envoyrls.Config).
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+
+	"github.com/hedzr/rate/cmd/ratelimitd/ratelimitpb"
+	"github.com/hedzr/rate/envoyrls"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/ratesvc"
+	"github.com/hedzr/rate/store"
+)
+
+func main() {
+	config := flag.String("config", "limiters.json", "the config file of the limiters")
+	httpAddr := flag.String("http", ":8080", "the listen address of the HTTP/JSON API, empty to disable")
+	grpcAddr := flag.String("grpc", ":8081", "the listen address of the gRPC API, empty to disable")
+	envoy := flag.String("envoy", "", "the glob pattern of the config files of the Envoy rate limit service, empty to disable")
+	flag.Parse()
+
+	if err := run(*config, *envoy, *httpAddr, *grpcAddr); err != nil {
+		logger.Errorf("ratelimitd: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(config, envoy, httpAddr, grpcAddr string) error {
+	s := store.NewMemory()
+	svc, err := newService(config, s)
+	if err != nil {
+		return err
+	}
+	var rls *envoyrls.Server
+	if envoy != "" {
+		if rls, err = newEnvoyServer(envoy, s); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 2)
+
+	if httpAddr != "" {
+		hs := &http.Server{Addr: httpAddr, Handler: ratesvc.NewHandler(svc), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			logger.Infof("ratelimitd: serving HTTP on %v", httpAddr)
+			if err := hs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+		defer func() {
+			sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = hs.Shutdown(sctx)
+		}()
+	}
+
+	if grpcAddr != "" {
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+		gs := newGRPCServer(svc, rls)
+		go func() {
+			logger.Infof("ratelimitd: serving gRPC on %v", grpcAddr)
+			errCh <- gs.Serve(lis)
+		}()
+		defer gs.GracefulStop()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err = <-errCh:
+		return err
+	}
+}
+
+func newService(config string, s store.Store) (*ratesvc.Service, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defs, err := ratesvc.LoadConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	return ratesvc.NewService(defs, s)
+}
+
+func newEnvoyServer(pattern string, s store.Store) (*envoyrls.Server, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no envoy config matches %q", pattern)
+	}
+	var configs []*envoyrls.Config
+	for _, file := range files {
+		c, err := loadEnvoyConfig(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		configs = append(configs, c)
+	}
+	return envoyrls.NewServer(configs, s)
+}
+
+func loadEnvoyConfig(file string) (*envoyrls.Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return envoyrls.LoadConfig(f)
+}
+
+func newGRPCServer(svc *ratesvc.Service, rls *envoyrls.Server) *grpc.Server {
+	gs := grpc.NewServer()
+	ratelimitpb.RegisterRateLimitServer(gs, &grpcServer{svc: svc})
+	if rls != nil {
+		rlsv3.RegisterRateLimitServiceServer(gs, rls)
+	}
+	return gs
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/hedzr/rate/cmd/ratelimitd/ratelimitpb"
+	"github.com/hedzr/rate/store"
+)
+
+func TestGRPC(t *testing.T) {
+	svc, err := newService("limiters.json", store.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1 << 16)
+	gs := newGRPCServer(svc, nil)
+	go func() { _ = gs.Serve(lis) }()
+	defer gs.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := ratelimitpb.NewRateLimitClient(conn)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		d, err := c.Take(ctx, &ratelimitpb.Request{Limiter: "login", Key: "u1"})
+		if err != nil || !d.GetAllowed() || d.GetLimit() != 5 || d.GetRemaining() != int64(4-i) {
+			t.Fatalf("take #%d: %v, %v", i, d, err)
+		}
+	}
+	d, err := c.Take(ctx, &ratelimitpb.Request{Limiter: "login", Key: "u1"})
+	if err != nil || d.GetAllowed() || d.GetRetryAfter().AsDuration() <= 0 {
+		t.Fatalf("the 6th take should be denied with a retry-after: %v, %v", d, err)
+	}
+	if d, err = c.Status(ctx, &ratelimitpb.Request{Limiter: "login", Key: "u1"}); err != nil || d.GetRemaining() != 0 {
+		t.Fatalf("status: %v, %v", d, err)
+	}
+
+	if _, err = c.Take(ctx, &ratelimitpb.Request{Limiter: "nope", Key: "u1"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expecting NotFound, got %v", err)
+	}
+	if _, err = c.Reserve(ctx, &ratelimitpb.Request{Limiter: "api"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expecting InvalidArgument, got %v", err)
+	}
+}
+
+func TestEnvoyConfig(t *testing.T) {
+	if _, err := newEnvoyServer("envoy/*.yaml", store.NewMemory()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newEnvoyServer("envoy/*.nope", store.NewMemory()); err == nil {
+		t.Fatal("expecting an error if no config matches")
+	}
+}
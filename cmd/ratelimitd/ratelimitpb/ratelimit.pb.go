@@ -0,0 +1,252 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: ratelimit.proto
+
+package ratelimitpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Request struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Limiter string                 `protobuf:"bytes,1,opt,name=limiter,proto3" json:"limiter,omitempty"`
+	Key     string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	// count of allows, default is 1
+	Count         int32                `protobuf:"varint,3,opt,name=count,proto3" json:"count,omitempty"`
+	MaxWait       *durationpb.Duration `protobuf:"bytes,4,opt,name=max_wait,json=maxWait,proto3" json:"max_wait,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_ratelimit_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_ratelimit_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_ratelimit_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Request) GetLimiter() string {
+	if x != nil {
+		return x.Limiter
+	}
+	return ""
+}
+
+func (x *Request) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Request) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Request) GetMaxWait() *durationpb.Duration {
+	if x != nil {
+		return x.MaxWait
+	}
+	return nil
+}
+
+type Decision struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Allowed   bool                   `protobuf:"varint,1,opt,name=allowed,proto3" json:"allowed,omitempty"`
+	Limit     int64                  `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	Remaining int64                  `protobuf:"varint,3,opt,name=remaining,proto3" json:"remaining,omitempty"`
+	// how long the key takes to recover to the full capacity
+	ResetAfter *durationpb.Duration `protobuf:"bytes,4,opt,name=reset_after,json=resetAfter,proto3" json:"reset_after,omitempty"`
+	// how long a denied caller should wait before retrying
+	RetryAfter    *durationpb.Duration `protobuf:"bytes,5,opt,name=retry_after,json=retryAfter,proto3" json:"retry_after,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Decision) Reset() {
+	*x = Decision{}
+	mi := &file_ratelimit_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Decision) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Decision) ProtoMessage() {}
+
+func (x *Decision) ProtoReflect() protoreflect.Message {
+	mi := &file_ratelimit_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Decision.ProtoReflect.Descriptor instead.
+func (*Decision) Descriptor() ([]byte, []int) {
+	return file_ratelimit_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Decision) GetAllowed() bool {
+	if x != nil {
+		return x.Allowed
+	}
+	return false
+}
+
+func (x *Decision) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *Decision) GetRemaining() int64 {
+	if x != nil {
+		return x.Remaining
+	}
+	return 0
+}
+
+func (x *Decision) GetResetAfter() *durationpb.Duration {
+	if x != nil {
+		return x.ResetAfter
+	}
+	return nil
+}
+
+func (x *Decision) GetRetryAfter() *durationpb.Duration {
+	if x != nil {
+		return x.RetryAfter
+	}
+	return nil
+}
+
+var File_ratelimit_proto protoreflect.FileDescriptor
+
+const file_ratelimit_proto_rawDesc = "" +
+	"\n" +
+	"\x0fratelimit.proto\x12\rhedzr.rate.v1\x1a\x1egoogle/protobuf/duration.proto\"\x81\x01\n" +
+	"\aRequest\x12\x18\n" +
+	"\alimiter\x18\x01 \x01(\tR\alimiter\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x14\n" +
+	"\x05count\x18\x03 \x01(\x05R\x05count\x124\n" +
+	"\bmax_wait\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\amaxWait\"\xd0\x01\n" +
+	"\bDecision\x12\x18\n" +
+	"\aallowed\x18\x01 \x01(\bR\aallowed\x12\x14\n" +
+	"\x05limit\x18\x02 \x01(\x03R\x05limit\x12\x1c\n" +
+	"\tremaining\x18\x03 \x01(\x03R\tremaining\x12:\n" +
+	"\vreset_after\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\n" +
+	"resetAfter\x12:\n" +
+	"\vretry_after\x18\x05 \x01(\v2\x19.google.protobuf.DurationR\n" +
+	"retryAfter2\xbb\x01\n" +
+	"\tRateLimit\x127\n" +
+	"\x04Take\x12\x16.hedzr.rate.v1.Request\x1a\x17.hedzr.rate.v1.Decision\x12:\n" +
+	"\aReserve\x12\x16.hedzr.rate.v1.Request\x1a\x17.hedzr.rate.v1.Decision\x129\n" +
+	"\x06Status\x12\x16.hedzr.rate.v1.Request\x1a\x17.hedzr.rate.v1.DecisionB2Z0github.com/hedzr/rate/cmd/ratelimitd/ratelimitpbb\x06proto3"
+
+var (
+	file_ratelimit_proto_rawDescOnce sync.Once
+	file_ratelimit_proto_rawDescData []byte
+)
+
+func file_ratelimit_proto_rawDescGZIP() []byte {
+	file_ratelimit_proto_rawDescOnce.Do(func() {
+		file_ratelimit_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ratelimit_proto_rawDesc), len(file_ratelimit_proto_rawDesc)))
+	})
+	return file_ratelimit_proto_rawDescData
+}
+
+var file_ratelimit_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_ratelimit_proto_goTypes = []any{
+	(*Request)(nil),             // 0: hedzr.rate.v1.Request
+	(*Decision)(nil),            // 1: hedzr.rate.v1.Decision
+	(*durationpb.Duration)(nil), // 2: google.protobuf.Duration
+}
+var file_ratelimit_proto_depIdxs = []int32{
+	2, // 0: hedzr.rate.v1.Request.max_wait:type_name -> google.protobuf.Duration
+	2, // 1: hedzr.rate.v1.Decision.reset_after:type_name -> google.protobuf.Duration
+	2, // 2: hedzr.rate.v1.Decision.retry_after:type_name -> google.protobuf.Duration
+	0, // 3: hedzr.rate.v1.RateLimit.Take:input_type -> hedzr.rate.v1.Request
+	0, // 4: hedzr.rate.v1.RateLimit.Reserve:input_type -> hedzr.rate.v1.Request
+	0, // 5: hedzr.rate.v1.RateLimit.Status:input_type -> hedzr.rate.v1.Request
+	1, // 6: hedzr.rate.v1.RateLimit.Take:output_type -> hedzr.rate.v1.Decision
+	1, // 7: hedzr.rate.v1.RateLimit.Reserve:output_type -> hedzr.rate.v1.Decision
+	1, // 8: hedzr.rate.v1.RateLimit.Status:output_type -> hedzr.rate.v1.Decision
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_ratelimit_proto_init() }
+func file_ratelimit_proto_init() {
+	if File_ratelimit_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ratelimit_proto_rawDesc), len(file_ratelimit_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ratelimit_proto_goTypes,
+		DependencyIndexes: file_ratelimit_proto_depIdxs,
+		MessageInfos:      file_ratelimit_proto_msgTypes,
+	}.Build()
+	File_ratelimit_proto = out.File
+	file_ratelimit_proto_goTypes = nil
+	file_ratelimit_proto_depIdxs = nil
+}
@@ -0,0 +1,207 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: ratelimit.proto
+
+package ratelimitpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RateLimit_Take_FullMethodName    = "/hedzr.rate.v1.RateLimit/Take"
+	RateLimit_Reserve_FullMethodName = "/hedzr.rate.v1.RateLimit/Reserve"
+	RateLimit_Status_FullMethodName  = "/hedzr.rate.v1.RateLimit/Status"
+)
+
+// RateLimitClient is the client API for RateLimit service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// RateLimit is the decision API of ratelimitd, the same as the HTTP/JSON one.
+type RateLimitClient interface {
+	// Take assigns count of allows without blocking
+	Take(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error)
+	// Reserve assigns count of allows, it waits for them at most max_wait
+	Reserve(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error)
+	// Status returns the state of the key without taking
+	Status(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error)
+}
+
+type rateLimitClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRateLimitClient(cc grpc.ClientConnInterface) RateLimitClient {
+	return &rateLimitClient{cc}
+}
+
+func (c *rateLimitClient) Take(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, RateLimit_Take_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rateLimitClient) Reserve(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, RateLimit_Reserve_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rateLimitClient) Status(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Decision, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, RateLimit_Status_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RateLimitServer is the server API for RateLimit service.
+// All implementations must embed UnimplementedRateLimitServer
+// for forward compatibility.
+//
+// RateLimit is the decision API of ratelimitd, the same as the HTTP/JSON one.
+type RateLimitServer interface {
+	// Take assigns count of allows without blocking
+	Take(context.Context, *Request) (*Decision, error)
+	// Reserve assigns count of allows, it waits for them at most max_wait
+	Reserve(context.Context, *Request) (*Decision, error)
+	// Status returns the state of the key without taking
+	Status(context.Context, *Request) (*Decision, error)
+	mustEmbedUnimplementedRateLimitServer()
+}
+
+// UnimplementedRateLimitServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRateLimitServer struct{}
+
+func (UnimplementedRateLimitServer) Take(context.Context, *Request) (*Decision, error) {
+	return nil, status.Error(codes.Unimplemented, "method Take not implemented")
+}
+func (UnimplementedRateLimitServer) Reserve(context.Context, *Request) (*Decision, error) {
+	return nil, status.Error(codes.Unimplemented, "method Reserve not implemented")
+}
+func (UnimplementedRateLimitServer) Status(context.Context, *Request) (*Decision, error) {
+	return nil, status.Error(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedRateLimitServer) mustEmbedUnimplementedRateLimitServer() {}
+func (UnimplementedRateLimitServer) testEmbeddedByValue()                   {}
+
+// UnsafeRateLimitServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RateLimitServer will
+// result in compilation errors.
+type UnsafeRateLimitServer interface {
+	mustEmbedUnimplementedRateLimitServer()
+}
+
+func RegisterRateLimitServer(s grpc.ServiceRegistrar, srv RateLimitServer) {
+	// If the following call panics, it indicates UnimplementedRateLimitServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RateLimit_ServiceDesc, srv)
+}
+
+func _RateLimit_Take_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RateLimitServer).Take(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RateLimit_Take_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RateLimitServer).Take(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RateLimit_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RateLimitServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RateLimit_Reserve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RateLimitServer).Reserve(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RateLimit_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RateLimitServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RateLimit_Status_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RateLimitServer).Status(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RateLimit_ServiceDesc is the grpc.ServiceDesc for RateLimit service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RateLimit_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hedzr.rate.v1.RateLimit",
+	HandlerType: (*RateLimitServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Take",
+			Handler:    _RateLimit_Take_Handler,
+		},
+		{
+			MethodName: "Reserve",
+			Handler:    _RateLimit_Reserve_Handler,
+		},
+		{
+			MethodName: "Status",
+			Handler:    _RateLimit_Status_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "ratelimit.proto",
+}
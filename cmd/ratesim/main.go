@@ -0,0 +1,207 @@
+// Command ratesim replays a traffic against the algorithms on a virtual
+// clock, to compare how they admit it:
+//
+//	ratesim -rate 100/s -pattern bursty -qps 150 -duration 10s
+//	ratesim -rate 100/s -burst 200 -algorithm token-bucket -trace stamps.txt -block
+//
+// The traffic is synthetic (constant, poisson, bursty or sine), or the
+// arrival times recorded in a file, one per line as the seconds or in RFC
+// 3339. The admitted and rejected counts are printed with an ASCII or CSV
+// timeline; with -block, the rejected requests wait and retry like
+// TakeBlocked, and the percentiles of their latencies are printed.
+//
+// With -replay, an access log of nginx or of JSON lines is replayed
+// through a limiter per key of each candidate, and the rejections are
+// reported per key (see package trace):
+//
+//	ratesim -replay access.log -log-format nginx -candidates limits.yaml -top 20
+//
+// The candidates are the definitions of a rateconfig file, or each of
+// -algorithm on -rate and -burst.
+//
+// The algorithms must run on a store (see rate.NewAlgorithm), which takes
+// the time as an argument, so that the simulation takes no real time.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/internal/randomizer"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/rateconfig"
+	"github.com/hedzr/rate/trace"
+)
+
+type options struct {
+	algorithms string
+	rate       string
+	burst      int64
+	traffic    traffic
+	seed       int64
+	trace      string
+	block      bool
+	maxWait    time.Duration
+	slot       time.Duration
+	width      int
+	format     string
+
+	replay     string
+	logFormat  string
+	keyField   string
+	candidates string
+	top        int
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.algorithms, "algorithm", "counter,leaky-bucket,token-bucket", "the comma-separated algorithms to compare")
+	flag.StringVar(&o.rate, "rate", "100/s", "the rate of the limiters, such as 5/min or 100/s")
+	flag.Int64Var(&o.burst, "burst", 0, "the capacity of the limiters, default is the count of -rate")
+	flag.StringVar(&o.traffic.pattern, "pattern", "constant", "the synthetic traffic: constant, poisson, bursty or sine")
+	flag.Float64Var(&o.traffic.qps, "qps", 150, "the mean arrival rate of the synthetic traffic")
+	flag.DurationVar(&o.traffic.duration, "duration", 10*time.Second, "the duration of the synthetic traffic")
+	flag.DurationVar(&o.traffic.period, "period", time.Second, "the period of the bursts and the sine wave")
+	flag.Float64Var(&o.traffic.duty, "duty", 0.1, "the fraction of a period a burst lasts")
+	flag.Float64Var(&o.traffic.amplitude, "amplitude", 0.8, "the amplitude of the sine wave, relative to -qps")
+	flag.Int64Var(&o.seed, "seed", 0, "the seed of the random traffic, 0 for a random one")
+	flag.StringVar(&o.trace, "trace", "", "the file of the recorded arrival times instead of the synthetic traffic, - for stdin")
+	flag.BoolVar(&o.block, "block", false, "the rejected requests wait and retry, like TakeBlocked")
+	flag.DurationVar(&o.maxWait, "max-wait", 0, "the blocked requests give up after, 0 for an hour")
+	flag.DurationVar(&o.slot, "slot", time.Second, "the width of a slot of the timeline")
+	flag.IntVar(&o.width, "width", 60, "the width of the bars of the ASCII timeline")
+	flag.StringVar(&o.format, "format", "text", "the format of the timeline or the replay report: text or csv")
+	flag.StringVar(&o.replay, "replay", "", "the access log to replay through the candidates, - for stdin")
+	flag.StringVar(&o.logFormat, "log-format", "nginx", "the format of the access log: nginx or jsonl")
+	flag.StringVar(&o.keyField, "key-field", "", "the field of the key in the access log, default is remote_addr of nginx or key of jsonl")
+	flag.StringVar(&o.candidates, "candidates", "", "the rateconfig file of the candidates to replay, default is -algorithm on -rate")
+	flag.IntVar(&o.top, "top", 20, "the keys of the most requests to print, 0 for all")
+	flag.Parse()
+
+	if err := run(&o, os.Stdin, os.Stdout, os.Stderr); err != nil {
+		logger.Errorf("ratesim: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(o *options, stdin io.Reader, stdout, stderr io.Writer) error {
+	d := rateconfig.Definition{Rate: o.rate, Burst: o.burst}
+	maxCount, period, err := d.Params()
+	if err != nil {
+		return err
+	}
+	if o.replay != "" {
+		return o.runReplay(stdin, stdout, maxCount, period)
+	}
+	if o.slot <= 0 || o.width < 1 {
+		return errors.New("the slot and the width must be positive")
+	}
+
+	arrivals, err := o.arrivals(stdin)
+	if err != nil {
+		return err
+	}
+
+	var results []*result
+	for _, name := range strings.Split(o.algorithms, ",") {
+		name = strings.TrimSpace(name)
+		alg := rate.NewAlgorithm(rate.Algorithm(name), maxCount, period)
+		if alg == nil {
+			return fmt.Errorf("algorithm %q cannot run on the virtual clock, only the ones of rate.NewAlgorithm can", name)
+		}
+		results = append(results, simulate(name, alg, arrivals, o.block, o.maxWait))
+	}
+
+	switch o.format {
+	case "text":
+		fmt.Fprintf(stdout, "%d requests, limited to %d per %v\n\n", len(arrivals), maxCount, period)
+		printSummary(stdout, results, o.block)
+		for _, res := range results {
+			printTimeline(stdout, res, o.slot, o.width)
+		}
+	case "csv":
+		printSummary(stderr, results, o.block)
+		writeCSV(stdout, results, o.slot)
+	default:
+		return fmt.Errorf("unknown format %q, should be text or csv", o.format)
+	}
+	return nil
+}
+
+func (o *options) arrivals(stdin io.Reader) ([]time.Duration, error) {
+	if o.trace == "" {
+		o.traffic.rnd = randomizer.New()
+		if o.seed != 0 {
+			o.traffic.rnd = randomizer.NewWithSeed(o.seed)
+		}
+		return o.traffic.arrivals()
+	}
+	r, closer, err := open(o.trace, stdin)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	return readTrace(r)
+}
+
+func (o *options) runReplay(stdin io.Reader, stdout io.Writer, maxCount int64, period time.Duration) error {
+	var candidates []plan.Plan
+	if o.candidates != "" {
+		c, err := rateconfig.Load(o.candidates)
+		if err != nil {
+			return err
+		}
+		if candidates, err = c.Plans(); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range strings.Split(o.algorithms, ",") {
+			name = strings.TrimSpace(name)
+			candidates = append(candidates, plan.Plan{Name: name + " " + o.rate, Algorithm: rate.Algorithm(name), MaxCount: maxCount, Period: period})
+		}
+	}
+
+	var opts []trace.Option
+	if o.keyField != "" {
+		opts = append(opts, trace.WithKeyField(o.keyField))
+	}
+	r, closer, err := open(o.replay, stdin)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	events, err := trace.ReadAll(r, trace.Format(o.logFormat), opts...)
+	if err != nil {
+		return err
+	}
+	rep, err := trace.Replay(events, candidates)
+	if err != nil {
+		return err
+	}
+	switch o.format {
+	case "text":
+		return rep.WriteText(stdout, o.top)
+	case "csv":
+		return rep.WriteCSV(stdout)
+	}
+	return fmt.Errorf("unknown format %q, should be text or csv", o.format)
+}
+
+// open opens the file at path, or stdin if path is "-"
+func open(path string, stdin io.Reader) (r io.Reader, closer func(), err error) {
+	if path == "-" {
+		return stdin, func() {}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
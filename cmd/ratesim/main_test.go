@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/internal/randomizer"
+	"github.com/hedzr/rate/tokenbucket"
+)
+
+func TestPatterns(t *testing.T) {
+	for _, pattern := range []string{"constant", "poisson", "bursty", "sine"} {
+		tr := traffic{pattern: pattern, qps: 100, duration: 10 * time.Second, period: time.Second, duty: 0.1, amplitude: 0.8, rnd: randomizer.NewWithSeed(1)}
+		at, err := tr.arrivals()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(at); n < 900 || n > 1100 {
+			t.Fatalf("%v: expecting about 1000 arrivals, got %v", pattern, n)
+		}
+		for i := 1; i < len(at); i++ {
+			if at[i] < at[i-1] || at[i] >= tr.duration {
+				t.Fatalf("%v: the arrivals should be sorted in the duration", pattern)
+			}
+		}
+	}
+	if _, err := (&traffic{pattern: "zigzag", qps: 1, duration: time.Second}).arrivals(); err == nil {
+		t.Fatal("expecting an unknown pattern rejected")
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	at, err := readTrace(strings.NewReader("# recorded\n1700000000.5\n\n1700000000.25\n2023-11-14T22:13:21Z\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{0, 250 * time.Millisecond, 750 * time.Millisecond}
+	for i := range want {
+		if at[i] != want[i] {
+			t.Fatalf("expecting %v, got %v", want, at)
+		}
+	}
+	if _, err = readTrace(strings.NewReader("1\nyesterday\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expecting the bad line reported, got %v", err)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	// 20/s against 10/s for 3s
+	var arrivals []time.Duration
+	for at := time.Duration(0); at < 3*time.Second; at += 50 * time.Millisecond {
+		arrivals = append(arrivals, at)
+	}
+	alg := tokenbucket.NewAlgorithm(10, time.Second)
+
+	res := simulate("token-bucket", alg, arrivals, false, 0)
+	if len(res.admittedAt) != 39 || len(res.rejectedAt) != 21 {
+		t.Fatalf("expecting 39 admitted, got %v/%v", len(res.admittedAt), len(res.rejectedAt))
+	}
+
+	res = simulate("token-bucket", alg, arrivals, true, 0)
+	if len(res.admittedAt) != 60 || res.percentile(100) != 2050*time.Millisecond {
+		t.Fatalf("expecting all admitted in 2.05s at most, got %v in %v", len(res.admittedAt), res.percentile(100))
+	}
+	res = simulate("token-bucket", alg, arrivals, true, time.Second)
+	if len(res.rejectedAt) == 0 || res.percentile(100) > time.Second {
+		t.Fatalf("expecting the waits longer than 1s given up, got %v in %v", len(res.rejectedAt), res.percentile(100))
+	}
+}
+
+func TestRun(t *testing.T) {
+	o := options{algorithms: "counter,leaky-bucket,token-bucket", rate: "10/s", slot: time.Second, width: 20, format: "csv", trace: "-"}
+	var stdout, stderr bytes.Buffer
+	if err := run(&o, strings.NewReader("0\n0.1\n0.2\n1.5\n"), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout.String(), "algorithm,start_ms,arrivals,admitted,rejected\ncounter,0,3,3,0\n") {
+		t.Fatalf("unexpected csv:\n%v", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "token-bucket") {
+		t.Fatalf("expecting the summary, got:\n%v", stderr.String())
+	}
+
+	o.algorithms = "priority-token-bucket"
+	if err := run(&o, strings.NewReader("0\n"), &stdout, &stderr); err == nil {
+		t.Fatal("expecting an algorithm without store rejected")
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	log := `{"time":"2026-10-10T00:00:00Z","key":"k1"}
+{"time":"2026-10-10T00:00:00.1Z","key":"k1"}
+{"time":"2026-10-10T00:00:00.2Z","key":"k1"}
+{"time":"2026-10-10T00:00:00.3Z","key":"k2"}
+`
+	o := options{algorithms: "counter,token-bucket", rate: "2/s", format: "csv", replay: "-", logFormat: "jsonl"}
+	var stdout, stderr bytes.Buffer
+	if err := run(&o, strings.NewReader(log), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if want := "key,requests,counter 2/s,token-bucket 2/s\nk1,3,1,1\nk2,1,0,0\n"; stdout.String() != want {
+		t.Fatalf("expecting:\n%v\ngot:\n%v", want, stdout.String())
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hedzr/rate/internal/randomizer"
+	"github.com/hedzr/rate/store"
+)
+
+// traffic describes a synthetic traffic pattern
+type traffic struct {
+	pattern   string        // constant, poisson, bursty or sine
+	qps       float64       // the mean arrival rate
+	duration  time.Duration // of the traffic
+	period    time.Duration // of the bursts and the sine wave
+	duty      float64       // the fraction of a period the burst lasts
+	amplitude float64       // of the sine wave, relative to qps
+	rnd       randomizer.Randomizer
+}
+
+// arrivals returns the arrival times of the requests, as the offsets from
+// the start of the traffic.
+func (t *traffic) arrivals() ([]time.Duration, error) {
+	if t.qps <= 0 || t.duration <= 0 {
+		return nil, fmt.Errorf("the qps and the duration must be positive")
+	}
+	var at []time.Duration
+	seconds := t.duration.Seconds()
+	switch t.pattern {
+	case "constant":
+		for i := 0; ; i++ {
+			s := float64(i) / t.qps
+			if s >= seconds {
+				break
+			}
+			at = append(at, secondsOf(s))
+		}
+	case "poisson":
+		for s := t.exp(t.qps); s < seconds; s += t.exp(t.qps) {
+			at = append(at, secondsOf(s))
+		}
+	case "bursty":
+		if t.period <= 0 || t.duty <= 0 || t.duty > 1 {
+			return nil, fmt.Errorf("bursty needs a positive period and a duty in (0, 1]")
+		}
+		p := t.period.Seconds()
+		n := int(math.Round(t.qps * p))
+		for start := 0.0; start < seconds; start += p {
+			for i := 0; i < n; i++ {
+				if s := start + p*t.duty*float64(i)/float64(n); s < seconds {
+					at = append(at, secondsOf(s))
+				}
+			}
+		}
+	case "sine":
+		if t.period <= 0 || t.amplitude < 0 || t.amplitude > 1 {
+			return nil, fmt.Errorf("sine needs a positive period and an amplitude in [0, 1]")
+		}
+		// a Poisson process of the varying rate, by thinning the one of
+		// the peak rate
+		peak := t.qps * (1 + t.amplitude)
+		w := 2 * math.Pi / t.period.Seconds()
+		for s := t.exp(peak); s < seconds; s += t.exp(peak) {
+			if t.rnd.NextFloat64()*peak < t.qps*(1+t.amplitude*math.Sin(w*s)) {
+				at = append(at, secondsOf(s))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown pattern %q, should be constant, poisson, bursty or sine", t.pattern)
+	}
+	return at, nil
+}
+
+// exp returns an exponential interval of the rate
+func (t *traffic) exp(rate float64) float64 { return -math.Log(1-t.rnd.NextFloat64()) / rate }
+
+func secondsOf(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+
+// readTrace reads the recorded arrival times, one per line, as the seconds
+// in decimal (such as the unix time '1700000000.125') or in RFC 3339. The
+// blank lines and the ones starting with '#' are skipped. The result is
+// sorted and relative to the earliest one.
+func readTrace(r io.Reader) ([]time.Duration, error) {
+	var stamps []int64
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if d, err := time.ParseDuration(s + "s"); err == nil { // exact, unlike a float
+			stamps = append(stamps, int64(d))
+		} else if tm, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			stamps = append(stamps, tm.UnixNano())
+		} else {
+			return nil, fmt.Errorf("line %d: %q is neither the seconds nor a RFC 3339 time", line, s)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+	at := make([]time.Duration, len(stamps))
+	for i, st := range stamps {
+		at[i] = time.Duration(st - stamps[0])
+	}
+	return at, nil
+}
+
+// epoch is the start of the virtual clock
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+const (
+	// minRetry is the least wait of a blocked request before it retries
+	minRetry = time.Microsecond
+	// giveUp is the wait of a blocked request without maxWait, in case
+	// an algorithm never admits it
+	giveUp = time.Hour
+)
+
+// result is the outcome of a simulation
+type result struct {
+	algorithm  string
+	arrivals   []time.Duration
+	admittedAt []time.Duration
+	rejectedAt []time.Duration
+	latencies  []time.Duration // of the admitted requests, sorted
+}
+
+// simulate replays the arrivals against alg on a virtual clock. In the
+// blocking mode, a rejected request retries after the wait hinted by alg,
+// like TakeBlocked does, and gives up after maxWait, or an hour if it is
+// not positive.
+func simulate(name string, alg store.Algorithm, arrivals []time.Duration, block bool, maxWait time.Duration) *result {
+	res := &result{algorithm: name, arrivals: arrivals}
+	if maxWait <= 0 {
+		maxWait = giveUp
+	}
+	var st store.State
+	exists := false
+	decide := func(at time.Duration) (ok bool, wait time.Duration) {
+		// the state is stored even if rejected, like store.NewLimiter does
+		st, ok, wait = alg.Decide(st, exists, epoch+int64(at), 1)
+		exists = true
+		return
+	}
+
+	if !block {
+		for _, at := range arrivals {
+			if ok, _ := decide(at); ok {
+				res.admittedAt = append(res.admittedAt, at)
+				res.latencies = append(res.latencies, 0)
+			} else {
+				res.rejectedAt = append(res.rejectedAt, at)
+			}
+		}
+		return res
+	}
+
+	q := make(requests, 0, len(arrivals))
+	for i, at := range arrivals {
+		q = append(q, request{arrival: at, at: at, seq: i})
+	}
+	heap.Init(&q)
+	for q.Len() > 0 {
+		r := heap.Pop(&q).(request)
+		ok, wait := decide(r.at)
+		switch {
+		case ok:
+			res.admittedAt = append(res.admittedAt, r.at)
+			res.latencies = append(res.latencies, r.at-r.arrival)
+		case r.at+wait-r.arrival > maxWait:
+			res.rejectedAt = append(res.rejectedAt, r.at)
+		default:
+			if wait < minRetry {
+				wait = minRetry
+			}
+			r.at += wait
+			heap.Push(&q, r)
+		}
+	}
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	return res
+}
+
+// request is a pending request of the blocking mode
+type request struct {
+	arrival time.Duration
+	at      time.Duration // of the next try
+	seq     int
+}
+
+// requests is a min-heap of the next tries, the earlier arrival first
+// on the ties
+type requests []request
+
+func (q requests) Len() int { return len(q) }
+func (q requests) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q requests) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *requests) Push(x interface{}) { *q = append(*q, x.(request)) }
+func (q *requests) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+// percentile returns the p-th percentile of the sorted latencies, by the
+// nearest rank
+func (res *result) percentile(p float64) time.Duration {
+	if len(res.latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(res.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return res.latencies[i]
+}
+
+// bucket is a slot of the timeline
+type bucket struct {
+	start                        time.Duration
+	arrivals, admitted, rejected int
+}
+
+// timeline counts the events of res in the slots of width
+func (res *result) timeline(width time.Duration) []bucket {
+	var bs []bucket
+	count := func(events []time.Duration, field func(b *bucket) *int) {
+		for _, at := range events {
+			i := int(at / width)
+			for len(bs) <= i {
+				bs = append(bs, bucket{start: time.Duration(len(bs)) * width})
+			}
+			*field(&bs[i])++
+		}
+	}
+	count(res.arrivals, func(b *bucket) *int { return &b.arrivals })
+	count(res.admittedAt, func(b *bucket) *int { return &b.admitted })
+	count(res.rejectedAt, func(b *bucket) *int { return &b.rejected })
+	return bs
+}
+
+func printSummary(w io.Writer, results []*result, block bool) {
+	fmt.Fprintf(w, "%-22s %9s %9s %7s", "algorithm", "admitted", "rejected", "admit%")
+	if block {
+		fmt.Fprintf(w, " %10s %10s %10s %10s", "p50", "p90", "p99", "max")
+	}
+	fmt.Fprintln(w)
+	for _, res := range results {
+		admitted, rejected := len(res.admittedAt), len(res.rejectedAt)
+		ratio := 0.0
+		if total := admitted + rejected; total > 0 {
+			ratio = 100 * float64(admitted) / float64(total)
+		}
+		fmt.Fprintf(w, "%-22s %9d %9d %6.1f%%", res.algorithm, admitted, rejected, ratio)
+		if block {
+			for _, p := range []float64{50, 90, 99, 100} {
+				fmt.Fprintf(w, " %10v", res.percentile(p).Round(time.Microsecond))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// printTimeline draws a bar per slot, '#' for the admitted requests and
+// 'x' for the rejected ones, scaled to width columns.
+func printTimeline(w io.Writer, res *result, slot time.Duration, width int) {
+	bs := res.timeline(slot)
+	most := 1
+	for _, b := range bs {
+		if n := b.admitted + b.rejected; n > most {
+			most = n
+		}
+	}
+	scale := func(n int) int { return int(math.Ceil(float64(n) * float64(width) / float64(most))) }
+	fmt.Fprintf(w, "\n%v ('#' admitted, 'x' rejected, %.3g requests per column)\n", res.algorithm, float64(most)/float64(width))
+	for _, b := range bs {
+		fmt.Fprintf(w, "%10v %6d %6d |%s%s\n", b.start, b.admitted, b.rejected,
+			strings.Repeat("#", scale(b.admitted)), strings.Repeat("x", scale(b.rejected)))
+	}
+}
+
+func writeCSV(w io.Writer, results []*result, slot time.Duration) {
+	fmt.Fprintln(w, "algorithm,start_ms,arrivals,admitted,rejected")
+	for _, res := range results {
+		for _, b := range res.timeline(slot) {
+			fmt.Fprintf(w, "%v,%d,%d,%d,%d\n", res.algorithm, b.start.Milliseconds(), b.arrivals, b.admitted, b.rejected)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package concurrency
+
+import (
+	"math"
+	"time"
+)
+
+// AIMD increases the limit by one for each successful request while the
+// limit is in use, and multiplies it by BackoffRatio on each drop.
+type AIMD struct {
+	Initial      int     // the initial limit, default is 20
+	MinLimit     int     // default is 1
+	MaxLimit     int     // default is 1000
+	BackoffRatio float64 // in (0, 1), default is 0.9
+}
+
+// NewAIMD returns an AIMD algorithm with the default settings
+func NewAIMD() *AIMD { return &AIMD{} }
+
+// InitialLimit implements Algorithm
+func (a *AIMD) InitialLimit() int { return orDefault(a.Initial, 20) }
+
+// Update implements Algorithm
+func (a *AIMD) Update(limit int, rtt time.Duration, inFlight int, dropped bool) int {
+	if dropped {
+		ratio := a.BackoffRatio
+		if ratio <= 0 || ratio >= 1 {
+			ratio = 0.9
+		}
+		limit = int(float64(limit) * ratio)
+	} else if inFlight*2 >= limit {
+		// grow only while the limit is really in use
+		limit++
+	}
+	return clamp(limit, orDefault(a.MinLimit, 1), orDefault(a.MaxLimit, 1000))
+}
+
+// Vegas estimates the queue built in the downstream from the ratio of the
+// minimal RTT without load and the RTT observed, and moves the limit to
+// keep the queue between Alpha and Beta, as TCP Vegas does.
+//
+// The minimal RTT is forgotten every ProbeInterval, so the limiter can
+// follow a downstream which becomes slower permanently.
+type Vegas struct {
+	Initial       int           // the initial limit, default is 20
+	MinLimit      int           // default is 1
+	MaxLimit      int           // default is 1000
+	ProbeInterval time.Duration // default is one minute
+
+	// Alpha, Beta and Threshold compute the bounds of the acceptable queue
+	// from the current limit, default to 3*log10(limit), 6*log10(limit)
+	// and log10(limit).
+	Alpha, Beta, Threshold func(limit int) int
+
+	rttNoLoad time.Duration
+	probeAt   time.Time
+	estimated float64
+}
+
+// NewVegas returns a Vegas algorithm with the default settings
+func NewVegas() *Vegas { return &Vegas{} }
+
+// InitialLimit implements Algorithm
+func (v *Vegas) InitialLimit() int { return orDefault(v.Initial, 20) }
+
+// Update implements Algorithm
+func (v *Vegas) Update(limit int, rtt time.Duration, inFlight int, dropped bool) int {
+	if rtt <= 0 {
+		return limit
+	}
+
+	now := time.Now()
+	if v.rttNoLoad == 0 || rtt < v.rttNoLoad || now.After(v.probeAt) {
+		v.rttNoLoad = rtt
+		v.probeAt = now.Add(orDefaultDuration(v.ProbeInterval, time.Minute))
+		return limit
+	}
+	if v.estimated == 0 {
+		v.estimated = float64(limit)
+	}
+
+	logLimit := func(l int) int { return int(math.Max(1, math.Ceil(math.Log10(float64(l))))) }
+	alpha, beta, threshold := v.Alpha, v.Beta, v.Threshold
+	if alpha == nil {
+		alpha = func(l int) int { return 3 * logLimit(l) }
+	}
+	if beta == nil {
+		beta = func(l int) int { return 6 * logLimit(l) }
+	}
+	if threshold == nil {
+		threshold = logLimit
+	}
+
+	queue := int(math.Ceil(v.estimated * (1 - float64(v.rttNoLoad)/float64(rtt))))
+	current := int(v.estimated)
+	switch {
+	case dropped:
+		v.estimated -= float64(logLimit(current))
+	case inFlight*2 < current:
+		// the limit is not in use, the samples tell nothing about it
+		return limit
+	case queue <= threshold(current):
+		v.estimated += float64(beta(current))
+	case queue < alpha(current):
+		v.estimated += float64(logLimit(current))
+	case queue > beta(current):
+		v.estimated -= float64(logLimit(current))
+	}
+
+	v.estimated = float64(clamp(int(v.estimated), orDefault(v.MinLimit, 1), orDefault(v.MaxLimit, 1000)))
+	return int(v.estimated)
+}
+
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func orDefaultDuration(v, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,223 @@
+// Package concurrency implements an adaptive limiter for in-flight requests
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Outcome tells the limiter how a request completed
+type Outcome int
+
+const (
+	// Success means the request completed normally, its RTT is a valid sample
+	Success Outcome = iota
+	// Dropped means the request timed out or was rejected by the downstream,
+	// which is a signal of overloading
+	Dropped
+	// Ignored means the request should not affect the limit, such as one
+	// canceled by the client
+	Ignored
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Success:
+		return "success"
+	case Dropped:
+		return "dropped"
+	case Ignored:
+		return "ignored"
+	}
+	return "unknown"
+}
+
+// Algorithm computes the concurrency limit from the samples of the completed requests.
+//
+// Update is always called with the limiter locked, so an algorithm needs
+// not to be safe for concurrent use.
+type Algorithm interface {
+	// InitialLimit returns the limit before any sample arrived.
+	InitialLimit() int
+	// Update returns the new limit after a request completed. rtt is the
+	// round-trip time of the request and inFlight is the count of the
+	// requests in flight when it started, including itself.
+	Update(limit int, rtt time.Duration, inFlight int, dropped bool) int
+}
+
+// ReleaseFunc must be called once when the request acquired completes.
+type ReleaseFunc func(outcome Outcome)
+
+// Limiter represents an adaptive concurrency limiter
+type Limiter interface {
+	// Acquire waits for a free slot until ctx is done.
+	Acquire(ctx context.Context) (release ReleaseFunc, err error)
+	// TryAcquire acquires a free slot without blocking.
+	TryAcquire() (release ReleaseFunc, ok bool)
+	// Limit returns the current concurrency limit
+	Limit() int
+	// InFlight returns the count of the acquired slots
+	InFlight() int
+	// Close wakes up all waiters with ErrClosed.
+	Close()
+	// Available returns a number for 'X-RateLimit-Remaining'
+	Available() int64
+	// Capacity returns a number for 'X-RateLimit-Limit'
+	Capacity() int64
+}
+
+// Option configures the limiter built by New
+type Option func(s *limiter)
+
+// WithQueueSize limits how many callers can wait in Acquire. The extra
+// callers fail with ErrQueueFull immediately. n <= 0 means unlimited.
+func WithQueueSize(n int) Option {
+	return func(s *limiter) { s.queueSize = n }
+}
+
+// New make a new instance of the concurrency limiter driven by alg.
+func New(alg Algorithm, opts ...Option) Limiter {
+	s := &limiter{alg: alg, limit: alg.InitialLimit(), waiters: list.New()}
+	if s.limit < 1 {
+		s.limit = 1
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+var (
+	// ErrQueueFull is returned by Acquire when too many callers are waiting
+	ErrQueueFull = errors.New("concurrency: too many waiters")
+	// ErrClosed is returned by Acquire after the limiter closed
+	ErrClosed = errors.New("concurrency: limiter closed")
+)
+
+type limiter struct {
+	alg       Algorithm
+	queueSize int
+
+	rw       sync.Mutex
+	limit    int
+	inFlight int
+	waiters  *list.List // of chan struct{}
+	closed   bool
+}
+
+func (s *limiter) Limit() int {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return s.limit
+}
+
+func (s *limiter) InFlight() int {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return s.inFlight
+}
+
+func (s *limiter) Available() int64 {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if r := s.limit - s.inFlight; r > 0 {
+		return int64(r)
+	}
+	return 0
+}
+
+func (s *limiter) Capacity() int64 { return int64(s.Limit()) }
+
+func (s *limiter) Close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.closed = true
+	for e := s.waiters.Front(); e != nil; e = e.Next() {
+		close(e.Value.(chan struct{}))
+	}
+	s.waiters.Init()
+}
+
+func (s *limiter) TryAcquire() (release ReleaseFunc, ok bool) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed || s.inFlight >= s.limit || s.waiters.Len() > 0 {
+		return nil, false
+	}
+	s.inFlight++
+	return s.releaser(s.inFlight), true
+}
+
+func (s *limiter) Acquire(ctx context.Context) (release ReleaseFunc, err error) {
+	if release, ok := s.TryAcquire(); ok {
+		return release, nil
+	}
+
+	s.rw.Lock()
+	if s.closed {
+		s.rw.Unlock()
+		return nil, ErrClosed
+	}
+	if s.queueSize > 0 && s.waiters.Len() >= s.queueSize {
+		s.rw.Unlock()
+		return nil, ErrQueueFull
+	}
+	ch := make(chan struct{})
+	e := s.waiters.PushBack(ch)
+	s.rw.Unlock()
+
+	select {
+	case <-ch:
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		if s.closed {
+			return nil, ErrClosed
+		}
+		return s.releaser(s.inFlight), nil // the slot was counted by grant()
+	case <-ctx.Done():
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		select {
+		case <-ch:
+			if !s.closed {
+				// granted just now, give the slot to the next one
+				s.inFlight--
+				s.grant()
+			}
+		default:
+			s.waiters.Remove(e)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// grant wakes up the waiters while there are free slots, the caller must hold the lock
+func (s *limiter) grant() {
+	for s.inFlight < s.limit && s.waiters.Len() > 0 {
+		ch := s.waiters.Remove(s.waiters.Front()).(chan struct{})
+		s.inFlight++
+		close(ch)
+	}
+}
+
+func (s *limiter) releaser(inFlight int) ReleaseFunc {
+	start := time.Now()
+	var once sync.Once
+	return func(outcome Outcome) {
+		once.Do(func() {
+			rtt := time.Since(start)
+			s.rw.Lock()
+			defer s.rw.Unlock()
+			s.inFlight--
+			if outcome != Ignored {
+				if s.limit = s.alg.Update(s.limit, rtt, inFlight, outcome == Dropped); s.limit < 1 {
+					s.limit = 1
+				}
+			}
+			s.grant()
+		})
+	}
+}
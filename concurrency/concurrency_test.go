@@ -0,0 +1,165 @@
+package concurrency_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/concurrency"
+)
+
+func TestAcquireRelease(t *testing.T) {
+	l := concurrency.New(&concurrency.AIMD{Initial: 2, MaxLimit: 2})
+	defer l.Close()
+
+	r1, ok1 := l.TryAcquire()
+	r2, ok2 := l.TryAcquire()
+	if !ok1 || !ok2 {
+		t.Fatal("two slots should be free")
+	}
+	if _, ok := l.TryAcquire(); ok || l.Available() != 0 || l.InFlight() != 2 {
+		t.Fatalf("the limiter should be full, in-flight: %v", l.InFlight())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		release, err := l.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		release(concurrency.Success)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r1(concurrency.Success)
+	r1(concurrency.Success) // releasing twice is harmless
+	<-done
+	r2(concurrency.Ignored)
+
+	if l.InFlight() != 0 {
+		t.Fatalf("all slots should be released, in-flight: %v", l.InFlight())
+	}
+}
+
+func TestQueueSizeAndClose(t *testing.T) {
+	l := concurrency.New(&concurrency.AIMD{Initial: 1}, concurrency.WithQueueSize(1))
+	release, _ := l.TryAcquire()
+	defer release(concurrency.Ignored)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := l.Acquire(context.Background()); err != concurrency.ErrQueueFull {
+		t.Fatalf("expecting queue full, got %v", err)
+	}
+	l.Close()
+	if err := <-errs; err != concurrency.ErrClosed {
+		t.Fatalf("expecting closed, got %v", err)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	a := &concurrency.AIMD{Initial: 10, MinLimit: 2, MaxLimit: 12}
+	limit := a.InitialLimit()
+	if limit = a.Update(limit, time.Millisecond, 2, false); limit != 10 {
+		t.Fatalf("an unused limit should not grow, got %v", limit)
+	}
+	for i := 0; i < 5; i++ {
+		limit = a.Update(limit, time.Millisecond, limit, false)
+	}
+	if limit != 12 {
+		t.Fatalf("expecting the limit grows to max, got %v", limit)
+	}
+	for i := 0; i < 30; i++ {
+		limit = a.Update(limit, time.Millisecond, limit, true)
+	}
+	if limit != 2 {
+		t.Fatalf("expecting the limit backs off to min, got %v", limit)
+	}
+}
+
+func TestVegas(t *testing.T) {
+	v := &concurrency.Vegas{Initial: 20, MaxLimit: 100}
+	limit := v.InitialLimit()
+	limit = v.Update(limit, 10*time.Millisecond, limit, false) // the first sample is the rtt without load
+	for i := 0; i < 10; i++ {
+		limit = v.Update(limit, 10*time.Millisecond, limit, false)
+	}
+	if limit <= 20 {
+		t.Fatalf("the limit should grow while the latency is flat, got %v", limit)
+	}
+	grown := limit
+	for i := 0; i < 10; i++ {
+		limit = v.Update(limit, 50*time.Millisecond, limit, false)
+	}
+	if limit >= grown {
+		t.Fatalf("the limit should shrink while the latency is rising, got %v (was %v)", limit, grown)
+	}
+}
+
+func TestAdaptsToLatency(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		alg     concurrency.Algorithm
+		timeout time.Duration // the requests slower are dropped, 0 means never
+	}{
+		{"aimd", &concurrency.AIMD{Initial: 4, MaxLimit: 64}, 15 * time.Millisecond},
+		{"vegas", &concurrency.Vegas{Initial: 4, MaxLimit: 64}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := concurrency.New(tc.alg)
+			defer l.Close()
+
+			// drive sends n requests by 64 callers to a downstream of latency
+			drive := func(latency time.Duration, n int) int {
+				var wg sync.WaitGroup
+				left := int32(n)
+				for i := 0; i < 64; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for atomic.AddInt32(&left, -1) >= 0 {
+							release, err := l.Acquire(context.Background())
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							time.Sleep(latency)
+							if tc.timeout > 0 && latency > tc.timeout {
+								release(concurrency.Dropped)
+							} else {
+								release(concurrency.Success)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				return l.Limit()
+			}
+
+			grown := drive(5*time.Millisecond, 300)
+			if grown <= 4 {
+				t.Fatalf("the limit should grow while the downstream is fast, got %v", grown)
+			}
+			lowered := drive(25*time.Millisecond, 64)
+			if lowered >= grown {
+				t.Fatalf("the limit should go down under the added latency, got %v (was %v)", lowered, grown)
+			}
+			if recovered := drive(5*time.Millisecond, 300); recovered <= lowered {
+				t.Fatalf("the limit should go up after the downstream recovered, got %v (was %v)", recovered, lowered)
+			}
+		})
+	}
+}
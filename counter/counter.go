@@ -2,10 +2,15 @@
 package counter
 
 import (
-	"github.com/hedzr/rate/rateapi"
 	"time"
+
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 )
 
+// name is the name of the algorithm in the snapshots, the same as rate.Counter
+const name = "counter"
+
 // New make a new instance of limiter
 func New(maxCount int64, d time.Duration) rateapi.Limiter {
 	return &counter{
@@ -17,6 +22,57 @@ func New(maxCount int64, d time.Duration) rateapi.Limiter {
 	}
 }
 
+// NewWithStore make a new instance of limiter whose state of key lives in s
+func NewWithStore(maxCount int64, d time.Duration, s store.Store, key string) rateapi.Limiter {
+	return store.NewLimiter(s, key, NewAlgorithm(maxCount, d))
+}
+
+// NewAlgorithm returns the counter algorithm for store.NewLimiter.
+//
+// The state Count is the requests in the window, Stamp is the end of the window.
+func NewAlgorithm(maxCount int64, d time.Duration) store.Algorithm {
+	return algorithm{maxCount, d}
+}
+
+type algorithm struct {
+	maximal int64
+	period  time.Duration
+}
+
+func (a algorithm) Capacity() int64 { return a.maximal }
+func (a algorithm) String() string  { return name }
+
+func (a algorithm) Decide(st store.State, exists bool, now int64, count int) (store.State, bool, time.Duration) {
+	if now > st.Stamp {
+		// if timeout, reset counter regally at first
+		st.Count = 0
+		st.Stamp = now + int64(a.period)
+	}
+
+	st.Count += int64(count) // it's acceptable in HPC scene
+	if st.Count <= a.maximal {
+		return st, true, 0
+	}
+	return st, false, time.Duration(st.Stamp - now)
+}
+
+func (a algorithm) Available(st store.State, exists bool, now int64) int64 {
+	if now > st.Stamp {
+		return a.maximal
+	}
+	if r := a.maximal - st.Count; r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (a algorithm) Reset(st store.State, exists bool, now int64) time.Duration {
+	if now > st.Stamp {
+		return 0
+	}
+	return time.Duration(st.Stamp - now)
+}
+
 type counter struct {
 	enabled bool
 	Maximal int
@@ -29,14 +85,10 @@ func (s *counter) Enabled() bool     { return s.enabled }
 func (s *counter) SetEnabled(b bool) { s.enabled = b }
 
 func (s *counter) take(count int) bool {
-	if time.Now().UnixNano() > s.tick {
-		// if timeout, reset counter regally at first
-		s.count = 0
-		s.tick = time.Now().Add(s.Period).UnixNano()
-	}
-
-	s.count += count            // it's acceptable in HPC scene
-	return s.count <= s.Maximal // it's acceptable in HPC scene
+	a := algorithm{int64(s.Maximal), s.Period}
+	st, ok, _ := a.Decide(store.State{Count: int64(s.count), Stamp: s.tick}, true, time.Now().UnixNano(), count)
+	s.count, s.tick = int(st.Count), st.Stamp
+	return ok
 }
 
 func (s *counter) Take(count int) bool {
@@ -55,8 +107,26 @@ func (s *counter) TakeBlocked(count int) (requestAt time.Time) {
 	return
 }
 
-func (s *counter) Ticks() int64     { return s.tick }
-func (s *counter) Count() int       { return s.count }
-func (s *counter) Available() int64 { return int64(s.count) }
-func (s *counter) Capacity() int64  { return int64(s.Maximal) }
-func (s *counter) Close()           {}
+func (s *counter) Ticks() int64 { return s.tick }
+func (s *counter) Count() int   { return s.count }
+func (s *counter) Available() int64 {
+	st := store.State{Count: int64(s.count), Stamp: s.tick}
+	return algorithm{int64(s.Maximal), s.Period}.Available(st, true, time.Now().UnixNano())
+}
+func (s *counter) Capacity() int64 { return int64(s.Maximal) }
+func (s *counter) Close()          {}
+
+// Snapshot implements rateapi.Snapshotter
+func (s *counter) Snapshot() ([]byte, error) {
+	return store.MarshalStates(name, store.State{Count: int64(s.count), Stamp: s.tick}), nil
+}
+
+// Restore implements rateapi.Snapshotter, the window in data goes on if
+// it has not ended.
+func (s *counter) Restore(data []byte) error {
+	st, _, err := store.UnmarshalState(data, name)
+	if err == nil {
+		s.count, s.tick = int(st.Count), st.Stamp
+	}
+	return err
+}
@@ -5,6 +5,8 @@ import (
 	"math/rand"
 	"testing"
 	"time"
+
+	"github.com/hedzr/rate/store"
 )
 
 func BenchmarkRandInt(b *testing.B) {
@@ -45,3 +47,59 @@ func TestCounterLimiterBlocked(b *testing.T) {
 	b.Log(l.Enabled(), l.Available(), l.Capacity())
 	l.SetEnabled(false)
 }
+
+func TestCounterAlgorithm(t *testing.T) {
+	a := NewAlgorithm(3, time.Second)
+	var st store.State
+	exists := false
+	now := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		var ok bool
+		if st, ok, _ = a.Decide(st, exists, now, 1); !ok {
+			t.Fatalf("#%d should be allowed", i)
+		}
+		exists = true
+	}
+	if a.Available(st, true, now) != 0 {
+		t.Fatal("the window should be exhausted")
+	}
+	if _, ok, wait := a.Decide(st, true, now, 1); ok || wait != time.Second {
+		t.Fatalf("expecting to wait for the end of window, got %v", wait)
+	}
+	if _, ok, _ := a.Decide(st, true, now+int64(time.Second)+1, 1); !ok {
+		t.Fatal("a new window should be allowed")
+	}
+}
+
+func TestCounterWithStore(t *testing.T) {
+	m := store.NewMemory()
+	l := NewWithStore(2, time.Hour, m, "k")
+	if !l.Take(1) || !l.Take(1) || l.Take(1) {
+		t.Fatal("expecting 2 allowed in the window")
+	}
+	if st, ok, _ := m.Load("k"); !ok || st.Count != 3 {
+		t.Fatalf("the state should live in the store, got %+v", st)
+	}
+}
+
+func TestCounterSnapshot(t *testing.T) {
+	l := New(5, time.Hour).(*counter)
+	l.Take(3)
+	data, err := l.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := New(5, time.Hour).(*counter)
+	if err = l2.Restore(data); err != nil || !l2.Take(2) || l2.Take(1) {
+		t.Fatalf("expecting the window restored, got %v, %v", l2.Count(), err)
+	}
+
+	// the window ended in the downtime
+	data = store.MarshalStates(name, store.State{Count: 5, Stamp: time.Now().Add(-time.Minute).UnixNano()})
+	if err = l2.Restore(data); err != nil || !l2.Take(5) {
+		t.Fatalf("expecting a new window, got %v", err)
+	}
+	if err = l2.Restore(store.MarshalStates("token-bucket")); err == nil {
+		t.Fatal("a snapshot of another algorithm should not be restored")
+	}
+}
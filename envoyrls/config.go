@@ -0,0 +1,144 @@
+package envoyrls
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/hedzr/rate/calendar"
+)
+
+// Config is the limits of a domain, in the same shape as the config
+// files of lyft/ratelimit:
+//
+//	domain: edge
+//	descriptors:
+//	  - key: remote_address
+//	    rate_limit:
+//	      unit: minute
+//	      requests_per_unit: 60
+//	  - key: path
+//	    value: /login
+//	    descriptors:
+//	      - key: remote_address
+//	        rate_limit: { unit: hour, requests_per_unit: 10 }
+//	        shadow_mode: true
+//	  - key: path
+//	    value: /healthz
+//	    rate_limit: { unlimited: true }
+type Config struct {
+	Domain      string       `yaml:"domain"`
+	Descriptors []Descriptor `yaml:"descriptors"`
+}
+
+// Descriptor matches an entry of the descriptors sent by Envoy. A
+// descriptor without Value matches any value of Key, and the one with
+// Value takes precedence over it.
+type Descriptor struct {
+	Key         string       `yaml:"key"`
+	Value       string       `yaml:"value"`
+	RateLimit   *RateLimit   `yaml:"rate_limit"`
+	Descriptors []Descriptor `yaml:"descriptors"`
+	// ShadowMode reports OK to Envoy even if the limit is exceeded, the
+	// limit is still counted.
+	ShadowMode bool `yaml:"shadow_mode"`
+	// DetailedMetric is accepted for compatibility and ignored
+	DetailedMetric bool `yaml:"detailed_metric"`
+}
+
+// RateLimit is the limit of a descriptor
+type RateLimit struct {
+	Name            string `yaml:"name"`
+	Unit            string `yaml:"unit"` // second, minute, hour, day, week, month or year
+	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
+	Unlimited       bool   `yaml:"unlimited"`
+}
+
+// LoadConfig reads the config of a domain from a YAML document, the
+// unknown fields are rejected.
+func LoadConfig(r io.Reader) (*Config, error) {
+	var c Config
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("envoyrls: %w", err)
+	}
+	return &c, nil
+}
+
+// node is a level of the descriptor tree of a domain
+type node struct {
+	limit    *limit
+	children map[string]*node // keyed by "key" or "key_value"
+}
+
+type limit struct {
+	name      string
+	unit      calendar.Unit
+	perUnit   uint32
+	unlimited bool
+	shadow    bool
+}
+
+func compile(descriptors []Descriptor, path string) (*node, error) {
+	n := &node{children: make(map[string]*node)}
+	for _, d := range descriptors {
+		if d.Key == "" {
+			return nil, fmt.Errorf("envoyrls: %s: a descriptor must have a key", path)
+		}
+		k := d.Key
+		if d.Value != "" {
+			k += "_" + d.Value
+		}
+		p := path + "." + k
+		if _, ok := n.children[k]; ok {
+			return nil, fmt.Errorf("envoyrls: %s: duplicated descriptor", p)
+		}
+		child, err := compile(d.Descriptors, p)
+		if err != nil {
+			return nil, err
+		}
+		if d.RateLimit != nil {
+			if child.limit, err = compileLimit(d.RateLimit, p); err != nil {
+				return nil, err
+			}
+			child.limit.shadow = d.ShadowMode
+		}
+		n.children[k] = child
+	}
+	return n, nil
+}
+
+func compileLimit(rl *RateLimit, path string) (*limit, error) {
+	if rl.Unlimited {
+		return &limit{name: rl.Name, unlimited: true}, nil
+	}
+	u, err := calendar.ParseUnit(rl.Unit)
+	if err != nil || u == calendar.None {
+		return nil, fmt.Errorf("envoyrls: %s: invalid unit %q", path, rl.Unit)
+	}
+	if rl.RequestsPerUnit == 0 {
+		return nil, fmt.Errorf("envoyrls: %s: requests_per_unit must be positive", path)
+	}
+	return &limit{name: rl.Name, unit: u, perUnit: rl.RequestsPerUnit}, nil
+}
+
+// lookup returns the limit of the node matched by the last entry
+func (n *node) lookup(entries []entry) *limit {
+	for i, e := range entries {
+		next, ok := n.children[e.key+"_"+e.value]
+		if !ok {
+			if next, ok = n.children[e.key]; !ok {
+				return nil
+			}
+		}
+		if i == len(entries)-1 {
+			return next.limit
+		}
+		n = next
+	}
+	return nil
+}
+
+type entry struct{ key, value string }
@@ -0,0 +1,180 @@
+// Package envoyrls implements the rate limit service of Envoy
+// (envoy.service.ratelimit.v3.RateLimitService) on top of the
+// calendar-aligned counter algorithm and a store.Store, so that it can
+// be the backend of the global rate limit filter of Envoy.
+//
+// The limits of the descriptors are configured in the same YAML shape as
+// lyft/ratelimit, see Config.
+//
+//	srv, err := envoyrls.NewServer(configs, store.NewMemory())
+//	...
+//	gs := grpc.NewServer()
+//	rlsv3.RegisterRateLimitServiceServer(gs, srv)
+//
+// It is a standalone module to keep the dependencies of hedzr/rate away.
+package envoyrls
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/hedzr/rate/calendar"
+	"github.com/hedzr/rate/store"
+)
+
+// Server implements rlsv3.RateLimitServiceServer
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	store    store.Store
+	domains  map[string]*node
+	location *time.Location
+}
+
+// Option configures the Server built by NewServer
+type Option func(s *Server)
+
+// WithLocation sets the time zone where the days, weeks, months and years
+// begin, default is UTC.
+func WithLocation(loc *time.Location) Option {
+	return func(s *Server) { s.location = loc }
+}
+
+// NewServer make a new instance of the service with the configs of the
+// domains, the counters live in s.
+func NewServer(configs []*Config, s store.Store, opts ...Option) (*Server, error) {
+	srv := &Server{store: s, domains: make(map[string]*node), location: time.UTC}
+	for _, c := range configs {
+		if c.Domain == "" {
+			return nil, fmt.Errorf("envoyrls: a config must have a domain")
+		}
+		if _, ok := srv.domains[c.Domain]; ok {
+			return nil, fmt.Errorf("envoyrls: domain %q configured twice", c.Domain)
+		}
+		root, err := compile(c.Descriptors, c.Domain)
+		if err != nil {
+			return nil, err
+		}
+		srv.domains[c.Domain] = root
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv, nil
+}
+
+// ShouldRateLimit implements rlsv3.RateLimitServiceServer.
+//
+// All descriptors of the request are counted, the response is
+// OVER_LIMIT if anyone of them exceeds its limit out of shadow mode. A
+// descriptor without a configured limit is OK.
+func (s *Server) ShouldRateLimit(_ context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "envoyrls: domain must not be empty")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "envoyrls: descriptor list must not be empty")
+	}
+	hits := req.GetHitsAddend()
+	if hits == 0 {
+		hits = 1
+	}
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	root := s.domains[req.GetDomain()]
+	now := time.Now().UnixNano()
+	for _, d := range req.GetDescriptors() {
+		st, err := s.decide(req.GetDomain(), root, d, hits, now)
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if st.GetCode() == rlsv3.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses = append(resp.Statuses, st)
+	}
+	return resp, nil
+}
+
+func (s *Server) decide(domain string, root *node, d *commonv3.RateLimitDescriptor, hits uint32, now int64) (*rlsv3.RateLimitResponse_DescriptorStatus, error) {
+	ok := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+
+	entries := make([]entry, 0, len(d.GetEntries()))
+	var sb strings.Builder
+	sb.WriteString(domain)
+	for _, e := range d.GetEntries() {
+		entries = append(entries, entry{e.GetKey(), e.GetValue()})
+		fmt.Fprintf(&sb, "|%s=%s", e.GetKey(), e.GetValue())
+	}
+
+	var l *limit
+	if o := d.GetLimit(); o != nil {
+		// the limit overridden by the route of Envoy
+		u, known := fromEnvoyUnit[o.GetUnit()]
+		if !known || o.GetRequestsPerUnit() == 0 {
+			return ok, nil
+		}
+		l = &limit{unit: u, perUnit: o.GetRequestsPerUnit()}
+		fmt.Fprintf(&sb, "|%d/%v", l.perUnit, l.unit)
+	} else if root != nil {
+		l = root.lookup(entries)
+	}
+	if l == nil || l.unlimited {
+		return ok, nil
+	}
+	if h := d.GetHitsAddend(); h != nil {
+		hits = uint32(h.GetValue())
+	}
+
+	alg := calendar.NewAlgorithm(int64(l.perUnit), calendar.Period{Unit: l.unit, Location: s.location})
+	var allowed bool
+	st, err := s.store.Update(sb.String(), func(st store.State, exists bool) (next store.State) {
+		next, allowed, _ = alg.Decide(st, exists, now, int(hits))
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code: rlsv3.RateLimitResponse_OK,
+		CurrentLimit: &rlsv3.RateLimitResponse_RateLimit{
+			Name:            l.name,
+			RequestsPerUnit: l.perUnit,
+			Unit:            toEnvoyUnit[l.unit],
+		},
+		LimitRemaining:     uint32(alg.Available(st, true, now)),
+		DurationUntilReset: durationpb.New(alg.(store.Resetter).Reset(st, true, now)),
+	}
+	if !allowed && !l.shadow {
+		res.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+	return res, nil
+}
+
+var toEnvoyUnit = map[calendar.Unit]rlsv3.RateLimitResponse_RateLimit_Unit{
+	calendar.Second: rlsv3.RateLimitResponse_RateLimit_SECOND,
+	calendar.Minute: rlsv3.RateLimitResponse_RateLimit_MINUTE,
+	calendar.Hour:   rlsv3.RateLimitResponse_RateLimit_HOUR,
+	calendar.Day:    rlsv3.RateLimitResponse_RateLimit_DAY,
+	calendar.Week:   rlsv3.RateLimitResponse_RateLimit_WEEK,
+	calendar.Month:  rlsv3.RateLimitResponse_RateLimit_MONTH,
+	calendar.Year:   rlsv3.RateLimitResponse_RateLimit_YEAR,
+}
+
+var fromEnvoyUnit = map[typev3.RateLimitUnit]calendar.Unit{
+	typev3.RateLimitUnit_SECOND: calendar.Second,
+	typev3.RateLimitUnit_MINUTE: calendar.Minute,
+	typev3.RateLimitUnit_HOUR:   calendar.Hour,
+	typev3.RateLimitUnit_DAY:    calendar.Day,
+	typev3.RateLimitUnit_MONTH:  calendar.Month,
+	typev3.RateLimitUnit_YEAR:   calendar.Year,
+}
@@ -0,0 +1,171 @@
+package envoyrls_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/hedzr/rate/envoyrls"
+	"github.com/hedzr/rate/store"
+)
+
+const config = `
+domain: edge
+descriptors:
+  - key: remote_address
+    rate_limit:
+      unit: hour
+      requests_per_unit: 3
+  - key: path
+    value: /login
+    descriptors:
+      - key: remote_address
+        rate_limit: { name: login, unit: day, requests_per_unit: 1 }
+  - key: path
+    value: /search
+    shadow_mode: true
+    rate_limit: { unit: minute, requests_per_unit: 1 }
+  - key: path
+    value: /healthz
+    rate_limit: { unlimited: true }
+`
+
+func newClient(t *testing.T) rlsv3.RateLimitServiceClient {
+	c, err := envoyrls.LoadConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := envoyrls.NewServer([]*envoyrls.Config{c}, store.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 16)
+	gs := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(gs, srv)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(kv ...string) *commonv3.RateLimitDescriptor {
+	d := &commonv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		d.Entries = append(d.Entries, &commonv3.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return d
+}
+
+func shouldRateLimit(t *testing.T, c rlsv3.RateLimitServiceClient, ds ...*commonv3.RateLimitDescriptor) *rlsv3.RateLimitResponse {
+	resp, err := c.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: ds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	c := newClient(t)
+
+	for i := 0; i < 3; i++ {
+		resp := shouldRateLimit(t, c, descriptor("remote_address", "10.0.0.1"))
+		st := resp.GetStatuses()[0]
+		if resp.GetOverallCode() != rlsv3.RateLimitResponse_OK || st.GetLimitRemaining() != uint32(2-i) ||
+			st.GetCurrentLimit().GetUnit() != rlsv3.RateLimitResponse_RateLimit_HOUR || st.GetDurationUntilReset().AsDuration() <= 0 {
+			t.Fatalf("request #%d: %v", i, resp)
+		}
+	}
+	if resp := shouldRateLimit(t, c, descriptor("remote_address", "10.0.0.1")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("the 4th request should be over limit: %v", resp)
+	}
+	if resp := shouldRateLimit(t, c, descriptor("remote_address", "10.0.0.2")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatal("each value of a key-only descriptor should have its own counter")
+	}
+
+	// nested descriptors
+	login := descriptor("path", "/login", "remote_address", "10.0.0.3")
+	if resp := shouldRateLimit(t, c, login); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK || resp.GetStatuses()[0].GetCurrentLimit().GetName() != "login" {
+		t.Fatalf("the first login should be allowed: %v", resp)
+	}
+	resp := shouldRateLimit(t, c, login, descriptor("path", "/healthz"), descriptor("path", "/unknown"))
+	if resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("the second login should be over limit: %v", resp)
+	}
+	for i, want := range []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OVER_LIMIT, rlsv3.RateLimitResponse_OK, rlsv3.RateLimitResponse_OK} {
+		if st := resp.GetStatuses()[i]; st.GetCode() != want {
+			t.Fatalf("status #%d: expecting %v, got %v", i, want, st)
+		}
+	}
+	if resp.GetStatuses()[1].GetCurrentLimit() != nil || resp.GetStatuses()[2].GetCurrentLimit() != nil {
+		t.Fatal("the unlimited and unknown descriptors should have no limit")
+	}
+
+	// shadow mode
+	for i := 0; i < 3; i++ {
+		resp := shouldRateLimit(t, c, descriptor("path", "/search"))
+		if resp.GetOverallCode() != rlsv3.RateLimitResponse_OK || resp.GetStatuses()[0].GetLimitRemaining() != 0 {
+			t.Fatalf("a descriptor in shadow mode should be counted but never over limit: %v", resp)
+		}
+	}
+
+	// the limit overridden by Envoy
+	override := descriptor("user", "bob")
+	override.Limit = &commonv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 1, Unit: typev3.RateLimitUnit_MINUTE}
+	shouldRateLimit(t, c, override)
+	if resp := shouldRateLimit(t, c, override); resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("the overridden limit should apply: %v", resp)
+	}
+}
+
+func TestHitsAddend(t *testing.T) {
+	c := newClient(t)
+	resp, err := c.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain: "edge", Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.9")}, HitsAddend: 3,
+	})
+	if err != nil || resp.GetOverallCode() != rlsv3.RateLimitResponse_OK || resp.GetStatuses()[0].GetLimitRemaining() != 0 {
+		t.Fatalf("expecting 3 hits taken at once: %v, %v", resp, err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	c := newClient(t)
+	if _, err := c.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{Domain: "edge"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expecting InvalidArgument, got %v", err)
+	}
+
+	for _, bad := range []string{
+		"domain: x\ndescriptors:\n  - key: a\n    rate_limit: { unit: fortnight, requests_per_unit: 1 }\n",
+		"domain: x\ndescriptors:\n  - key: a\n    rate_limit: { unit: second }\n",
+		"domain: x\ndescriptors:\n  - key: a\n  - key: a\n",
+		"domain: x\ndescriptors:\n  - value: a\n",
+	} {
+		cfg, err := envoyrls.LoadConfig(strings.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = envoyrls.NewServer([]*envoyrls.Config{cfg}, store.NewMemory()); err == nil {
+			t.Fatalf("expecting an error for %q", bad)
+		}
+	}
+	if _, err := envoyrls.LoadConfig(strings.NewReader("domain: x\nlimits: []\n")); err == nil {
+		t.Fatal("the unknown fields should be rejected")
+	}
+}
@@ -0,0 +1,358 @@
+// Package fairqueue implements a fair scheduler in front of a shared limiter
+//
+// When many keys (tenants) share one limiter, the callers of TakeBlocked
+// race with each other and the one which retries fastest wins. A
+// Scheduler queues the blocked callers per key and grants the tokens of
+// the shared limiter to the keys in deficit round robin order, so each
+// key gets the share of its weight.
+package fairqueue
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+// Scheduler grants the tokens of a shared limiter to the waiters of many keys fairly
+type Scheduler interface {
+	// Wait blocks until count tokens were granted to key, or ctx is done.
+	// A count above the capacity of the shared limiter fails with
+	// ErrTooLarge, it would never be granted.
+	//
+	// If ctx is done after the tokens were taken from the shared
+	// limiter, Wait returns nil since the tokens have been consumed.
+	Wait(ctx context.Context, key string, count int) error
+	// SetWeight changes the weight of key, the default weight is 1.
+	SetWeight(key string, weight int)
+	// For returns a rateapi.Limiter bound to key. Its TakeBlocked waits
+	// in the queue of key, and its Take takes from the shared limiter
+	// only if no one of any key is waiting.
+	For(key string) rateapi.Limiter
+	// Waiting returns the count of the callers waiting for key
+	Waiting(key string) int
+	// Close wakes up all waiters with ErrClosed. The shared limiter is not closed.
+	Close()
+}
+
+// Option configures the scheduler built by New
+type Option func(s *scheduler)
+
+// WithWeight sets the weight of key, see also Scheduler.SetWeight
+func WithWeight(key string, weight int) Option {
+	return func(s *scheduler) { s.weights[key] = weight }
+}
+
+// WithDefaultWeight sets the weight for the keys not configured, default is 1
+func WithDefaultWeight(weight int) Option {
+	return func(s *scheduler) { s.defaultWeight = weight }
+}
+
+// WithQueueLimit limits how many callers can wait for one key. The extra
+// callers fail with ErrQueueFull immediately. n <= 0 means unlimited.
+func WithQueueLimit(n int) Option {
+	return func(s *scheduler) { s.queueLimit = n }
+}
+
+// WithQuantum sets the tokens added to the deficit of a key of weight 1
+// on each round, default is 1.
+func WithQuantum(n int) Option {
+	return func(s *scheduler) { s.quantum = n }
+}
+
+// WithPollInterval sets how long the scheduler sleeps while the shared
+// limiter has no tokens, default is 1ms.
+func WithPollInterval(d time.Duration) Option {
+	return func(s *scheduler) { s.pollInterval = d }
+}
+
+var (
+	// ErrQueueFull is returned by Wait when too many callers are waiting for a key
+	ErrQueueFull = errors.New("fairqueue: too many waiters for the key")
+	// ErrClosed is returned by Wait after the scheduler closed
+	ErrClosed = errors.New("fairqueue: scheduler closed")
+	// ErrTooLarge is returned by Wait if count exceeds the capacity of the
+	// shared limiter, the waiter would block the scheduler for every key
+	ErrTooLarge = errors.New("fairqueue: waiting for more than the capacity")
+)
+
+// New make a new instance of the scheduler in front of the shared limiter.
+func New(limiter rateapi.Limiter, opts ...Option) Scheduler {
+	s := &scheduler{
+		limiter:       limiter,
+		defaultWeight: 1,
+		quantum:       1,
+		pollInterval:  time.Millisecond,
+		weights:       make(map[string]int),
+		flows:         make(map[string]*flow),
+		active:        list.New(),
+		wakeCh:        make(chan struct{}, 1),
+		exitCh:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go s.run()
+	return s
+}
+
+type waiter struct {
+	count   int
+	ch      chan struct{}
+	granted bool
+	elem    *list.Element // in flow.queue
+}
+
+type flow struct {
+	key     string
+	deficit int
+	queue   *list.List    // of *waiter
+	elem    *list.Element // in scheduler.active, nil if idle
+}
+
+type scheduler struct {
+	limiter       rateapi.Limiter
+	defaultWeight int
+	quantum       int
+	queueLimit    int
+	pollInterval  time.Duration
+
+	rw      sync.Mutex
+	weights map[string]int
+	flows   map[string]*flow
+	active  *list.List // of *flow, in round robin order
+	current *flow      // the flow being served in this round
+	closed  bool
+	wakeCh  chan struct{}
+	exitCh  chan struct{}
+}
+
+func (s *scheduler) SetWeight(key string, weight int) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.weights[key] = weight
+}
+
+func (s *scheduler) weight(key string) int {
+	if w, ok := s.weights[key]; ok && w > 0 {
+		return w
+	}
+	if s.defaultWeight > 0 {
+		return s.defaultWeight
+	}
+	return 1
+}
+
+func (s *scheduler) Waiting(key string) int {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if f, ok := s.flows[key]; ok {
+		return f.queue.Len()
+	}
+	return 0
+}
+
+func (s *scheduler) Close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.exitCh)
+	for _, f := range s.flows {
+		for e := f.queue.Front(); e != nil; e = e.Next() {
+			close(e.Value.(*waiter).ch)
+		}
+	}
+	s.flows, s.current = make(map[string]*flow), nil
+	s.active.Init()
+}
+
+func (s *scheduler) Wait(ctx context.Context, key string, count int) error {
+	if int64(count) > s.limiter.Capacity() {
+		return ErrTooLarge
+	}
+	s.rw.Lock()
+	if s.closed {
+		s.rw.Unlock()
+		return ErrClosed
+	}
+	f, ok := s.flows[key]
+	if !ok {
+		f = &flow{key: key, queue: list.New()}
+		s.flows[key] = f
+	}
+	if s.queueLimit > 0 && f.queue.Len() >= s.queueLimit {
+		s.rw.Unlock()
+		return ErrQueueFull
+	}
+	w := &waiter{count: count, ch: make(chan struct{})}
+	w.elem = f.queue.PushBack(w)
+	if f.elem == nil {
+		f.elem = s.active.PushBack(f)
+	}
+	s.rw.Unlock()
+
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-w.ch:
+		if !w.granted {
+			return ErrClosed
+		}
+		return nil
+	case <-ctx.Done():
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		if w.granted {
+			return nil
+		}
+		if w.elem != nil {
+			f.queue.Remove(w.elem)
+			w.elem = nil
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *scheduler) run() {
+	for {
+		w, ok := s.next()
+		if !ok {
+			return
+		}
+		if s.acquire(w) {
+			s.grant(w)
+		}
+	}
+}
+
+// next picks the waiter to serve in deficit round robin order, it blocks
+// while nobody is waiting.
+func (s *scheduler) next() (*waiter, bool) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for {
+		if s.closed {
+			return nil, false
+		}
+
+		if s.active.Len() == 0 {
+			s.rw.Unlock()
+			select {
+			case <-s.wakeCh:
+			case <-s.exitCh:
+			}
+			s.rw.Lock()
+			continue
+		}
+
+		f := s.current
+		if f == nil {
+			f = s.active.Front().Value.(*flow)
+			f.deficit += s.quantum * s.weight(f.key)
+			s.current = f
+		}
+
+		if f.queue.Len() == 0 {
+			s.retire(f)
+			continue
+		}
+
+		if w := f.queue.Front().Value.(*waiter); w.count <= f.deficit {
+			return w, true
+		}
+
+		// the deficit is not enough, the flow waits for the next round
+		s.active.MoveToBack(f.elem)
+		s.current = nil
+	}
+}
+
+// retire removes an idle flow from the round, the caller must hold the lock
+func (s *scheduler) retire(f *flow) {
+	s.active.Remove(f.elem)
+	f.elem, f.deficit = nil, 0
+	delete(s.flows, f.key)
+	if s.current == f {
+		s.current = nil
+	}
+}
+
+// acquire polls the shared limiter until the tokens for w were taken,
+// it gives up if w was canceled or the scheduler closed.
+func (s *scheduler) acquire(w *waiter) bool {
+	for {
+		s.rw.Lock()
+		gone := s.closed || w.elem == nil
+		s.rw.Unlock()
+		if gone {
+			return false
+		}
+
+		if s.limiter.Take(w.count) {
+			return true
+		}
+
+		select {
+		case <-s.exitCh:
+			return false
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *scheduler) grant(w *waiter) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	f := s.current
+	if s.closed || w.elem == nil || f == nil {
+		return // canceled just now, the tokens are lost
+	}
+	f.queue.Remove(w.elem)
+	w.elem, w.granted = nil, true
+	f.deficit -= w.count
+	close(w.ch)
+	if f.queue.Len() == 0 {
+		s.retire(f)
+	}
+}
+
+func (s *scheduler) For(key string) rateapi.Limiter {
+	return &keyLimiter{s, key}
+}
+
+type keyLimiter struct {
+	*scheduler
+	key string
+}
+
+func (k *keyLimiter) Take(count int) bool {
+	k.rw.Lock()
+	busy := k.active.Len() > 0
+	k.rw.Unlock()
+	return !busy && k.limiter.Take(count)
+}
+
+func (k *keyLimiter) TakeBlocked(count int) (requestAt time.Time) {
+	requestAt = time.Now().UTC()
+	if err := k.Wait(context.Background(), k.key, count); err != nil {
+		logger.Errorf("fairqueue: %v", err)
+		return time.Time{}
+	}
+	return
+}
+
+func (k *keyLimiter) Close()            {}
+func (k *keyLimiter) Available() int64  { return k.limiter.Available() }
+func (k *keyLimiter) Capacity() int64   { return k.limiter.Capacity() }
+func (k *keyLimiter) Enabled() bool     { return k.limiter.Enabled() }
+func (k *keyLimiter) SetEnabled(b bool) { k.limiter.SetEnabled(b) }
@@ -0,0 +1,135 @@
+package fairqueue_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/fairqueue"
+	"github.com/hedzr/rate/tokenbucket"
+)
+
+// gate is a shared limiter which allows nothing until it opens
+type gate struct{ open int32 }
+
+func (g *gate) Take(count int) bool { return atomic.LoadInt32(&g.open) == 1 }
+func (g *gate) TakeBlocked(count int) (requestAt time.Time) {
+	for !g.Take(count) {
+		time.Sleep(time.Millisecond)
+	}
+	return time.Now()
+}
+func (g *gate) Close()            {}
+func (g *gate) Available() int64  { return int64(atomic.LoadInt32(&g.open)) }
+func (g *gate) Capacity() int64   { return 1 }
+func (g *gate) Enabled() bool     { return true }
+func (g *gate) SetEnabled(b bool) {}
+
+func TestWeightedFairness(t *testing.T) {
+	g := &gate{}
+	s := fairqueue.New(g, fairqueue.WithWeight("pro", 3))
+	defer s.Close()
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, key := range []string{"free", "pro"} {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				if err := s.Wait(context.Background(), key, 1); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+			}(key)
+		}
+	}
+	for s.Waiting("free") < 20 || s.Waiting("pro") < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&g.open, 1)
+	wg.Wait()
+
+	var pro int
+	for _, key := range order[:16] {
+		if key == "pro" {
+			pro++
+		}
+	}
+	if pro < 10 || pro > 14 {
+		t.Fatalf("expecting about 12 of the first 16 grants for the weight 3 key, got %v: %v", pro, order)
+	}
+}
+
+func TestNoStarvation(t *testing.T) {
+	l := tokenbucket.New(100, time.Second) // one token per 10ms
+	defer l.Close()
+	for l.Take(1) {
+		// drain the initial tokens
+	}
+	s := fairqueue.New(l)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		go func() { _ = s.Wait(ctx, "greedy", 1) }()
+	}
+	for s.Waiting("greedy") < 50 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := s.Wait(context.Background(), "polite", 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("the polite key waited %v behind the greedy one", elapsed)
+	}
+}
+
+func TestCancelQueueLimitAndClose(t *testing.T) {
+	g := &gate{}
+	s := fairqueue.New(g, fairqueue.WithQueueLimit(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, "a", 1); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+	if n := s.Waiting("a"); n != 0 {
+		t.Fatalf("a canceled waiter should leave the queue, got %v", n)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Wait(context.Background(), "a", 1) }()
+	for s.Waiting("a") < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Wait(context.Background(), "a", 1); err != fairqueue.ErrQueueFull {
+		t.Fatalf("expecting queue full, got %v", err)
+	}
+	if s.For("b").Take(1) {
+		t.Fatal("Take should not jump the queue")
+	}
+	if err := s.Wait(context.Background(), "b", 2); err != fairqueue.ErrTooLarge {
+		t.Fatalf("expecting too large, got %v", err)
+	}
+	if at := s.For("b").TakeBlocked(2); !at.IsZero() {
+		t.Fatalf("TakeBlocked beyond the capacity should fail, got %v", at)
+	}
+
+	s.Close()
+	if err := <-errs; err != fairqueue.ErrClosed {
+		t.Fatalf("expecting closed, got %v", err)
+	}
+	if err := s.Wait(context.Background(), "a", 1); err != fairqueue.ErrClosed {
+		t.Fatalf("expecting closed, got %v", err)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/hedzr/rate
 
-go 1.17
+go 1.21
 
 // replace github.com/hedzr/errors v1.1.18
 
@@ -17,3 +17,8 @@ go 1.17
 // replace github.com/kardianos/service => ../../kardianos/service
 
 // replace github.com/hedzr/go-ringbuf => ../go-ringbuf
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -12,11 +12,19 @@ func New() Randomizer {
 	return &randomizer{seededRand: mrand.New(mrand.NewSource(time.Now().UTC().UnixNano()))} //nolint:gosec //like it
 }
 
+// NewWithSeed return a tool for randomizer which repeats the same
+// sequence for the same seed, such as for the simulations.
+func NewWithSeed(seed int64) Randomizer {
+	return &randomizer{seededRand: mrand.New(mrand.NewSource(seed))} //nolint:gosec //like it
+}
+
 // Randomizer enables normal resolution randomizer
 type Randomizer interface {
 	Next() int
 	NextIn(max int) int
 	NextInRange(min, max int) int
+	// NextFloat64 returns a float in [0.0, 1.0)
+	NextFloat64() float64
 	AsHires() HiresRandomizer
 	AsStrings() StringsRandomizer
 }
@@ -15,6 +15,15 @@ func TestNew(t *testing.T) {
 	t.Log(r.NextInRange(20, 30))
 }
 
+func TestNewWithSeed(t *testing.T) {
+	a, b := randomizer.NewWithSeed(1), randomizer.NewWithSeed(1)
+	for i := 0; i < 10; i++ {
+		if a.NextIn(1000) != b.NextIn(1000) || a.NextFloat64() != b.NextFloat64() {
+			t.Fatal("the same seed should repeat the same sequence")
+		}
+	}
+}
+
 func BenchmarkRandomizer(b *testing.B) {
 	var result int
 	r := randomizer.New()
@@ -0,0 +1,204 @@
+// Package keyed holds a limiter per key, such as per API key or per
+// client address, creating them on demand.
+package keyed
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hedzr/rate/rateapi"
+)
+
+// New make a new instance of the keyed limiters, the limiter of a key is
+// made by newLimiter at the first use.
+func New(newLimiter func(key string) rateapi.Limiter) *Limiters {
+	return &Limiters{newLimiter: newLimiter}
+}
+
+// Limiters is a set of limiters keyed by string, it is safe for
+// concurrent use.
+type Limiters struct {
+	newLimiter func(key string) rateapi.Limiter
+	limiters   sync.Map     // key -> rateapi.Limiter
+	creating   sync.RWMutex // held for writing by Update
+	count      int64
+}
+
+// Get returns the limiter of key, it is created if not exists. A nil
+// result means newLimiter failed.
+func (s *Limiters) Get(key string) rateapi.Limiter {
+	if l, ok := s.limiters.Load(key); ok {
+		return l.(rateapi.Limiter)
+	}
+	s.creating.RLock()
+	defer s.creating.RUnlock()
+	l := s.newLimiter(key)
+	if l == nil {
+		return nil
+	}
+	actual, loaded := s.limiters.LoadOrStore(key, l)
+	if loaded {
+		l.Close() // another goroutine won
+	} else {
+		atomic.AddInt64(&s.count, 1)
+	}
+	return actual.(rateapi.Limiter)
+}
+
+// Update calls fn while no limiter is being created, so that a limiter
+// is either made before fn and seen by a Range after Update, or made
+// after fn and sees what fn changed, such as what newLimiter reads.
+func (s *Limiters) Update(fn func()) {
+	s.creating.Lock()
+	defer s.creating.Unlock()
+	fn()
+}
+
+// Semaphore returns the limiter of key as a rateapi.Semaphore, such as of
+// semaphore.NewKeyed. A nil result means newLimiter failed or its limiter
+// is not a semaphore.
+func (s *Limiters) Semaphore(key string) rateapi.Semaphore {
+	sem, _ := s.Get(key).(rateapi.Semaphore)
+	return sem
+}
+
+// Lookup returns the limiter of key without creating it
+func (s *Limiters) Lookup(key string) (rateapi.Limiter, bool) {
+	l, ok := s.limiters.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return l.(rateapi.Limiter), true
+}
+
+// Delete closes and removes the limiter of key
+func (s *Limiters) Delete(key string) {
+	if l, ok := s.limiters.LoadAndDelete(key); ok {
+		atomic.AddInt64(&s.count, -1)
+		l.(rateapi.Limiter).Close()
+	}
+}
+
+// Len returns the count of keys, for the live keys gauge
+func (s *Limiters) Len() int { return int(atomic.LoadInt64(&s.count)) }
+
+// Range calls fn for each key and its limiter until fn returns false
+func (s *Limiters) Range(fn func(key string, l rateapi.Limiter) bool) {
+	s.limiters.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(rateapi.Limiter))
+	})
+}
+
+// Close closes and removes all limiters
+func (s *Limiters) Close() {
+	s.limiters.Range(func(k, _ interface{}) bool {
+		s.Delete(k.(string))
+		return true
+	})
+}
+
+// snapshotVersion is the version of the encoding of Snapshot
+const snapshotVersion = 1
+
+// ErrBadSnapshot is returned by Restore if the snapshot cannot be decoded
+var ErrBadSnapshot = errors.New("keyed: bad snapshot")
+
+// Snapshot encodes the keys and the snapshots of their limiters, to be
+// restored after a restart. The limiters which cannot snapshot their
+// states (see rateapi.Snapshotter) are skipped.
+//
+// The encoding is versioned and compact: the version, the count of the
+// keys, then each key and the snapshot of its limiter, prefixed by their
+// lengths in varints.
+func (s *Limiters) Snapshot() ([]byte, error) {
+	snapshots := make(map[string][]byte)
+	var err error
+	s.Range(func(key string, l rateapi.Limiter) bool {
+		sn, ok := l.(rateapi.Snapshotter)
+		if !ok {
+			return true
+		}
+		data, e := sn.Snapshot()
+		if e != nil && !errors.Is(e, rateapi.ErrNoSnapshot) {
+			err = fmt.Errorf("keyed: snapshot %q: %w", key, e)
+			return false
+		}
+		if e == nil {
+			snapshots[key] = data
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snapshots))
+	for key := range snapshots {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := []byte{snapshotVersion}
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, key := range keys {
+		b = binary.AppendUvarint(b, uint64(len(key)))
+		b = append(b, key...)
+		b = binary.AppendUvarint(b, uint64(len(snapshots[key])))
+		b = append(b, snapshots[key]...)
+	}
+	return b, nil
+}
+
+// Restore makes the limiters of the keys in a Snapshot and restores their
+// states. Nothing is restored if data cannot be decoded; the errors of the
+// limiters are joined, the other keys are still restored.
+func (s *Limiters) Restore(data []byte) error {
+	if len(data) == 0 {
+		return ErrBadSnapshot
+	}
+	if data[0] != snapshotVersion {
+		return fmt.Errorf("keyed: unsupported snapshot version %d", data[0])
+	}
+	b := data[1:]
+	next := func() ([]byte, bool) {
+		n, m := binary.Uvarint(b)
+		if m <= 0 || n > uint64(len(b)-m) {
+			return nil, false
+		}
+		v := b[m : m+int(n)]
+		b = b[m+int(n):]
+		return v, true
+	}
+	count, m := binary.Uvarint(b)
+	if m <= 0 || count > uint64(len(b)) {
+		return ErrBadSnapshot
+	}
+	b = b[m:]
+	keys, snapshots := make([]string, 0, count), make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, ok1 := next()
+		snapshot, ok2 := next()
+		if !ok1 || !ok2 {
+			return ErrBadSnapshot
+		}
+		keys, snapshots = append(keys, string(key)), append(snapshots, snapshot)
+	}
+	if len(b) > 0 {
+		return ErrBadSnapshot
+	}
+
+	var errs []error
+	for i, key := range keys {
+		sn, ok := s.Get(key).(rateapi.Snapshotter)
+		if !ok {
+			continue // not limited any more
+		}
+		if err := sn.Restore(snapshots[i]); err != nil {
+			errs = append(errs, fmt.Errorf("keyed: restore %q: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
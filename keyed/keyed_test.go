@@ -0,0 +1,127 @@
+package keyed_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/rateapi"
+)
+
+func TestLimiters(t *testing.T) {
+	var created int64
+	var mu sync.Mutex
+	ls := keyed.New(func(key string) rateapi.Limiter {
+		mu.Lock()
+		created++
+		mu.Unlock()
+		return rate.New(rate.Counter, 2, time.Minute)
+	})
+	defer ls.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.Get("a")
+			ls.Get("b")
+		}()
+	}
+	wg.Wait()
+	if ls.Len() != 2 {
+		t.Fatalf("expecting 2 keys, got %v (created %v)", ls.Len(), created)
+	}
+
+	a := ls.Get("a")
+	if !a.Take(2) || a.Take(1) {
+		t.Fatal("the limiter of a key should be kept")
+	}
+	if !ls.Get("b").Take(1) {
+		t.Fatal("the keys should be independent")
+	}
+
+	ls.Delete("a")
+	if _, ok := ls.Lookup("a"); ok || ls.Len() != 1 {
+		t.Fatal("the key should be deleted")
+	}
+	n := 0
+	ls.Range(func(key string, l rateapi.Limiter) bool { n++; return true })
+	if n != 1 {
+		t.Fatalf("expecting 1 key in range, got %v", n)
+	}
+
+	if keyed.New(func(string) rateapi.Limiter { return nil }).Get("x") != nil {
+		t.Fatal("a failed limiter should not be kept")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	gen := func(key string) rateapi.Limiter { return rate.New(rate.Counter, 2, time.Minute) }
+	ls := keyed.New(gen)
+	defer ls.Close()
+	ls.Get("a").Take(2)
+	ls.Get("b").Take(1)
+	data, err := ls.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := keyed.New(gen)
+	defer restored.Close()
+	if err = restored.Restore(data); err != nil || restored.Len() != 2 {
+		t.Fatalf("expecting 2 keys restored, got %v, %v", restored.Len(), err)
+	}
+	if restored.Get("a").Take(1) || !restored.Get("b").Take(1) || restored.Get("b").Take(1) {
+		t.Fatal("the states of the keys should be restored")
+	}
+	if err = keyed.New(gen).Restore(data[:len(data)-1]); !errors.Is(err, keyed.ErrBadSnapshot) {
+		t.Fatalf("expecting a bad snapshot, got %v", err)
+	}
+
+	other := keyed.New(func(string) rateapi.Limiter { return rate.New(rate.TokenBucket, 2, time.Minute) })
+	defer other.Close()
+	if err = other.Restore(data); err == nil {
+		t.Fatal("the snapshots of another algorithm should not be restored")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var maxCount atomic.Int64
+	maxCount.Store(2)
+	making, proceed := make(chan struct{}), make(chan struct{})
+	ls := keyed.New(func(key string) rateapi.Limiter {
+		n := maxCount.Load()
+		if key == "slow" {
+			close(making)
+			<-proceed
+		}
+		return rate.New(rate.Counter, n, time.Minute)
+	})
+	defer ls.Close()
+
+	go ls.Get("slow")
+	<-making
+	updated := make(chan struct{})
+	go func() {
+		ls.Update(func() { maxCount.Store(5) })
+		close(updated)
+	}()
+	select {
+	case <-updated:
+		t.Fatal("Update ran while a limiter was being made")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(proceed)
+	<-updated
+	if l, ok := ls.Lookup("slow"); !ok || l.Capacity() != 2 {
+		t.Fatalf("the limiter made before Update is not stored: %v %v", l, ok)
+	}
+	if c := ls.Get("fast").Capacity(); c != 5 {
+		t.Fatalf("the limiter made after Update has capacity %d", c)
+	}
+}
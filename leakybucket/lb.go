@@ -7,18 +7,100 @@ import (
 
 	"github.com/hedzr/rate/pkg/logger"
 	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 )
 
+// name is the name of the algorithm in the snapshots, the same as rate.LeakyBucket
+const name = "leaky-bucket"
+
 // New make a new instance of limiter
 func New(maxCount int64, d time.Duration) rateapi.Limiter {
-	return (&leakyBucket{
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return nil
+	}
+	if s := (&leakyBucket{
 		true,
 		int64(maxCount),
 		make(chan struct{}),
 		int64(d) / int64(maxCount),
 		time.Now().UnixNano(),
 		0,
-	}).start(d)
+	}).start(d); s != nil {
+		return s
+	}
+	return nil // not a typed nil, so that the caller can test it
+}
+
+// NewWithStore make a new instance of limiter whose state of key lives in s
+func NewWithStore(maxCount int64, d time.Duration, s store.Store, key string) rateapi.Limiter {
+	if alg := NewAlgorithm(maxCount, d); alg != nil {
+		return store.NewLimiter(s, key, alg)
+	}
+	return nil
+}
+
+// NewAlgorithm returns the leaky-bucket algorithm for store.NewLimiter.
+//
+// The state Count is the water level, Stamp is the last time it leaked.
+// It returns nil for the arguments New rejects.
+func NewAlgorithm(maxCount int64, d time.Duration) store.Algorithm {
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return nil
+	}
+	if rate := int64(d) / maxCount; rate < 1000 {
+		logger.Errorf("the rate cannot be less than 1000us, it's %v", rate)
+		return nil
+	}
+	return algorithm{maxCount, int64(d) / maxCount}
+}
+
+type algorithm struct {
+	maximal int64
+	rate    int64
+}
+
+func (a algorithm) Capacity() int64 { return a.maximal }
+func (a algorithm) String() string  { return name }
+
+func (a algorithm) leak(st store.State, exists bool, now int64) store.State {
+	if !exists {
+		st.Stamp = now
+	}
+	// the time short of a whole drop is kept for the next leak, or the
+	// bucket never leaks under the requests closer than a drop
+	n := (now - st.Stamp) / a.rate
+	st.Count -= n
+	st.Stamp += n * a.rate
+	if st.Count <= 0 {
+		st.Count, st.Stamp = 0, now
+	}
+	return st
+}
+
+func (a algorithm) Decide(st store.State, exists bool, now int64, count int) (store.State, bool, time.Duration) {
+	st = a.leak(st, exists, now)
+	if st.Count < a.maximal {
+		st.Count += int64(count)
+		return st, true, 0
+	}
+	return st, false, time.Duration(a.rate)
+}
+
+func (a algorithm) Available(st store.State, exists bool, now int64) int64 {
+	return max64(0, a.maximal-a.leak(st, exists, now).Count)
+}
+
+func (a algorithm) Reset(st store.State, exists bool, now int64) time.Duration {
+	return time.Duration(a.leak(st, exists, now).Count * a.rate)
+}
+
+func max64(a, b int64) int64 {
+	if a < b {
+		return b
+	}
+	return a
 }
 
 type leakyBucket struct {
@@ -40,6 +122,27 @@ func (s *leakyBucket) Close() {
 	close(s.exitCh)
 }
 
+// Snapshot implements rateapi.Snapshotter
+func (s *leakyBucket) Snapshot() ([]byte, error) {
+	st := store.State{Count: atomic.LoadInt64(&s.count), Stamp: atomic.LoadInt64(&s.refreshTime)}
+	return store.MarshalStates(name, st), nil
+}
+
+// Restore implements rateapi.Snapshotter, the water leaks for the time
+// since the snapshot.
+func (s *leakyBucket) Restore(data []byte) error {
+	st, exists, err := store.UnmarshalState(data, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		st.Stamp = time.Now().UnixNano()
+	}
+	atomic.StoreInt64(&s.count, st.Count)
+	atomic.StoreInt64(&s.refreshTime, st.Stamp)
+	return nil
+}
+
 func (s *leakyBucket) start(d time.Duration) *leakyBucket {
 	if s.rate < 1000 {
 		logger.Errorf("the rate cannot be less than 1000us, it's %v", s.rate)
@@ -56,27 +159,15 @@ func (s *leakyBucket) start(d time.Duration) *leakyBucket {
 //	// nothing to do
 //}
 
-func (s *leakyBucket) max(a, b int64) int64 {
-	if a < b {
-		return b
-	}
-	return a
-}
-
 func (s *leakyBucket) take(count int) (requestAt time.Time, ok bool) {
 	requestAt = time.Now()
 
-	rtm := atomic.LoadInt64(&s.refreshTime)
-	cnt := atomic.LoadInt64(&s.count)
-	atomic.StoreInt64(&s.count, s.max(0, cnt-(requestAt.UnixNano()-rtm)/s.rate*int64(count)))
-	atomic.StoreInt64(&s.refreshTime, requestAt.UnixNano())
-
-	cnt = atomic.LoadInt64(&s.count)
-	if cnt < s.Maximal {
-		atomic.AddInt64(&s.count, int64(count))
-		ok = true
-	}
-
+	var st store.State
+	st.Stamp = atomic.LoadInt64(&s.refreshTime)
+	st.Count = atomic.LoadInt64(&s.count)
+	st, ok, _ = algorithm{s.Maximal, s.rate}.Decide(st, true, requestAt.UnixNano(), count)
+	atomic.StoreInt64(&s.count, st.Count)
+	atomic.StoreInt64(&s.refreshTime, st.Stamp)
 	return
 }
 
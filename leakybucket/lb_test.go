@@ -11,6 +11,7 @@ import (
 	"github.com/hedzr/rate/internal/randomizer"
 	"github.com/hedzr/rate/leakybucket"
 	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 )
 
 func BenchmarkRandInt(b *testing.B) {
@@ -101,3 +102,84 @@ func safeRandNumber(rand randomizer.Randomizer, min, max int) int {
 }
 
 var mu sync.Mutex
+
+func TestLeakyBucketWithStore(t *testing.T) {
+	m := store.NewMemory()
+	l1 := leakybucket.NewWithStore(3, time.Hour, m, "k")
+	l2 := leakybucket.NewWithStore(3, time.Hour, m, "k")
+	var allowed int
+	for i := 0; i < 3; i++ {
+		if l1.Take(1) {
+			allowed++
+		}
+		if l2.Take(1) {
+			allowed++
+		}
+	}
+	if allowed != 3 || l1.Available() != 0 {
+		t.Fatalf("expecting 3 allowed across the limiters, got %v, available %v", allowed, l1.Available())
+	}
+
+	a := leakybucket.NewAlgorithm(3, 3*time.Second) // leaks one per second
+	st, _, _ := m.Load("k")
+	if _, ok, _ := a.Decide(st, true, st.Stamp+int64(time.Second), 1); !ok {
+		t.Fatal("the bucket should have leaked one")
+	}
+}
+
+func TestLeakBetweenDrops(t *testing.T) {
+	alg := leakybucket.NewAlgorithm(10, time.Second) // a drop per 100ms
+	var st store.State
+	exists := false
+	admitted := 0
+	for now := int64(0); now < int64(3*time.Second); now += int64(50 * time.Millisecond) {
+		var ok bool
+		if st, ok, _ = alg.Decide(st, exists, now, 1); ok {
+			admitted++
+		}
+		exists = true
+	}
+	// the capacity, then a drop per 100ms in 3s
+	if admitted < 38 || admitted > 40 {
+		t.Fatalf("the requests closer than a drop should not stop the leak, admitted %v", admitted)
+	}
+}
+
+func TestLeakyBucketSnapshot(t *testing.T) {
+	l := leakybucket.New(10, time.Hour) // a drop per 6min
+	defer l.Close()
+	l.Take(10)
+	data, err := l.(rateapi.Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := leakybucket.New(10, time.Hour)
+	defer l2.Close()
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil || l2.Take(1) {
+		t.Fatalf("expecting the full bucket restored, got %v", err)
+	}
+
+	// 30 minutes of downtime leak 5 drops
+	data = store.MarshalStates("leaky-bucket", store.State{Count: 10, Stamp: time.Now().Add(-30 * time.Minute).UnixNano()})
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		if l2.Take(1) {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Fatalf("expecting the downtime credited, admitted %v", admitted)
+	}
+}
+
+func TestLeakBySize(t *testing.T) {
+	alg := leakybucket.NewAlgorithm(10, time.Second) // a drop per 100ms
+	st, _, _ := alg.Decide(store.State{}, false, 0, 10)
+	// a drop leaked, whatever the size of the request
+	if st, ok, _ := alg.Decide(st, true, int64(100*time.Millisecond), 5); !ok || st.Count != 14 {
+		t.Fatalf("expecting a drop leaked, got %+v", st)
+	}
+}
@@ -0,0 +1,278 @@
+// Package multiwindow implements a limiter which combines several windows for one key
+package multiwindow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/calendar"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
+)
+
+// Window represents one limit of a plan, such as 10 requests per second.
+//
+// A window resets relative to the first request in it by default. If
+// Calendar is set, Period is ignored and the window resets at the
+// boundaries of the calendar period, such as midnight in a time zone.
+type Window struct {
+	Max      int64
+	Period   time.Duration
+	Calendar calendar.Period
+}
+
+func (w Window) String() string {
+	if w.aligned() {
+		return fmt.Sprintf("%d/%v", w.Max, w.Calendar)
+	}
+	return fmt.Sprintf("%d/%v", w.Max, w.Period)
+}
+
+func (w Window) aligned() bool { return w.Calendar.Unit != calendar.None }
+
+// length returns the nominal length of the window, for sorting only
+func (w Window) length() time.Duration {
+	switch w.Calendar.Unit {
+	case calendar.Second:
+		return time.Second
+	case calendar.Minute:
+		return time.Minute
+	case calendar.Hour:
+		return time.Hour
+	case calendar.Day:
+		return 24 * time.Hour
+	case calendar.Week:
+		return 7 * 24 * time.Hour
+	case calendar.Month:
+		return 31 * 24 * time.Hour
+	case calendar.Year:
+		return 366 * 24 * time.Hour
+	}
+	return w.Period
+}
+
+// Decision is the result of a request against all windows.
+//
+// If the request was rejected, Window, Limit, Remaining and Reset
+// describe the window which rejected it. Otherwise they describe the
+// window which has the least remains, so the HTTP layer can emit
+// 'X-RateLimit-Limit', 'X-RateLimit-Remaining' and 'X-RateLimit-Reset'
+// from it directly.
+type Decision struct {
+	Allowed   bool
+	Window    Window
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+// RetryAfter returns how long a rejected caller should wait before retrying.
+func (d Decision) RetryAfter() time.Duration {
+	if d.Allowed {
+		return 0
+	}
+	if w := time.Until(d.Reset); w > 0 {
+		return w
+	}
+	return 0
+}
+
+// Limiter is a rateapi.Limiter which takes the counts from every window atomically.
+type Limiter interface {
+	rateapi.Limiter
+	// Decide assigns count of allows from all windows, or none of them
+	// if any window is exhausted.
+	Decide(count int) Decision
+	// Windows returns the windows sorted by their length.
+	Windows() []Window
+}
+
+// New make a new instance of limiter with the given windows.
+//
+//	l := multiwindow.New(
+//	    multiwindow.Window{Max: 10, Period: time.Second},
+//	    multiwindow.Window{Max: 300, Period: time.Minute},
+//	    multiwindow.Window{Max: 10000, Period: 24 * time.Hour},
+//	)
+func New(windows ...Window) Limiter {
+	if len(windows) == 0 {
+		logger.Errorf("multiwindow: at least one window is required")
+		return nil
+	}
+	s := &multiWindow{enabled: true, states: make([]state, len(windows))}
+	for i, w := range windows {
+		if w.Max < 1 || w.length() <= 0 {
+			logger.Errorf("multiwindow: invalid window %v", w)
+			return nil
+		}
+		s.states[i].Window = w
+	}
+	sort.SliceStable(s.states, func(i, j int) bool { return s.states[i].length() < s.states[j].length() })
+	return s
+}
+
+type state struct {
+	Window
+	count int64
+	start int64 // the beginning of current window, in nanoseconds
+	tick  int64 // the end of current window, in nanoseconds
+}
+
+func (st *state) refresh(now int64) {
+	if now >= st.tick || now < st.start {
+		st.count = 0
+		if st.aligned() {
+			start, end := st.Calendar.Bounds(time.Unix(0, now))
+			st.start, st.tick = start.UnixNano(), end.UnixNano()
+		} else {
+			st.start, st.tick = now, now+int64(st.Period)
+		}
+	}
+}
+
+func (st *state) remains() int64 {
+	if r := st.Max - st.count; r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (st *state) decision(allowed bool) Decision {
+	return Decision{
+		Allowed:   allowed,
+		Window:    st.Window,
+		Limit:     st.Max,
+		Remaining: st.remains(),
+		Reset:     time.Unix(0, st.tick),
+	}
+}
+
+type multiWindow struct {
+	enabled bool
+	rw      sync.Mutex
+	states  []state
+}
+
+func (s *multiWindow) Enabled() bool     { return s.enabled }
+func (s *multiWindow) SetEnabled(b bool) { s.enabled = b }
+func (s *multiWindow) Close()            {}
+
+func (s *multiWindow) Windows() []Window {
+	ws := make([]Window, len(s.states))
+	for i := range s.states {
+		ws[i] = s.states[i].Window
+	}
+	return ws
+}
+
+func (s *multiWindow) Decide(count int) Decision {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return s.decide(time.Now().UnixNano(), int64(count))
+}
+
+func (s *multiWindow) decide(now, count int64) Decision {
+	var rejected *state
+	for i := range s.states {
+		st := &s.states[i]
+		st.refresh(now)
+		if st.count+count > st.Max && (rejected == nil || st.tick > rejected.tick) {
+			// the window resetting last is the one the caller must wait for
+			rejected = st
+		}
+	}
+	if rejected != nil {
+		return rejected.decision(false)
+	}
+
+	for i := range s.states {
+		s.states[i].count += count
+	}
+	return s.tightest().decision(true)
+}
+
+// tightest returns the window which has the least remains
+func (s *multiWindow) tightest() *state {
+	t := &s.states[0]
+	for i := 1; i < len(s.states); i++ {
+		if s.states[i].remains() < t.remains() {
+			t = &s.states[i]
+		}
+	}
+	return t
+}
+
+func (s *multiWindow) Take(count int) bool {
+	return s.Decide(count).Allowed
+}
+
+// TakeBlocked waits until all of the windows allow count, it returns the
+// zero time at once if count exceeds the Max of a window, which would
+// never allow it.
+func (s *multiWindow) TakeBlocked(count int) (requestAt time.Time) {
+	for i := range s.states {
+		if w := s.states[i].Window; int64(count) > w.Max {
+			logger.Errorf("multiwindow: taking %v exceeds the window %v", count, w)
+			return time.Time{}
+		}
+	}
+	requestAt = time.Now().UTC()
+	for d := s.Decide(count); !d.Allowed; d = s.Decide(count) {
+		time.Sleep(d.RetryAfter() + time.Millisecond)
+	}
+	return
+}
+
+func (s *multiWindow) Available() int64 {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	now := time.Now().UnixNano()
+	for i := range s.states {
+		s.states[i].refresh(now)
+	}
+	return s.tightest().remains()
+}
+
+// name is the name of the algorithm in the snapshots
+const name = "multiwindow"
+
+// Snapshot implements rateapi.Snapshotter, with a state per window
+func (s *multiWindow) Snapshot() ([]byte, error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	states := make([]store.State, len(s.states))
+	for i := range s.states {
+		states[i] = store.State{Count: s.states[i].count, Stamp: s.states[i].tick}
+	}
+	return store.MarshalStates(name, states...), nil
+}
+
+// Restore implements rateapi.Snapshotter, data must be a snapshot of a
+// limiter of the same windows. The windows in data go on if they have
+// not ended.
+func (s *multiWindow) Restore(data []byte) error {
+	states, err := store.UnmarshalStates(data, name)
+	if err != nil {
+		return err
+	}
+	if len(states) != len(s.states) {
+		return fmt.Errorf("multiwindow: the snapshot has %d windows rather than %d", len(states), len(s.states))
+	}
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for i, st := range states {
+		w := &s.states[i]
+		w.count, w.tick, w.start = st.Count, st.Stamp, st.Stamp-int64(w.Period)
+		if w.aligned() {
+			start, _ := w.Calendar.Bounds(time.Unix(0, st.Stamp-1))
+			w.start = start.UnixNano()
+		}
+	}
+	return nil
+}
+
+// Capacity returns the maximal count of the shortest window
+func (s *multiWindow) Capacity() int64 { return s.states[0].Max }
@@ -0,0 +1,99 @@
+package multiwindow_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/calendar"
+	"github.com/hedzr/rate/multiwindow"
+)
+
+func TestMultiWindowLimiter(t *testing.T) {
+	l := multiwindow.New(
+		multiwindow.Window{Max: 10, Period: time.Hour},
+		multiwindow.Window{Max: 3, Period: 100 * time.Millisecond},
+	)
+	defer l.Close()
+
+	if ws := l.Windows(); ws[0].Period != 100*time.Millisecond {
+		t.Fatalf("windows should be sorted by period, got %v", ws)
+	}
+
+	for i := 0; i < 3; i++ {
+		d := l.Decide(1)
+		if !d.Allowed {
+			t.Fatalf("#%d should be allowed: %+v", i, d)
+		}
+		if d.Remaining != int64(2-i) || d.Limit != 3 {
+			t.Fatalf("#%d unexpected decision: %+v", i, d)
+		}
+	}
+
+	d := l.Decide(1)
+	if d.Allowed || d.Window.Period != 100*time.Millisecond {
+		t.Fatalf("the short window should reject: %+v", d)
+	}
+	if ra := d.RetryAfter(); ra <= 0 || ra > 100*time.Millisecond {
+		t.Fatalf("bad retry-after: %v", ra)
+	}
+
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		l.TakeBlocked(1)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("TakeBlocked should wait for the short window, elapsed %v", time.Since(start))
+	}
+
+	d = l.Decide(1)
+	if d.Allowed || d.Window.Period != time.Hour || d.Limit != 10 {
+		t.Fatalf("the long window should reject: %+v", d)
+	}
+	t.Logf("the hourly window exhausted, reset at %v", d.Reset)
+}
+
+func TestMultiWindowAtomic(t *testing.T) {
+	l := multiwindow.New(
+		multiwindow.Window{Max: 5, Period: time.Hour},
+		multiwindow.Window{Max: 100, Period: time.Hour * 24},
+	)
+	if l.Take(6) {
+		t.Fatal("6 exceeds the hourly window")
+	}
+	// a rejected request must not be charged to any window
+	if !l.Take(5) {
+		t.Fatal("5 should be allowed after a rejection")
+	}
+	if l.Available() != 0 || l.Capacity() != 5 {
+		t.Fatalf("available: %v, capacity: %v", l.Available(), l.Capacity())
+	}
+	if at := l.TakeBlocked(6); !at.IsZero() {
+		t.Fatalf("6 would never fit the hourly window, got %v", at)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if l := multiwindow.New(); l != nil {
+		t.Fatal("expecting nil for empty windows")
+	}
+	if l := multiwindow.New(multiwindow.Window{Max: 0, Period: time.Second}); l != nil {
+		t.Fatal("expecting nil for invalid window")
+	}
+}
+
+func TestMultiWindowCalendar(t *testing.T) {
+	month := calendar.Period{Unit: calendar.Month, Location: time.UTC}
+	l := multiwindow.New(
+		multiwindow.Window{Max: 2, Calendar: month},
+		multiwindow.Window{Max: 10, Period: time.Second},
+	)
+	if ws := l.Windows(); ws[1].Calendar != month {
+		t.Fatalf("the monthly window should be sorted last: %v", ws)
+	}
+	l.Take(2)
+	d := l.Decide(1)
+	_, end := month.Bounds(time.Now())
+	if d.Allowed || !d.Reset.Equal(end) {
+		t.Fatalf("the monthly window should reject until %v: %+v", end, d)
+	}
+}
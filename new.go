@@ -7,7 +7,9 @@ import (
 
 	"github.com/hedzr/rate/counter"
 	"github.com/hedzr/rate/leakybucket"
+	"github.com/hedzr/rate/priority"
 	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 	"github.com/hedzr/rate/tokenbucket"
 )
 
@@ -21,6 +23,9 @@ const (
 	LeakyBucket Algorithm = "leaky-bucket"
 	// TokenBucket algorithm
 	TokenBucket Algorithm = "token-bucket"
+	// PriorityTokenBucket algorithm, a token bucket which reserves 10% of
+	// the tokens for high priority requests. See also priority.New.
+	PriorityTokenBucket Algorithm = "priority-token-bucket"
 )
 
 // New returns a new instance of the rate limiter with certain a algorithm.
@@ -29,15 +34,48 @@ const (
 //
 // - use a right algorithm name such as rate.LeakyBucket, rate.TokenBucket
 // - or register yours implement with rate.Register and assign it by algorithm name.
-func New(algorithm Algorithm, maxCount int64, d time.Duration) rateapi.Limiter {
+//
+// The options such as WithName and WithObserver decorate the limiter,
+// use Unwrap to get the algorithm specific one.
+func New(algorithm Algorithm, maxCount int64, d time.Duration, opts ...Option) rateapi.Limiter {
 	if lfn, ok := knownLimiters[algorithm]; ok {
-		return lfn(maxCount, d)
+		return newObserved(lfn, algorithm, maxCount, d, true, opts)
+	}
+	return nil
+}
+
+// NewWithStore returns a new instance of the rate limiter with certain a
+// algorithm, whose state of key lives in the store s. So a limiter can be
+// distributed by sharing a store between the processes.
+//
+// The options are the same as New. Since the state lives in s, it
+// survives the Reconfigure of the decorated limiter.
+//
+// a nil result means the algorithm doesn't support an external store, or
+// it rejects maxCount and d, such as a rate below a token per microsecond.
+func NewWithStore(algorithm Algorithm, maxCount int64, d time.Duration, s store.Store, key string, opts ...Option) rateapi.Limiter {
+	return newObserved(func(maxCount int64, d time.Duration) rateapi.Limiter {
+		if alg := NewAlgorithm(algorithm, maxCount, d); alg != nil {
+			return store.NewLimiter(s, key, alg)
+		}
+		return nil
+	}, algorithm, maxCount, d, false, opts)
+}
+
+// NewAlgorithm returns the decision of certain a algorithm on a store.State.
+//
+// a nil result means the algorithm doesn't support an external store, or
+// it rejects maxCount and d.
+func NewAlgorithm(algorithm Algorithm, maxCount int64, d time.Duration) store.Algorithm {
+	if afn, ok := knownAlgorithms[algorithm]; ok {
+		return afn(maxCount, d)
 	}
 	return nil
 }
 
 // CountOf extracts the Available tokens/rate-remains count from a rate-limiter
 func CountOf(limiter rateapi.Limiter) int64 {
+	limiter = Unwrap(limiter)
 	if c, ok := limiter.(interface{ Count() int }); ok {
 		return int64(c.Count())
 	}
@@ -53,7 +91,7 @@ func CountOf(limiter rateapi.Limiter) int64 {
 // Register puts your generator into registry so it will be assign from New() in the future
 func Register(algorithm string, generator func(maxCount int64, d time.Duration) rateapi.Limiter) error {
 	switch Algorithm(algorithm) {
-	case Counter, LeakyBucket, TokenBucket:
+	case Counter, LeakyBucket, TokenBucket, PriorityTokenBucket:
 		return errors.New("reserved name found")
 	}
 
@@ -85,7 +123,20 @@ func init() {
 	knownLimiters[TokenBucket] = func(maxCount int64, d time.Duration) rateapi.Limiter {
 		return tokenbucket.New(maxCount, d)
 	}
+
+	knownLimiters[PriorityTokenBucket] = func(maxCount int64, d time.Duration) rateapi.Limiter {
+		return priority.NewWithRatio(maxCount, d, priority.DefaultReserveRatio)
+	}
+
+	knownAlgorithms = map[Algorithm]func(maxCount int64, d time.Duration) store.Algorithm{
+		Counter:     counter.NewAlgorithm,
+		LeakyBucket: leakybucket.NewAlgorithm,
+		TokenBucket: tokenbucket.NewAlgorithm,
+	}
 }
 
 // knownLimiters is a public registry to store the generators of a rate-limiter
 var knownLimiters map[Algorithm]func(maxCount int64, d time.Duration) rateapi.Limiter
+
+// knownAlgorithms stores the algorithms which can run on a store.State
+var knownAlgorithms map[Algorithm]func(maxCount int64, d time.Duration) store.Algorithm
@@ -1,10 +1,17 @@
 package rate_test
 
 import (
-	"github.com/hedzr/rate"
-	"github.com/hedzr/rate/rateapi"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 )
 
 func TestRegister(t *testing.T) {
@@ -73,4 +80,214 @@ func TestNewLimiters(t *testing.T) {
 		t.Fatal("New a limiter failed")
 	}
 	defer l2.Close()
+
+	l3 := rate.New(rate.PriorityTokenBucket, 100, time.Second)
+	if l3 == nil {
+		t.Fatal("New a limiter failed")
+	}
+	defer l3.Close()
+}
+
+func TestNewWithStore(t *testing.T) {
+	m := store.NewMemory()
+	for _, alg := range []rate.Algorithm{rate.Counter, rate.LeakyBucket, rate.TokenBucket} {
+		l1 := rate.NewWithStore(alg, 10, time.Hour, m, string(alg))
+		l2 := rate.NewWithStore(alg, 10, time.Hour, m, string(alg))
+		var allowed int
+		for i := 0; i < 10; i++ {
+			if l1.Take(1) {
+				allowed++
+			}
+			if l2.Take(1) {
+				allowed++
+			}
+		}
+		if allowed != 10 {
+			t.Fatalf("%v: expecting 10 allowed across the limiters, got %v", alg, allowed)
+		}
+	}
+	if l := rate.NewWithStore(rate.PriorityTokenBucket, 10, time.Hour, m, "k"); l != nil {
+		t.Fatal("the priority token bucket cannot run on a store")
+	}
+	for _, alg := range []rate.Algorithm{rate.LeakyBucket, rate.TokenBucket} {
+		if l := rate.NewWithStore(alg, 0, time.Hour, m, "k"); l != nil || rate.New(alg, 0, time.Hour) != nil {
+			t.Fatalf("%v: a zero maxCount should be rejected", alg)
+		}
+		if l := rate.NewWithStore(alg, 10, 9*time.Nanosecond, m, "k"); l != nil {
+			t.Fatalf("%v: a rate rounding to zero should be rejected", alg)
+		}
+		if a := rate.NewAlgorithm(alg, 10, 9*time.Nanosecond); a != nil {
+			t.Fatalf("%v: a rate rounding to zero should be rejected", alg)
+		}
+	}
+
+	l := rate.NewWithStore(rate.TokenBucket, 10, time.Hour, m, "reconfigured", rate.WithName("x"))
+	for i := 0; i < 8; i++ {
+		l.Take(1)
+	}
+	if err := l.(rateapi.Reconfigurable).Reconfigure(20, 2*time.Hour); err != nil || l.Capacity() != 20 {
+		t.Fatalf("reconfigure: %v, %v", err, l.Capacity())
+	}
+	if a := l.Available(); a != 2 {
+		t.Fatalf("the state should survive the reconfiguration, got %v available", a)
+	}
+	if err := l.(rateapi.Reconfigurable).Reconfigure(10, 9*time.Nanosecond); err == nil || l.Capacity() != 20 {
+		t.Fatalf("a rate rounding to zero should be rejected, got %v of %v", err, l.Capacity())
+	}
+	l.Take(1) // the old limiter is kept, it must not divide by zero
+}
+
+func TestObserver(t *testing.T) {
+	var allowed, denied, waits, closes int
+	var reconfigured int64
+	ob := &rate.ObserverFuncs{
+		Allow:       func(l rateapi.Limiter, count int) { allowed += count },
+		Deny:        func(l rateapi.Limiter, count int) { denied += count },
+		Wait:        func(l rateapi.Limiter, count int, d time.Duration) { waits++ },
+		Close:       func(l rateapi.Limiter) { closes++ },
+		Reconfigure: func(l rateapi.Limiter, maxCount int64, d time.Duration) { reconfigured = maxCount },
+	}
+	l := rate.New(rate.Counter, 2, time.Minute, rate.WithName("login"), rate.WithObserver(ob))
+	if n, ok := l.(rateapi.Named); !ok || n.Name() != "login" || n.Algorithm() != string(rate.Counter) {
+		t.Fatal("the observed limiter should be named")
+	}
+
+	l.Take(1)
+	l.TakeBlocked(1)
+	l.Take(1)
+	if allowed != 2 || denied != 1 || waits != 1 {
+		t.Fatalf("expecting 2 allowed, 1 denied, 1 wait, got %v, %v, %v", allowed, denied, waits)
+	}
+
+	r, ok := l.(rateapi.Reconfigurable)
+	if !ok {
+		t.Fatal("the observed limiter should be reconfigurable")
+	}
+	if err := r.Reconfigure(5, time.Minute); err != nil || reconfigured != 5 || l.Capacity() != 5 {
+		t.Fatalf("reconfigure: %v, %v, %v", err, reconfigured, l.Capacity())
+	}
+	if r.Reconfigure(0, time.Minute) == nil {
+		t.Fatal("a zero maxCount should be rejected")
+	}
+	if l.Available() != 3 || !l.Take(1) {
+		t.Fatalf("the 2 requests taken should carry over, got %v available", l.Available())
+	}
+
+	l.Close()
+	l.Close()
+	if closes != 1 {
+		t.Fatalf("OnClose should be called once, got %v", closes)
+	}
+	if r.Reconfigure(5, time.Minute) != rate.ErrClosed {
+		t.Fatal("a closed limiter cannot be reconfigured")
+	}
+
+	// a TakeBlocked failed with the zero time is a deny, not a wait
+	allowed, denied, waits = 0, 0, 0
+	tb := rate.New(rate.TokenBucket, 2, time.Minute, rate.WithObserver(ob))
+	defer tb.Close()
+	if at := tb.TakeBlocked(3); !at.IsZero() || allowed != 0 || denied != 3 || waits != 0 {
+		t.Fatalf("expecting 3 denied and no wait, got %v, %v, %v", allowed, denied, waits)
+	}
+}
+
+// closeCounted counts the closes of a limiter
+type closeCounted struct {
+	rateapi.Limiter
+	closes *int32
+}
+
+func (l closeCounted) Close() { atomic.AddInt32(l.closes, 1); l.Limiter.Close() }
+
+func TestReconfigureDrains(t *testing.T) {
+	var closes int32
+	_ = rate.Register("close-counted", func(maxCount int64, d time.Duration) rateapi.Limiter {
+		return closeCounted{rate.New(rate.TokenBucket, maxCount, d), &closes}
+	})
+	defer rate.Unregister("close-counted")
+
+	for _, alg := range []rate.Algorithm{rate.TokenBucket, rate.PriorityTokenBucket, "close-counted"} {
+		closes = 0
+		l := rate.New(alg, 2, 200*time.Millisecond, rate.WithName("x"))
+		l.Take(2)
+		done := make(chan struct{})
+		go func() {
+			l.TakeBlocked(1)
+			close(done)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		if err := l.(rateapi.Reconfigurable).Reconfigure(4, 400*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if a := l.Available(); a < 2 || a > 3 {
+			t.Fatalf("%v: the 2 tokens taken should carry over, got %v available", alg, a)
+		}
+		if alg == "close-counted" && atomic.LoadInt32(&closes) != 0 {
+			t.Fatal("the old limiter should not be closed under a blocked call")
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%v: TakeBlocked should return after the reconfiguration", alg)
+		}
+		if alg == "close-counted" && atomic.LoadInt32(&closes) != 1 {
+			t.Fatalf("the old limiter should be closed when the blocked call left, got %v closes", closes)
+		}
+		l.Close()
+	}
+}
+
+func TestNoObserver(t *testing.T) {
+	l := rate.New(rate.TokenBucket, 10, time.Second)
+	defer l.Close()
+	if _, ok := l.(rateapi.Named); ok {
+		t.Fatal("a limiter without options should not be decorated")
+	}
+	if rate.New(rate.TokenBucket, 10, time.Microsecond, rate.WithName("x")) != nil {
+		t.Fatal("an invalid rate should result in nil")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	old := rate.LogLevel()
+	defer rate.SetLogLevel(old)
+
+	l := rate.New(rate.Counter, 1, time.Minute, rate.WithName("login"), rate.WithKey("10.0.0.1"), rate.WithLogHandler(h))
+	l.Take(1)
+	l.Take(1)
+	if buf.Len() != 0 {
+		t.Fatalf("the denials should not be logged at the default level, got %s", buf.String())
+	}
+
+	rate.SetLogLevel(slog.LevelDebug)
+	l.Take(1)
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["msg"] != "rate: denied" || rec["algorithm"] != string(rate.Counter) || rec["name"] != "login" ||
+		rec["key"] != "10.0.0.1" || rec["capacity"] != float64(1) || rec["rate"] != "1/1m0s" {
+		t.Fatalf("unexpected record: %v", rec)
+	}
+
+	buf.Reset()
+	rate.SetLogLevel(slog.LevelInfo)
+	_ = l.(rateapi.Reconfigurable).Reconfigure(3, time.Second)
+	if !strings.Contains(buf.String(), `"msg":"rate: limiter reconfigured"`) || !strings.Contains(buf.String(), `"rate":"3/1s"`) {
+		t.Fatalf("unexpected record: %s", buf.String())
+	}
+	l.Close()
+	if !strings.Contains(buf.String(), `"msg":"rate: limiter closed"`) {
+		t.Fatalf("the close should be logged, got %s", buf.String())
+	}
+
+	buf.Reset()
+	if rate.New(rate.TokenBucket, 10, time.Microsecond, rate.WithLogger(slog.New(h))) != nil {
+		t.Fatal("an invalid rate should result in nil")
+	}
+	if !strings.Contains(buf.String(), `"level":"ERROR"`) || !strings.Contains(buf.String(), `"rate":"10/1µs"`) {
+		t.Fatalf("the invalid rate should be logged, got %s", buf.String())
+	}
 }
@@ -0,0 +1,347 @@
+package rate
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+// Option configures the limiter built by New
+type Option func(o *observed)
+
+// WithName sets the name of the limiter, which is reported by
+// rateapi.Named to the observers, such as the label of the metrics.
+func WithName(name string) Option {
+	return func(o *observed) { o.name = name }
+}
+
+// WithKey sets the key of the limiter, such as the API key or the client
+// address it limits, for the log records.
+func WithKey(key string) Option {
+	return func(o *observed) { o.key = key }
+}
+
+// WithLogger sets the logger of the limiter events, default is the one
+// set by logger.SetSlog. The records are filtered by SetLogLevel too.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *observed) { o.log = l }
+}
+
+// WithLogHandler is WithLogger with a logger of h
+func WithLogHandler(h slog.Handler) Option {
+	return func(o *observed) { o.log = slog.New(h) }
+}
+
+// SetLogLevel sets the minimal level of the limiter events at runtime,
+// default is slog.LevelInfo. The denials and waits are logged at
+// slog.LevelDebug, the lifecycle events at slog.LevelInfo and the
+// invalid configs at slog.LevelError.
+func SetLogLevel(lvl slog.Level) { logger.SetSlogLevel(lvl) }
+
+// LogLevel returns the minimal level of the limiter events
+func LogLevel() slog.Level { return logger.SlogLevel() }
+
+// WithObserver attaches an observer to the limiter, it can be used
+// more than once.
+func WithObserver(ob rateapi.Observer) Option {
+	return func(o *observed) { o.observers = append(o.observers, ob) }
+}
+
+// ObserverFuncs is a rateapi.Observer built from the functions, the nil
+// ones are ignored. For example, to audit the denials only:
+//
+//	l := rate.New(rate.TokenBucket, 100, time.Second, rate.WithName(tenant),
+//		rate.WithObserver(&rate.ObserverFuncs{Deny: func(l rateapi.Limiter, count int) {
+//			audit.Printf("tenant %v exceeded its quota", l.(rateapi.Named).Name())
+//		}}))
+type ObserverFuncs struct {
+	Allow       func(l rateapi.Limiter, count int)
+	Deny        func(l rateapi.Limiter, count int)
+	Wait        func(l rateapi.Limiter, count int, d time.Duration)
+	Close       func(l rateapi.Limiter)
+	Reconfigure func(l rateapi.Limiter, maxCount int64, d time.Duration)
+}
+
+// OnAllow implements rateapi.Observer
+func (f *ObserverFuncs) OnAllow(l rateapi.Limiter, count int) {
+	if f.Allow != nil {
+		f.Allow(l, count)
+	}
+}
+
+// OnDeny implements rateapi.Observer
+func (f *ObserverFuncs) OnDeny(l rateapi.Limiter, count int) {
+	if f.Deny != nil {
+		f.Deny(l, count)
+	}
+}
+
+// OnWait implements rateapi.Observer
+func (f *ObserverFuncs) OnWait(l rateapi.Limiter, count int, d time.Duration) {
+	if f.Wait != nil {
+		f.Wait(l, count, d)
+	}
+}
+
+// OnClose implements rateapi.Observer
+func (f *ObserverFuncs) OnClose(l rateapi.Limiter) {
+	if f.Close != nil {
+		f.Close(l)
+	}
+}
+
+// OnReconfigure implements rateapi.Observer
+func (f *ObserverFuncs) OnReconfigure(l rateapi.Limiter, maxCount int64, d time.Duration) {
+	if f.Reconfigure != nil {
+		f.Reconfigure(l, maxCount, d)
+	}
+}
+
+// observed decorates a limiter to notify the observers, to log the
+// events and to reconfigure it. New returns the bare limiter if no
+// option given, so there is no cost for the limiters without an observer.
+//
+// The hot path loads the underlying limiter atomically, the observers
+// are fixed at building, so no lock is taken.
+type observed struct {
+	inner     atomic.Value // *holder
+	carry     bool         // carries the usage over Reconfigure, the state is not in a store
+	name      string
+	key       string
+	algorithm Algorithm
+	generator func(maxCount int64, d time.Duration) rateapi.Limiter
+	observers []rateapi.Observer
+	log       *slog.Logger
+	events    atomic.Value // logHolder, log with the attributes of current config
+
+	rw     sync.Mutex // serializes Reconfigure and Close
+	closed bool
+}
+
+// holder counts the calls in flight of a limiter, a limiter replaced by
+// Reconfigure is closed when the last of them leaves.
+type holder struct {
+	rateapi.Limiter
+	refs    int64
+	retired int32
+	once    sync.Once
+}
+
+func (h *holder) close() { h.once.Do(h.Limiter.Close) }
+
+type logHolder struct{ *slog.Logger }
+
+func newObserved(generator func(maxCount int64, d time.Duration) rateapi.Limiter, algorithm Algorithm, maxCount int64, d time.Duration, carry bool, opts []Option) rateapi.Limiter {
+	l := generator(maxCount, d)
+	if len(opts) == 0 {
+		return l
+	}
+	o := &observed{algorithm: algorithm, generator: generator, carry: carry, log: logger.Slog()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.configured(maxCount, d)
+	if l == nil {
+		o.logEvent(slog.LevelError, "rate: cannot build the limiter")
+		return nil
+	}
+	o.inner.Store(&holder{Limiter: l})
+	o.logEvent(slog.LevelDebug, "rate: limiter created")
+	return o
+}
+
+func (o *observed) load() rateapi.Limiter { return o.inner.Load().(*holder).Limiter }
+
+// acquire loads the limiter and counts the call in flight, so that
+// Reconfigure does not close it under the call
+func (o *observed) acquire() *holder {
+	for {
+		h := o.inner.Load().(*holder)
+		atomic.AddInt64(&h.refs, 1)
+		if atomic.LoadInt32(&h.retired) == 0 {
+			return h
+		}
+		o.release(h) // replaced just now
+	}
+}
+
+func (o *observed) release(h *holder) {
+	if atomic.AddInt64(&h.refs, -1) == 0 && atomic.LoadInt32(&h.retired) != 0 {
+		h.close()
+	}
+}
+
+// configured updates the attributes of the log records
+func (o *observed) configured(maxCount int64, d time.Duration) {
+	if o.log == nil {
+		return
+	}
+	attrs := []interface{}{slog.String("algorithm", string(o.algorithm))}
+	if o.name != "" {
+		attrs = append(attrs, slog.String("name", o.name))
+	}
+	if o.key != "" {
+		attrs = append(attrs, slog.String("key", o.key))
+	}
+	attrs = append(attrs, slog.Int64("capacity", maxCount), slog.String("rate", fmt.Sprintf("%d/%v", maxCount, d)))
+	o.events.Store(logHolder{o.log.With(attrs...)})
+}
+
+func (o *observed) logEvent(lvl slog.Level, msg string, attrs ...slog.Attr) {
+	if h, ok := o.events.Load().(logHolder); ok {
+		logger.LogAttrs(h.Logger, lvl, msg, attrs...)
+	}
+}
+
+// Unwrap returns the underlying limiter
+func (o *observed) Unwrap() rateapi.Limiter { return o.load() }
+
+func (o *observed) Name() string      { return o.name }
+func (o *observed) Algorithm() string { return string(o.algorithm) }
+
+func (o *observed) Enabled() bool     { return o.load().Enabled() }
+func (o *observed) SetEnabled(b bool) { o.load().SetEnabled(b) }
+func (o *observed) Available() int64  { return o.load().Available() }
+func (o *observed) Capacity() int64   { return o.load().Capacity() }
+
+func (o *observed) Take(count int) bool {
+	h := o.acquire()
+	ok := h.Take(count)
+	o.release(h)
+	if !ok {
+		o.logEvent(slog.LevelDebug, "rate: denied", slog.Int("count", count))
+	}
+	for _, ob := range o.observers {
+		if ok {
+			ob.OnAllow(o, count)
+		} else {
+			ob.OnDeny(o, count)
+		}
+	}
+	return ok
+}
+
+// TakeBlocked reports a wait and an allow to the observers, or a deny if
+// the limiter failed with the zero time, such as a closed semaphore.
+func (o *observed) TakeBlocked(count int) (requestAt time.Time) {
+	h := o.acquire()
+	requestAt = h.TakeBlocked(count)
+	o.release(h)
+	if requestAt.IsZero() {
+		o.logEvent(slog.LevelDebug, "rate: denied", slog.Int("count", count))
+		for _, ob := range o.observers {
+			ob.OnDeny(o, count)
+		}
+		return
+	}
+	waited := time.Since(requestAt)
+	o.logEvent(slog.LevelDebug, "rate: waited", slog.Int("count", count), slog.Duration("wait", waited))
+	for _, ob := range o.observers {
+		ob.OnWait(o, count, waited)
+		ob.OnAllow(o, count)
+	}
+	return
+}
+
+func (o *observed) Close() {
+	o.rw.Lock()
+	if o.closed {
+		o.rw.Unlock()
+		return
+	}
+	o.closed = true
+	o.inner.Load().(*holder).close()
+	o.rw.Unlock()
+	o.logEvent(slog.LevelInfo, "rate: limiter closed")
+	for _, ob := range o.observers {
+		ob.OnClose(o)
+	}
+}
+
+// Snapshot implements rateapi.Snapshotter if the limiter does, otherwise
+// it returns rateapi.ErrNoSnapshot.
+func (o *observed) Snapshot() ([]byte, error) {
+	if sn, ok := o.load().(rateapi.Snapshotter); ok {
+		return sn.Snapshot()
+	}
+	return nil, rateapi.ErrNoSnapshot
+}
+
+// Restore implements rateapi.Snapshotter if the limiter does, otherwise
+// it returns rateapi.ErrNoSnapshot.
+func (o *observed) Restore(data []byte) error {
+	if sn, ok := o.load().(rateapi.Snapshotter); ok {
+		return sn.Restore(data)
+	}
+	return rateapi.ErrNoSnapshot
+}
+
+// ErrClosed is returned by Reconfigure after the limiter closed
+var ErrClosed = errors.New("rate: limiter closed")
+
+// Reconfigure replaces the underlying limiter with a new one of maxCount
+// per d. The usage of the old one carries over, capped to maxCount, such
+// as the tokens taken from a bucket; the state of NewWithStore lives in
+// the store, so it survives anyway.
+//
+// The calls in flight, such as TakeBlocked, go on with the old limiter,
+// which is closed when the last of them returns. The arguments are
+// validated by the constructor of the algorithm, such as the rate of a
+// token bucket; if it rejects them, the old limiter is kept.
+func (o *observed) Reconfigure(maxCount int64, d time.Duration) error {
+	if maxCount < 1 || d <= 0 {
+		o.logEvent(slog.LevelError, "rate: invalid reconfiguration", slog.Int64("new_capacity", maxCount), slog.Duration("new_period", d))
+		return errors.New("rate: the maxCount and period must be positive")
+	}
+	o.rw.Lock()
+	if o.closed {
+		o.rw.Unlock()
+		return ErrClosed
+	}
+	l := o.generator(maxCount, d)
+	if l == nil {
+		o.rw.Unlock()
+		o.logEvent(slog.LevelError, "rate: invalid reconfiguration", slog.Int64("new_capacity", maxCount), slog.Duration("new_period", d))
+		return fmt.Errorf("rate: %v rejects %d per %v", o.algorithm, maxCount, d)
+	}
+	old := o.inner.Load().(*holder)
+	l.SetEnabled(old.Enabled())
+	if o.carry {
+		if used := old.Capacity() - old.Available(); used > 0 {
+			if used > l.Capacity() {
+				used = l.Capacity()
+			}
+			l.Take(int(used))
+		}
+	}
+	o.inner.Store(&holder{Limiter: l})
+	atomic.StoreInt32(&old.retired, 1)
+	if atomic.LoadInt64(&old.refs) == 0 {
+		old.close()
+	}
+	o.configured(maxCount, d)
+	o.rw.Unlock()
+	o.logEvent(slog.LevelInfo, "rate: limiter reconfigured")
+	for _, ob := range o.observers {
+		ob.OnReconfigure(o, maxCount, d)
+	}
+	return nil
+}
+
+// Unwrap returns the innermost limiter under the decorators of New, for
+// the type assertions on the algorithm specific interfaces.
+func Unwrap(l rateapi.Limiter) rateapi.Limiter {
+	for {
+		u, ok := l.(interface{ Unwrap() rateapi.Limiter })
+		if !ok {
+			return l
+		}
+		l = u.Unwrap()
+	}
+}
@@ -0,0 +1,239 @@
+// Package otelrate integrates the limiters with OpenTelemetry.
+//
+// Wrap records the decisions of a limiter as the metric instruments, and
+// traces every blocking wait as a span. Annotate marks the active span of
+// a request with the limiter key and the decision, it fits
+// middleware.WithDecisionHook:
+//
+//	l := otelrate.Wrap(rate.New(rate.TokenBucket, 100, time.Second, rate.WithName("api")))
+//	if err := l.Wait(ctx, 1); err != nil {
+//		return err
+//	}
+//
+//	h := middleware.ForHTTP(keyFunc, limiters, next, middleware.WithDecisionHook(otelrate.Annotate))
+//
+// It is a standalone module to keep the dependencies of hedzr/rate away.
+package otelrate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+const instrumentation = "github.com/hedzr/rate/otelrate"
+
+// The attribute keys
+const (
+	LimiterKey   = attribute.Key("ratelimit.limiter")
+	AlgorithmKey = attribute.Key("ratelimit.algorithm")
+	KeyKey       = attribute.Key("ratelimit.key")
+	DecisionKey  = attribute.Key("ratelimit.decision")
+	CountKey     = attribute.Key("ratelimit.count")
+	WaitKey      = attribute.Key("ratelimit.wait_seconds")
+)
+
+// The decisions
+const (
+	Allowed = "allowed"
+	// Denied means the request was rejected by Take, or Wait failed
+	Denied = "denied"
+	// Delayed means the request was allowed after a blocking wait
+	Delayed = "delayed"
+)
+
+// ErrTooLarge is returned by Wait if count exceeds the capacity of the
+// limiter, it would never be assigned
+var ErrTooLarge = errors.New("otelrate: waiting for more than the capacity")
+
+// maxPoll is the longest interval of Wait between the tries of Take
+const maxPoll = 50 * time.Millisecond
+
+// Option configures the Limiter built by Wrap
+type Option func(c *config)
+
+type config struct {
+	tp        trace.TracerProvider
+	mp        metric.MeterProvider
+	name      string
+	algorithm string
+}
+
+// WithTracerProvider sets the tracer provider, default is the global one
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) { c.tp = tp }
+}
+
+// WithMeterProvider sets the meter provider, default is the global one
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) { c.mp = mp }
+}
+
+// WithName sets the name and the algorithm attributes of the limiter,
+// default is taken from rateapi.Named.
+func WithName(name, algorithm string) Option {
+	return func(c *config) { c.name, c.algorithm = name, algorithm }
+}
+
+// Wrap returns a limiter which records the decisions of l
+func Wrap(l rateapi.Limiter, opts ...Option) *Limiter {
+	c := &config{tp: otel.GetTracerProvider(), mp: otel.GetMeterProvider()}
+	if n, ok := l.(rateapi.Named); ok {
+		c.name, c.algorithm = n.Name(), n.Algorithm()
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	s := &Limiter{
+		Limiter: l,
+		tracer:  c.tp.Tracer(instrumentation),
+		attrs:   attribute.NewSet(LimiterKey.String(c.name), AlgorithmKey.String(c.algorithm)),
+	}
+	meter := c.mp.Meter(instrumentation)
+	var err error
+	if s.decisions, err = meter.Int64Counter("rate.decisions",
+		metric.WithDescription("The tokens decided by the limiter."), metric.WithUnit("{token}")); err != nil {
+		logger.Warnf("otelrate: %v", err)
+	}
+	if s.waits, err = meter.Float64Histogram("rate.wait.duration",
+		metric.WithDescription("The time waited for the allows."), metric.WithUnit("s")); err != nil {
+		logger.Warnf("otelrate: %v", err)
+	}
+	if s.available, err = meter.Int64ObservableGauge("rate.available",
+		metric.WithDescription("The remains of the limiter."), metric.WithUnit("{token}")); err != nil {
+		logger.Warnf("otelrate: %v", err)
+	}
+	if s.reg, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(s.available, s.Limiter.Available(), metric.WithAttributeSet(s.attrs))
+		return nil
+	}, s.available); err != nil {
+		logger.Warnf("otelrate: %v", err)
+	}
+	return s
+}
+
+// Limiter is a rateapi.Limiter recording its decisions
+type Limiter struct {
+	rateapi.Limiter
+	tracer    trace.Tracer
+	attrs     attribute.Set
+	decisions metric.Int64Counter
+	waits     metric.Float64Histogram
+	available metric.Int64ObservableGauge
+	reg       metric.Registration
+}
+
+// Unwrap returns the underlying limiter
+func (s *Limiter) Unwrap() rateapi.Limiter { return s.Limiter }
+
+func (s *Limiter) record(ctx context.Context, decision string, count int) {
+	s.decisions.Add(ctx, int64(count), metric.WithAttributeSet(s.attrs), metric.WithAttributes(DecisionKey.String(decision)))
+}
+
+func (s *Limiter) Take(count int) bool {
+	ok := s.Limiter.Take(count)
+	decision := Allowed
+	if !ok {
+		decision = Denied
+	}
+	s.record(context.Background(), decision, count)
+	return ok
+}
+
+// TakeBlocked is Wait without a deadline, it returns the zero time if
+// the allows are not assigned.
+func (s *Limiter) TakeBlocked(count int) (requestAt time.Time) {
+	requestAt = time.Now().UTC()
+	if err := s.Wait(context.Background(), count); err != nil {
+		logger.Errorf("otelrate: %v", err)
+		return time.Time{}
+	}
+	return
+}
+
+// Wait blocks until count of allows assigned or ctx is done, in a span
+// "rate.wait" which is a child of the span in ctx. While the limiter has
+// no allows, it retries Take with a backoff up to 50ms. A count above the
+// capacity fails with ErrTooLarge; the failures are recorded as denied.
+func (s *Limiter) Wait(ctx context.Context, count int) (err error) {
+	ctx, span := s.tracer.Start(ctx, "rate.wait", trace.WithAttributes(s.attrs.ToSlice()...), trace.WithAttributes(CountKey.Int(count)))
+	defer span.End()
+
+	start := time.Now()
+	decision := Allowed
+	switch {
+	case int64(count) > s.Limiter.Capacity():
+		err = ErrTooLarge
+	case !s.Limiter.Take(count):
+		decision = Delayed
+		err = s.poll(ctx, count)
+	}
+	waited := time.Since(start).Seconds()
+
+	if err != nil {
+		decision = Denied
+		span.RecordError(err)
+	}
+	span.SetAttributes(DecisionKey.String(decision), WaitKey.Float64(waited))
+	s.record(ctx, decision, count)
+	if err == nil {
+		s.waits.Record(ctx, waited, metric.WithAttributeSet(s.attrs))
+	}
+	return
+}
+
+// poll retries Take until it allows count or ctx is done
+func (s *Limiter) poll(ctx context.Context, count int) error {
+	for d := time.Millisecond; ; {
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if s.Limiter.Take(count) {
+			return nil
+		}
+		if d *= 2; d > maxPoll {
+			d = maxPoll
+		}
+	}
+}
+
+func (s *Limiter) Close() {
+	if s.reg != nil {
+		_ = s.reg.Unregister()
+	}
+	s.Limiter.Close()
+}
+
+// AnnotateSpan sets the limiter key and the decision on the span in ctx,
+// and adds an event "rate_limited" if the request was denied.
+func AnnotateSpan(ctx context.Context, key string, allowed bool) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	decision := Allowed
+	if !allowed {
+		decision = Denied
+		span.AddEvent("rate_limited", trace.WithAttributes(KeyKey.String(key)))
+	}
+	span.SetAttributes(KeyKey.String(key), DecisionKey.String(decision))
+}
+
+// Annotate is AnnotateSpan for the span of r, it is a middleware.DecisionHook
+func Annotate(r *http.Request, key string, allowed bool) {
+	AnnotateSpan(r.Context(), key, allowed)
+}
@@ -0,0 +1,142 @@
+package otelrate_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/otelrate"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/supports/middleware"
+)
+
+func providers() (*tracetest.SpanRecorder, *sdktrace.TracerProvider, *sdkmetric.ManualReader, *sdkmetric.MeterProvider) {
+	sr := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	return sr, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)), reader, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+}
+
+func attr(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestWrap(t *testing.T) {
+	sr, tp, reader, mp := providers()
+	l := otelrate.Wrap(rate.New(rate.TokenBucket, 2, 200*time.Millisecond, rate.WithName("api")),
+		otelrate.WithTracerProvider(tp), otelrate.WithMeterProvider(mp))
+	defer l.Close()
+
+	l.Take(2)
+	l.Take(1)
+	if err := l.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 1 || spans[0].Name() != "rate.wait" {
+		t.Fatalf("expecting a span of the wait, got %v", spans)
+	}
+	attrs := spans[0].Attributes()
+	if attr(attrs, otelrate.DecisionKey).AsString() != otelrate.Delayed || attr(attrs, otelrate.WaitKey).AsFloat64() <= 0 ||
+		attr(attrs, otelrate.LimiterKey).AsString() != "api" || attr(attrs, otelrate.AlgorithmKey).AsString() != "token-bucket" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	var waits uint64
+	var available bool
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					v, _ := dp.Attributes.Value(otelrate.DecisionKey)
+					got[v.AsString()] += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					waits += dp.Count
+				}
+			case metricdata.Gauge[int64]:
+				available = m.Name == "rate.available" && len(data.DataPoints) == 1
+			}
+		}
+	}
+	if got[otelrate.Allowed] != 2 || got[otelrate.Denied] != 1 || got[otelrate.Delayed] != 1 || waits != 1 || !available {
+		t.Fatalf("unexpected metrics %v, waits %v, available %v", got, waits, available)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	sr, tp, _, mp := providers()
+	l := otelrate.Wrap(rate.New(rate.TokenBucket, 1, time.Hour, rate.WithName("api")),
+		otelrate.WithTracerProvider(tp), otelrate.WithMeterProvider(mp))
+	defer l.Close()
+
+	l.Take(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+	if err := l.Wait(context.Background(), 2); err != otelrate.ErrTooLarge {
+		t.Fatalf("expecting too large, got %v", err)
+	}
+	if at := l.TakeBlocked(2); !at.IsZero() {
+		t.Fatalf("TakeBlocked beyond the capacity should fail, got %v", at)
+	}
+	for _, span := range sr.Ended() {
+		if attr(span.Attributes(), otelrate.DecisionKey).AsString() != otelrate.Denied {
+			t.Fatalf("a failed wait should be denied, got %v", span.Attributes())
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	sr, tp, _, _ := providers()
+	limiters := keyed.New(func(key string) rateapi.Limiter { return rate.New(rate.Counter, 1, time.Minute) })
+	defer limiters.Close()
+	h := middleware.ForHTTP(middleware.HeaderKey("X-API-KEY"), limiters, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		middleware.WithDecisionHook(otelrate.Annotate))
+
+	for i := 0; i < 2; i++ {
+		ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		req.Header.Set("X-API-KEY", "k1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		span.End()
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expecting 2 spans, got %v", len(spans))
+	}
+	for i, want := range []string{otelrate.Allowed, otelrate.Denied} {
+		attrs := spans[i].Attributes()
+		if attr(attrs, otelrate.KeyKey).AsString() != "k1" || attr(attrs, otelrate.DecisionKey).AsString() != want {
+			t.Fatalf("span #%d: unexpected attributes %v", i, attrs)
+		}
+	}
+	if ev := spans[1].Events(); len(ev) != 1 || ev[0].Name != "rate_limited" {
+		t.Fatalf("the denied request should have an event, got %v", ev)
+	}
+}
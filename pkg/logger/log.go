@@ -3,10 +3,12 @@
 
 package logger
 
+import "log/slog"
+
 const LogValid bool = false //nolint:gochecknoglobals //i know that
 
 func Log(format string, v ...interface{}) { //nolint:goprintffuncname //no
-
+	slogf(slog.LevelInfo, format, v...)
 }
 
 //
@@ -23,23 +25,23 @@ func GetLevel() (lvl Level) {
 }
 
 func Infof(format string, v ...interface{}) {
-
+	slogf(slog.LevelInfo, format, v...)
 }
 
 func Warnf(format string, v ...interface{}) {
-
+	slogf(slog.LevelWarn, format, v...)
 }
 
 func Debugf(format string, v ...interface{}) {
-
+	slogf(slog.LevelDebug, format, v...)
 }
 
 func Tracef(format string, v ...interface{}) {
-
+	slogf(slog.LevelDebug-4, format, v...)
 }
 
 func Errorf(format string, v ...interface{}) {
-
+	slogf(slog.LevelError, format, v...)
 }
 
 func Fatalf(format string, v ...interface{}) {
@@ -51,5 +53,5 @@ func Panicf(format string, v ...interface{}) {
 }
 
 func Printf(format string, v ...interface{}) {
-
+	slogf(slog.LevelInfo, format, v...)
 }
@@ -3,7 +3,10 @@
 
 package logger
 
-import "log"
+import (
+	"log"
+	"log/slog"
+)
 
 const LogValid bool = true
 
@@ -40,6 +43,9 @@ func GetLevel() (lvl Level) {
 }
 
 func Infof(format string, v ...interface{}) {
+	if slogf(slog.LevelInfo, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Infof(format, v...)
 		return
@@ -48,6 +54,9 @@ func Infof(format string, v ...interface{}) {
 }
 
 func Warnf(format string, v ...interface{}) {
+	if slogf(slog.LevelWarn, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Warnf(format, v...)
 		return
@@ -56,6 +65,9 @@ func Warnf(format string, v ...interface{}) {
 }
 
 func Debugf(format string, v ...interface{}) {
+	if slogf(slog.LevelDebug, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Debugf(format, v...)
 		return
@@ -64,6 +76,9 @@ func Debugf(format string, v ...interface{}) {
 }
 
 func Tracef(format string, v ...interface{}) {
+	if slogf(slog.LevelDebug-4, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Tracef(format, v...)
 		return
@@ -72,6 +87,9 @@ func Tracef(format string, v ...interface{}) {
 }
 
 func Errorf(format string, v ...interface{}) {
+	if slogf(slog.LevelError, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Errorf(format, v...)
 		return
@@ -96,6 +114,9 @@ func Panicf(format string, v ...interface{}) {
 }
 
 func Printf(format string, v ...interface{}) {
+	if slogf(slog.LevelInfo, format, v...) {
+		return
+	}
 	if realLogger != nil {
 		realLogger.Printf(format, v...)
 		return
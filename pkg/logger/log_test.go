@@ -4,6 +4,9 @@
 package logger_test
 
 import (
+	"bytes"
+	"log/slog"
+	"strings"
 	"testing"
 
 	"github.com/hedzr/rate/pkg/logger"
@@ -21,3 +24,23 @@ func TestFLog(t *testing.T) {
 
 	logger.Log("but again")
 }
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	old := logger.SetSlog(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer logger.SetSlog(old)
+	defer logger.SetSlogLevel(logger.SlogLevel())
+
+	logger.Debugf("hidden %d", 1)
+	logger.Warnf("shown %d", 2)
+	if s := buf.String(); strings.Contains(s, "hidden") || !strings.Contains(s, "level=WARN msg=\"shown 2\"") {
+		t.Fatalf("unexpected output: %s", s)
+	}
+
+	buf.Reset()
+	logger.SetSlogLevel(slog.LevelDebug)
+	logger.Debugf("now shown")
+	if !strings.Contains(buf.String(), "level=DEBUG") {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
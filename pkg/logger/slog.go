@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+var (
+	slogger   atomic.Value // holder
+	slogLevel = new(slog.LevelVar)
+)
+
+type holder struct{ l *slog.Logger }
+
+// SetSlog routes the messages of this package to l, regardless of the
+// build tags. A nil l stops the routing.
+func SetSlog(l *slog.Logger) (old *slog.Logger) {
+	old = Slog()
+	slogger.Store(holder{l})
+	return
+}
+
+// Slog returns the logger set by SetSlog, or nil
+func Slog() *slog.Logger {
+	if h, ok := slogger.Load().(holder); ok {
+		return h.l
+	}
+	return nil
+}
+
+// SetSlogLevel sets the minimal level of the structured records at
+// runtime, default is slog.LevelInfo.
+func SetSlogLevel(lvl slog.Level) { slogLevel.Set(lvl) }
+
+// SlogLevel returns the minimal level of the structured records
+func SlogLevel() slog.Level { return slogLevel.Level() }
+
+// LogAttrs emits a structured record to l, if lvl is enabled both by
+// SetSlogLevel and by l.
+func LogAttrs(l *slog.Logger, lvl slog.Level, msg string, attrs ...slog.Attr) {
+	if l == nil || lvl < slogLevel.Level() || !l.Enabled(context.Background(), lvl) {
+		return
+	}
+	l.LogAttrs(context.Background(), lvl, msg, attrs...)
+}
+
+// slogf emits a printf-style message to the logger set by SetSlog, and
+// tells if it has been set.
+func slogf(lvl slog.Level, format string, v ...interface{}) bool {
+	l := Slog()
+	if l == nil {
+		return false
+	}
+	if lvl >= slogLevel.Level() && l.Enabled(context.Background(), lvl) {
+		l.Log(context.Background(), lvl, fmt.Sprintf(format, v...))
+	}
+	return true
+}
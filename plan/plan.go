@@ -0,0 +1,258 @@
+// Package plan limits each key by the limits of its plan, such as the
+// Free, Pro and Enterprise plans of the API keys.
+//
+// A Resolver tells the plan of a key, the table of the plans tells their
+// limits. The limiter of a key is made from its plan at the first use:
+//
+//	pl, err := plan.New(plan.Static(plansOfKeys, "free"), []plan.Plan{
+//		{Name: "free", Algorithm: rate.TokenBucket, MaxCount: 10, Period: time.Minute},
+//		{Name: "pro", Algorithm: rate.TokenBucket, MaxCount: 1000, Period: time.Minute},
+//	})
+//	http.Handle("/", middleware.ForHTTP(middleware.HeaderKey("X-API-KEY"), pl.Limiters, api))
+//
+// When the plan of a key changes, Refresh migrates its limiter to the new
+// plan, and the usage carries over: a key which used 7 of the 10 requests
+// of Free has used 7 of the 1000 requests of Pro.
+package plan
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
+)
+
+// Resolver tells the plan of a key. An empty name means the fallback
+// plan, see WithFallback.
+type Resolver interface {
+	Resolve(key string) (plan string, err error)
+}
+
+// ResolverFunc is a Resolver of a function
+type ResolverFunc func(key string) (plan string, err error)
+
+// Resolve calls f
+func (f ResolverFunc) Resolve(key string) (string, error) { return f(key) }
+
+// Static returns a Resolver of the plans in m, the other keys are on def.
+// m must not be changed after.
+func Static(m map[string]string, def string) Resolver {
+	return ResolverFunc(func(key string) (string, error) {
+		if p, ok := m[key]; ok {
+			return p, nil
+		}
+		return def, nil
+	})
+}
+
+// Plan is a named limit profile
+type Plan struct {
+	Name      string
+	Algorithm rate.Algorithm
+	MaxCount  int64
+	Period    time.Duration
+}
+
+// Option configures Limiters
+type Option func(s *Limiters)
+
+// WithStore sets the store of the states of the keys, default is a
+// store.Memory. The states are kept at the keys as they are.
+func WithStore(st store.Store) Option {
+	return func(s *Limiters) { s.store = st }
+}
+
+// WithFallback sets the plan of the keys resolved to an empty or unknown
+// plan, or failed to resolve. Without it, such keys are not limited, and
+// they are resolved again at each use.
+func WithFallback(name string) Option {
+	return func(s *Limiters) { s.fallback = name }
+}
+
+// WithLimiterOptions sets the options of the limiter of each key besides
+// rate.WithName, which is the name of the plan, and rate.WithKey.
+func WithLimiterOptions(opts ...rate.Option) Option {
+	return func(s *Limiters) { s.opts = append(s.opts, opts...) }
+}
+
+// Limiters holds the limiter of each key made from its plan. The embedded
+// keyed.Limiters fits middleware.ForHTTP.
+type Limiters struct {
+	*keyed.Limiters
+	resolver Resolver
+	plans    map[string]*Plan
+	store    store.Store
+	fallback string
+	opts     []rate.Option
+
+	assigned sync.Map   // key -> *Plan
+	rw       sync.Mutex // serializes the migrations
+}
+
+// New validates the plans and makes the Limiters. The algorithm of each
+// plan must run on a store (see rate.NewAlgorithm), so that the usage of
+// a key survives the migrations.
+func New(resolver Resolver, plans []Plan, opts ...Option) (*Limiters, error) {
+	s := &Limiters{resolver: resolver, plans: make(map[string]*Plan, len(plans))}
+	for i := range plans {
+		p := plans[i]
+		switch {
+		case p.Name == "":
+			return nil, fmt.Errorf("plan #%d has no name", i+1)
+		case s.plans[p.Name] != nil:
+			return nil, fmt.Errorf("plan %q is duplicated", p.Name)
+		case p.MaxCount < 1 || p.Period <= 0:
+			return nil, fmt.Errorf("plan %q: the max count and the period must be positive", p.Name)
+		case rate.NewAlgorithm(p.Algorithm, p.MaxCount, p.Period) == nil:
+			return nil, fmt.Errorf("plan %q: algorithm %q cannot run on a store", p.Name, p.Algorithm)
+		}
+		s.plans[p.Name] = &p
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.fallback != "" && s.plans[s.fallback] == nil {
+		return nil, fmt.Errorf("the fallback plan %q is unknown", s.fallback)
+	}
+	if s.store == nil {
+		s.store = store.NewMemory()
+	}
+	s.Limiters = keyed.New(s.newLimiter)
+	return s, nil
+}
+
+func (s *Limiters) newLimiter(key string) rateapi.Limiter {
+	p := s.resolve(key)
+	if p == nil {
+		return nil
+	}
+	s.assigned.Store(key, p)
+	opts := append([]rate.Option{rate.WithName(p.Name), rate.WithKey(key)}, s.opts...)
+	return rate.NewWithStore(p.Algorithm, p.MaxCount, p.Period, s.store, key, opts...)
+}
+
+// resolve returns the plan of key, or nil if it is not limited
+func (s *Limiters) resolve(key string) *Plan {
+	name, err := s.resolver.Resolve(key)
+	if err != nil {
+		logger.Warnf("plan: resolve the plan of %q failed: %v", key, err)
+		name = ""
+	}
+	if name == "" {
+		name = s.fallback
+	} else if s.plans[name] == nil {
+		logger.Warnf("plan: the plan %q of %q is unknown", name, key)
+		name = s.fallback
+	}
+	return s.plans[name]
+}
+
+// PlanOf returns the plan of the limiter of key, ok is false if key has
+// no limiter.
+func (s *Limiters) PlanOf(key string) (p Plan, ok bool) {
+	if v, found := s.assigned.Load(key); found {
+		if _, ok = s.Lookup(key); ok {
+			p = *v.(*Plan)
+		}
+	}
+	return
+}
+
+// ErrNotLimited is returned by Refresh if the new plan of the key is
+// unknown and there is no fallback, the key is not limited any more.
+var ErrNotLimited = errors.New("plan: the key is not limited")
+
+// Refresh resolves the plan of key again, and migrates its limiter to the
+// new plan if it changed. The usage of the key carries over, such as the
+// requests taken in the window of a counter, the tokens taken from a
+// token bucket, or the water in a leaky bucket; it is capped to the
+// capacity of the new plan. The window of a counter restarts at the
+// migration.
+//
+// A key without a limiter gets its plan at the next use, nothing is done.
+func (s *Limiters) Refresh(key string) (changed bool, err error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	l, ok := s.Lookup(key)
+	v, assigned := s.assigned.Load(key)
+	if !ok || !assigned {
+		return
+	}
+	from, to := v.(*Plan), s.resolve(key)
+	if to == from {
+		return
+	}
+	if to == nil {
+		s.forget(key)
+		return true, ErrNotLimited
+	}
+
+	if err = s.migrate(key, from, to); err != nil {
+		return
+	}
+	s.assigned.Store(key, to)
+	if to.Algorithm == from.Algorithm {
+		if r, ok := l.(rateapi.Reconfigurable); ok {
+			return true, r.Reconfigure(to.MaxCount, to.Period)
+		}
+	}
+	s.Limiters.Delete(key) // rebuilt from the new plan at the next use
+	return true, nil
+}
+
+// RefreshAll refreshes the plans of all keys, and returns the keys which
+// were migrated.
+func (s *Limiters) RefreshAll() (migrated []string) {
+	s.Range(func(key string, _ rateapi.Limiter) bool {
+		if changed, _ := s.Refresh(key); changed {
+			migrated = append(migrated, key)
+		}
+		return true
+	})
+	return
+}
+
+// migrate converts the state of key from the plan from to the plan to
+func (s *Limiters) migrate(key string, from, to *Plan) error {
+	src := rate.NewAlgorithm(from.Algorithm, from.MaxCount, from.Period)
+	dst := rate.NewAlgorithm(to.Algorithm, to.MaxCount, to.Period)
+	now := time.Now().UnixNano()
+	_, err := s.store.Update(key, func(st store.State, exists bool) store.State {
+		used := src.Capacity() - src.Available(st, exists, now)
+		if used < 0 {
+			used = 0
+		} else if c := dst.Capacity(); used > c {
+			used = c
+		}
+		next, _, _ := dst.Decide(store.State{}, false, now, int(used))
+		return next
+	})
+	return err
+}
+
+// Delete closes the limiter of key and forgets its plan and its state
+func (s *Limiters) Delete(key string) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.forget(key)
+}
+
+func (s *Limiters) forget(key string) {
+	s.Limiters.Delete(key)
+	s.assigned.Delete(key)
+	_ = s.store.Delete(key)
+}
+
+// Close closes the limiters of all keys and forgets their plans
+func (s *Limiters) Close() {
+	s.Range(func(key string, _ rateapi.Limiter) bool {
+		s.Delete(key)
+		return true
+	})
+}
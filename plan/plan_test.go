@@ -0,0 +1,118 @@
+package plan_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/plan"
+)
+
+func TestPlans(t *testing.T) {
+	var mu sync.Mutex
+	plans := map[string]string{"k-pro": "pro", "k-bad": "gold"}
+	resolver := plan.ResolverFunc(func(key string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if key == "k-err" {
+			return "", errors.New("billing is down")
+		}
+		return plans[key], nil
+	})
+	setPlan := func(key, name string) {
+		mu.Lock()
+		plans[key] = name
+		mu.Unlock()
+	}
+
+	pl, err := plan.New(resolver, []plan.Plan{
+		{Name: "free", Algorithm: rate.Counter, MaxCount: 10, Period: time.Minute},
+		{Name: "pro", Algorithm: rate.Counter, MaxCount: 100, Period: time.Minute},
+		{Name: "enterprise", Algorithm: rate.TokenBucket, MaxCount: 1000, Period: time.Minute},
+	}, plan.WithFallback("free"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	for key, capacity := range map[string]int64{"k-free": 10, "k-pro": 100, "k-bad": 10, "k-err": 10} {
+		if l := pl.Get(key); l == nil || l.Capacity() != capacity {
+			t.Fatalf("%v: expecting the capacity %v", key, capacity)
+		}
+	}
+
+	// upgraded on the same algorithm
+	l := pl.Get("k-free")
+	if !l.Take(7) {
+		t.Fatal("expecting 7 taken")
+	}
+	setPlan("k-free", "pro")
+	if changed, err := pl.Refresh("k-free"); !changed || err != nil {
+		t.Fatalf("expecting a migration, got %v, %v", changed, err)
+	}
+	if p, _ := pl.PlanOf("k-free"); p.Name != "pro" {
+		t.Fatalf("expecting pro, got %v", p.Name)
+	}
+	if l = pl.Get("k-free"); l.Capacity() != 100 || l.Available() != 93 {
+		t.Fatalf("the usage should carry over, got %v/%v", l.Available(), l.Capacity())
+	}
+
+	// upgraded to another algorithm
+	setPlan("k-free", "enterprise")
+	if changed, err := pl.Refresh("k-free"); !changed || err != nil {
+		t.Fatalf("expecting a migration, got %v, %v", changed, err)
+	}
+	if l = pl.Get("k-free"); l.Capacity() != 1000 || l.Available() != 993 {
+		t.Fatalf("the usage should carry over, got %v/%v", l.Available(), l.Capacity())
+	}
+
+	// downgraded, the usage is capped
+	if !l.Take(100) {
+		t.Fatal("expecting 100 taken")
+	}
+	setPlan("k-free", "free")
+	if migrated := pl.RefreshAll(); len(migrated) != 1 || migrated[0] != "k-free" {
+		t.Fatalf("expecting k-free migrated, got %v", migrated)
+	}
+	if l = pl.Get("k-free"); l.Capacity() != 10 || l.Available() != 0 || l.Take(1) {
+		t.Fatalf("the usage should be capped, got %v/%v", l.Available(), l.Capacity())
+	}
+
+	if changed, _ := pl.Refresh("k-pro"); changed {
+		t.Fatal("an unchanged plan should not be migrated")
+	}
+	if changed, _ := pl.Refresh("k-unknown"); changed {
+		t.Fatal("a key without limiter should not be migrated")
+	}
+}
+
+func TestNotLimited(t *testing.T) {
+	pl, err := plan.New(plan.Static(map[string]string{"k1": "free"}, ""), []plan.Plan{
+		{Name: "free", Algorithm: rate.TokenBucket, MaxCount: 10, Period: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl.Get("k2") != nil {
+		t.Fatal("a key without plan should not be limited")
+	}
+	if pl.Get("k1") == nil {
+		t.Fatal("expecting k1 limited")
+	}
+
+	for _, plans := range [][]plan.Plan{
+		{{Algorithm: rate.Counter, MaxCount: 1, Period: time.Second}},
+		{{Name: "a", Algorithm: rate.Counter, MaxCount: 1, Period: time.Second}, {Name: "a", Algorithm: rate.Counter, MaxCount: 1, Period: time.Second}},
+		{{Name: "a", Algorithm: rate.Counter}},
+		{{Name: "a", Algorithm: rate.PriorityTokenBucket, MaxCount: 1, Period: time.Second}},
+	} {
+		if _, err = plan.New(plan.Static(nil, ""), plans); err == nil {
+			t.Fatalf("expecting %v rejected", plans)
+		}
+	}
+	if _, err = plan.New(plan.Static(nil, ""), nil, plan.WithFallback("x")); err == nil {
+		t.Fatal("expecting the unknown fallback rejected")
+	}
+}
@@ -0,0 +1,299 @@
+// Package policy maps the keys and the client addresses to the special
+// treatments, such as the unlimited internal keys, the denied abusers, or
+// the partners on an alternative limit.
+//
+// A Rule matches by exactly one of:
+//
+//   - Key: the exact key
+//   - Hash: the SHA-256 of the key as "sha256:<hex>", see HashKey, so
+//     that the secrets are not kept in the config
+//   - Prefix: a prefix of the key
+//   - CIDR: a range of the client addresses, such as "10.0.0.0/8"
+//
+// and leads to an Action. The lookups cost O(1) of the size of the list:
+// the exact keys and the hashes are in maps, the prefixes and the CIDRs
+// are in a map per distinct length.
+//
+// The precedence is: the exact key, the hash, the longest prefix, then the
+// longest CIDR.
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Action is the treatment of a matched request
+type Action int
+
+const (
+	// Unlimited requests are not limited
+	Unlimited Action = iota + 1
+	// Deny rejects the requests
+	Deny
+	// Limit applies an alternative named limit
+	Limit
+)
+
+func (a Action) String() string {
+	switch a {
+	case Unlimited:
+		return "unlimited"
+	case Deny:
+		return "deny"
+	case Limit:
+		return "limit"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ErrDenied is returned for the requests denied by a policy
+var ErrDenied = errors.New("denied by policy")
+
+// Rule is an entry of a policy list
+type Rule struct {
+	Key    string `yaml:"key" json:"key,omitempty" toml:"key"`
+	Hash   string `yaml:"hash" json:"hash,omitempty" toml:"hash"`
+	Prefix string `yaml:"prefix" json:"prefix,omitempty" toml:"prefix"`
+	CIDR   string `yaml:"cidr" json:"cidr,omitempty" toml:"cidr"`
+	// Action is "unlimited", "deny" or "limit", default is "limit" if
+	// Limit is set, or "unlimited".
+	Action string `yaml:"action" json:"action,omitempty" toml:"action"`
+	// Limit is the name of the alternative limit
+	Limit string `yaml:"limit" json:"limit,omitempty" toml:"limit"`
+}
+
+// Decision is the result of a lookup
+type Decision struct {
+	Action Action
+	// Limit is the name of the alternative limit if Action is Limit
+	Limit string
+}
+
+func (r *Rule) decision() (d Decision, err error) {
+	switch strings.ToLower(r.Action) {
+	case "":
+		d.Action = Unlimited
+		if r.Limit != "" {
+			d.Action = Limit
+		}
+	case "unlimited":
+		d.Action = Unlimited
+	case "deny":
+		d.Action = Deny
+	case "limit":
+		d.Action = Limit
+	default:
+		return d, fmt.Errorf("unknown action %q", r.Action)
+	}
+	if d.Action == Limit {
+		if r.Limit == "" {
+			return d, errors.New("action limit needs the name of a limit")
+		}
+		d.Limit = r.Limit
+	} else if r.Limit != "" {
+		return d, fmt.Errorf("action %v takes no limit", d.Action)
+	}
+	return
+}
+
+// List is a compiled policy list, it is safe for concurrent lookups
+type List struct {
+	keys     map[string]Decision
+	hashes   map[[sha256.Size]byte]Decision
+	prefixes map[int]map[string]Decision // by length
+	lengths  []int                       // of the prefixes, longest first
+	networks map[int]map[netip.Prefix]Decision
+	bits     []int // of the networks, longest first
+	limits   []string
+}
+
+// Compile compiles the rules, a rule must match by exactly one of its
+// fields and must not duplicate another.
+func Compile(rules []Rule) (*List, error) {
+	l := &List{
+		keys:     make(map[string]Decision),
+		hashes:   make(map[[sha256.Size]byte]Decision),
+		prefixes: make(map[int]map[string]Decision),
+		networks: make(map[int]map[netip.Prefix]Decision),
+	}
+	limits := make(map[string]bool)
+	for i := range rules {
+		if err := l.add(&rules[i]); err != nil {
+			return nil, fmt.Errorf("policy #%d: %w", i+1, err)
+		}
+		if n := rules[i].Limit; n != "" && !limits[n] {
+			limits[n] = true
+			l.limits = append(l.limits, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(l.lengths)))
+	sort.Sort(sort.Reverse(sort.IntSlice(l.bits)))
+	return l, nil
+}
+
+func (l *List) add(r *Rule) error {
+	d, err := r.decision()
+	if err != nil {
+		return err
+	}
+	var set int
+	for _, s := range []string{r.Key, r.Hash, r.Prefix, r.CIDR} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("a rule must have exactly one of key, hash, prefix and cidr")
+	}
+
+	dup := false
+	switch {
+	case r.Key != "":
+		_, dup = l.keys[r.Key]
+		l.keys[r.Key] = d
+	case r.Hash != "":
+		h, err := parseHash(r.Hash)
+		if err != nil {
+			return err
+		}
+		_, dup = l.hashes[h]
+		l.hashes[h] = d
+	case r.Prefix != "":
+		n := len(r.Prefix)
+		m, ok := l.prefixes[n]
+		if !ok {
+			m = make(map[string]Decision)
+			l.prefixes[n] = m
+			l.lengths = append(l.lengths, n)
+		}
+		_, dup = m[r.Prefix]
+		m[r.Prefix] = d
+	default:
+		p, err := parseCIDR(r.CIDR)
+		if err != nil {
+			return err
+		}
+		m, ok := l.networks[p.Bits()]
+		if !ok {
+			m = make(map[netip.Prefix]Decision)
+			l.networks[p.Bits()] = m
+			l.bits = append(l.bits, p.Bits())
+		}
+		_, dup = m[p]
+		m[p] = d
+	}
+	if dup {
+		return fmt.Errorf("duplicated rule %+v", *r)
+	}
+	return nil
+}
+
+func parseHash(s string) (h [sha256.Size]byte, err error) {
+	hexed, ok := strings.CutPrefix(s, "sha256:")
+	b, err := hex.DecodeString(hexed)
+	if !ok || err != nil || len(b) != sha256.Size {
+		return h, fmt.Errorf("hash %q should be like sha256:<64 hex digits>", s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// parseCIDR parses a range or a single address, the IPv4-mapped IPv6
+// ones are unmapped.
+func parseCIDR(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("cidr %q: %w", s, err)
+		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return p, fmt.Errorf("cidr %q: %w", s, err)
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// HashKey returns the value of Rule.Hash for key
+func HashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// AddrOf parses the client address of http.Request.RemoteAddr, the result
+// is invalid if it cannot be parsed.
+func AddrOf(remoteAddr string) netip.Addr {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	a, _ := netip.ParseAddr(host)
+	return a.Unmap()
+}
+
+// Limits returns the names of the alternative limits referred by the list
+func (l *List) Limits() []string {
+	if l == nil {
+		return nil
+	}
+	return l.limits
+}
+
+// Len returns the count of the rules
+func (l *List) Len() (n int) {
+	n = len(l.keys) + len(l.hashes)
+	for _, m := range l.prefixes {
+		n += len(m)
+	}
+	for _, m := range l.networks {
+		n += len(m)
+	}
+	return
+}
+
+// Lookup returns the decision of the key and the client address, ok is
+// false if no rule matches. addr may be invalid, then only the rules of
+// the keys are looked up. A nil List matches nothing.
+func (l *List) Lookup(key string, addr netip.Addr) (d Decision, ok bool) {
+	if l == nil {
+		return
+	}
+	if d, ok = l.keys[key]; ok {
+		return
+	}
+	if len(l.hashes) > 0 {
+		if d, ok = l.hashes[sha256.Sum256([]byte(key))]; ok {
+			return
+		}
+	}
+	for _, n := range l.lengths {
+		if n <= len(key) {
+			if d, ok = l.prefixes[n][key[:n]]; ok {
+				return
+			}
+		}
+	}
+	if addr.IsValid() {
+		addr = addr.Unmap()
+		for _, bits := range l.bits {
+			if p, err := addr.Prefix(bits); err == nil {
+				if d, ok = l.networks[bits][p]; ok {
+					return
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package policy_test
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/hedzr/rate/policy"
+)
+
+func TestLookup(t *testing.T) {
+	l, err := policy.Compile([]policy.Rule{
+		{Key: "internal", Action: "unlimited"},
+		{Hash: policy.HashKey("s3cret"), Action: "deny"},
+		{Prefix: "partner-", Limit: "partners"},
+		{Prefix: "partner-gold-"},
+		{CIDR: "10.0.0.0/8", Action: "unlimited"},
+		{CIDR: "10.1.0.0/16", Action: "deny"},
+		{CIDR: "2001:db8::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 7 || len(l.Limits()) != 1 {
+		t.Fatalf("unexpected list: %v rules, limits %v", l.Len(), l.Limits())
+	}
+
+	addr := netip.MustParseAddr
+	for _, tc := range []struct {
+		key  string
+		addr netip.Addr
+		want policy.Decision
+		ok   bool
+	}{
+		{"internal", addr("10.1.2.3"), policy.Decision{Action: policy.Unlimited}, true},
+		{"s3cret", netip.Addr{}, policy.Decision{Action: policy.Deny}, true},
+		{"partner-acme", netip.Addr{}, policy.Decision{Action: policy.Limit, Limit: "partners"}, true},
+		{"partner-gold-acme", netip.Addr{}, policy.Decision{Action: policy.Unlimited}, true},
+		{"k1", addr("10.2.0.1"), policy.Decision{Action: policy.Unlimited}, true},
+		{"k1", addr("10.1.0.1"), policy.Decision{Action: policy.Deny}, true},
+		{"k1", addr("::ffff:10.1.0.1"), policy.Decision{Action: policy.Deny}, true},
+		{"k1", addr("2001:db8::1"), policy.Decision{Action: policy.Unlimited}, true},
+		{"k1", addr("192.0.2.1"), policy.Decision{}, false},
+		{"k1", netip.Addr{}, policy.Decision{}, false},
+	} {
+		if d, ok := l.Lookup(tc.key, tc.addr); ok != tc.ok || d != tc.want {
+			t.Fatalf("%v %v: expecting %+v, got %+v", tc.key, tc.addr, tc.want, d)
+		}
+	}
+	if _, ok := (*policy.List)(nil).Lookup("internal", netip.Addr{}); ok {
+		t.Fatal("a nil list should match nothing")
+	}
+	if a := policy.AddrOf("[::ffff:10.0.0.1]:8080"); a != addr("10.0.0.1") {
+		t.Fatalf("unexpected address %v", a)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range [][]policy.Rule{
+		{{}},
+		{{Key: "a", Prefix: "a"}},
+		{{Key: "a", Action: "throttle"}},
+		{{Key: "a", Action: "limit"}},
+		{{Key: "a", Action: "deny", Limit: "x"}},
+		{{Hash: "md5:abc"}},
+		{{CIDR: "10.0.0.0/33"}},
+		{{Key: "a"}, {Key: "a", Action: "deny"}},
+	} {
+		if _, err := policy.Compile(rules); err == nil {
+			t.Fatalf("%+v should be rejected", rules)
+		}
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	var rules []policy.Rule
+	for i := 0; i < 100000; i++ {
+		rules = append(rules, policy.Rule{Key: fmt.Sprintf("key-%d", i)}, policy.Rule{Hash: policy.HashKey(fmt.Sprintf("secret-%d", i))})
+	}
+	l, _ := policy.Compile(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Lookup("unknown", netip.Addr{})
+	}
+}
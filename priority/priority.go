@@ -0,0 +1,319 @@
+// Package priority implements a token-bucket limiter with reserved headroom for high priority requests
+package priority
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/tokenbucket"
+)
+
+// Priority of a take/wait call
+type Priority int
+
+const (
+	// Low priority requests, such as batch jobs, may only consume the
+	// tokens above the reserve.
+	Low Priority = iota
+	// High priority requests, such as interactive traffic, may consume
+	// all tokens and are served first from the queue.
+	High
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Low:
+		return "low"
+	case High:
+		return "high"
+	}
+	return "unknown"
+}
+
+// Limiter is a token-bucket rateapi.Limiter which is aware of the priorities.
+//
+// Take and TakeBlocked of rateapi.Limiter are in High priority.
+type Limiter interface {
+	rateapi.Limiter
+	// TakeWithPriority assigns count of allows without blocking. It
+	// fails if anyone of the same or higher priority is waiting.
+	TakeWithPriority(count int, p Priority) bool
+	// WaitWithPriority blocks until count of allows assigned, or ctx is
+	// done. A count above the tokens p may consume, the capacity less the
+	// reserve for Low, fails with ErrTooLarge.
+	WaitWithPriority(ctx context.Context, count int, p Priority) error
+	// Reserve returns the tokens reserved for High priority
+	Reserve() int64
+	// SetReserve changes the tokens reserved for High priority
+	SetReserve(reserve int64)
+}
+
+// DefaultReserveRatio is the ratio of capacity reserved when the limiter is built by rate.New
+const DefaultReserveRatio = 0.1
+
+var (
+	// ErrClosed is returned by WaitWithPriority after the limiter closed
+	ErrClosed = errors.New("priority: limiter closed")
+	// ErrTooLarge is returned by WaitWithPriority if count exceeds the
+	// tokens of its priority, it would never be granted and would block
+	// the waiters behind it
+	ErrTooLarge = errors.New("priority: waiting for more than the capacity")
+)
+
+// New make a new instance of limiter which reserves tokens for High priority
+func New(maxCount int64, d time.Duration, reserve int64) Limiter {
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return nil
+	}
+	if int64(d)/maxCount < 1000 {
+		logger.Errorf("the rate cannot be less than 1000us, it's %v", int64(d)/maxCount)
+		return nil
+	}
+	tb, ok := tokenbucket.New(maxCount, d).(bucket)
+	if !ok {
+		logger.Errorf("priority: the token bucket cannot take above a reserve")
+		return nil
+	}
+	s := &prioritized{
+		bucket:   tb,
+		reserve:  reserve,
+		interval: d / time.Duration(maxCount),
+		wakeCh:   make(chan struct{}, 1),
+		exitCh:   make(chan struct{}),
+	}
+	go s.looper()
+	return s
+}
+
+// NewWithRatio make a new instance of limiter which reserves a ratio of maxCount for High priority
+func NewWithRatio(maxCount int64, d time.Duration, ratio float64) Limiter {
+	return New(maxCount, d, int64(float64(maxCount)*ratio))
+}
+
+type bucket interface {
+	rateapi.Limiter
+	TakeAbove(count int, reserve int64) bool
+}
+
+type waiter struct {
+	count   int
+	p       Priority
+	seq     uint64
+	index   int
+	granted bool
+	err     error // why it was not granted, ErrClosed if nil
+	ch      chan struct{}
+}
+
+// waitQueue is a heap ordered by the priority, and FIFO in one priority
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].p != q[j].p {
+		return q[i].p > q[j].p
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+type prioritized struct {
+	bucket
+	reserve  int64
+	interval time.Duration
+
+	rw     sync.Mutex
+	queue  waitQueue
+	seq    uint64
+	closed bool
+	wakeCh chan struct{}
+	exitCh chan struct{}
+}
+
+func (s *prioritized) Reserve() int64 { return atomic.LoadInt64(&s.reserve) }
+
+// SetReserve changes the reserve, the waiters of Low which no longer fit
+// under the capacity fail with ErrTooLarge
+func (s *prioritized) SetReserve(reserve int64) {
+	atomic.StoreInt64(&s.reserve, reserve)
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *prioritized) reserveFor(p Priority) int64 {
+	if p >= High {
+		return 0
+	}
+	return s.Reserve()
+}
+
+// tooLarge tells if count of p would never be granted
+func (s *prioritized) tooLarge(count int, p Priority) bool {
+	return int64(count) > s.Capacity()-s.reserveFor(p)
+}
+
+// Snapshot implements rateapi.Snapshotter, it is the snapshot of the
+// token bucket, the waiters are not kept.
+func (s *prioritized) Snapshot() ([]byte, error) {
+	if sn, ok := s.bucket.(rateapi.Snapshotter); ok {
+		return sn.Snapshot()
+	}
+	return nil, rateapi.ErrNoSnapshot
+}
+
+// Restore implements rateapi.Snapshotter
+func (s *prioritized) Restore(data []byte) error {
+	if sn, ok := s.bucket.(rateapi.Snapshotter); ok {
+		return sn.Restore(data)
+	}
+	return rateapi.ErrNoSnapshot
+}
+
+func (s *prioritized) Close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.exitCh)
+	for _, w := range s.queue {
+		close(w.ch)
+	}
+	s.queue = nil
+	s.bucket.Close()
+}
+
+// blocked tells if anyone of the same or higher priority is waiting, the caller must hold the lock
+func (s *prioritized) blocked(p Priority) bool {
+	return len(s.queue) > 0 && s.queue[0].p >= p
+}
+
+func (s *prioritized) TakeWithPriority(count int, p Priority) bool {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return !s.closed && !s.blocked(p) && s.TakeAbove(count, s.reserveFor(p))
+}
+
+func (s *prioritized) Take(count int) bool {
+	return s.TakeWithPriority(count, High)
+}
+
+// TakeBlocked is WaitWithPriority in High priority without a deadline,
+// it returns the zero time if the tokens are not granted.
+func (s *prioritized) TakeBlocked(count int) (requestAt time.Time) {
+	requestAt = time.Now().UTC()
+	if err := s.WaitWithPriority(context.Background(), count, High); err != nil {
+		logger.Errorf("priority: %v", err)
+		return time.Time{}
+	}
+	return
+}
+
+func (s *prioritized) WaitWithPriority(ctx context.Context, count int, p Priority) error {
+	s.rw.Lock()
+	if s.closed {
+		s.rw.Unlock()
+		return ErrClosed
+	}
+	if s.tooLarge(count, p) {
+		s.rw.Unlock()
+		return ErrTooLarge
+	}
+	if !s.blocked(p) && s.TakeAbove(count, s.reserveFor(p)) {
+		s.rw.Unlock()
+		return nil
+	}
+	s.seq++
+	w := &waiter{count: count, p: p, seq: s.seq, ch: make(chan struct{})}
+	heap.Push(&s.queue, w)
+	s.rw.Unlock()
+
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-w.ch:
+		if !w.granted {
+			if w.err != nil {
+				return w.err
+			}
+			return ErrClosed
+		}
+		return nil
+	case <-ctx.Done():
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		if w.granted {
+			return nil
+		}
+		if w.index >= 0 && !s.closed {
+			heap.Remove(&s.queue, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// looper grants the tokens to the waiters in order of priority as the
+// bucket refills.
+func (s *prioritized) looper() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.exitCh:
+			return
+		case <-ticker.C:
+		case <-s.wakeCh:
+		}
+		s.dispatch()
+	}
+}
+
+func (s *prioritized) dispatch() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for len(s.queue) > 0 && !s.closed {
+		w := s.queue[0]
+		if s.tooLarge(w.count, w.p) {
+			// the reserve grew since it queued
+			heap.Pop(&s.queue)
+			w.err = ErrTooLarge
+			close(w.ch)
+			continue
+		}
+		if !s.TakeAbove(w.count, s.reserveFor(w.p)) {
+			return // the head of line blocks the lower ones
+		}
+		heap.Pop(&s.queue)
+		w.granted = true
+		close(w.ch)
+	}
+}
@@ -0,0 +1,110 @@
+package priority_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/priority"
+)
+
+func TestReservedHeadroom(t *testing.T) {
+	l := priority.New(10, time.Hour, 4) // no refill during the test
+	defer l.Close()
+
+	var low int
+	for l.TakeWithPriority(1, priority.Low) {
+		low++
+	}
+	if low != 6 || l.Available() != 4 {
+		t.Fatalf("low priority should stop at the reserve, took %v, available %v", low, l.Available())
+	}
+	for i := 0; i < 4; i++ {
+		if !l.Take(1) {
+			t.Fatalf("#%d high priority should consume the reserve", i)
+		}
+	}
+	if l.Take(1) {
+		t.Fatal("the bucket should be empty")
+	}
+}
+
+func TestHighServedFirst(t *testing.T) {
+	l := priority.New(100, time.Second, 0) // one token per 10ms
+	defer l.Close()
+	for l.Take(1) {
+		// drain the initial tokens
+	}
+
+	var mu sync.Mutex
+	var order []priority.Priority
+	var wg sync.WaitGroup
+	wait := func(p priority.Priority) {
+		defer wg.Done()
+		if err := l.WaitWithPriority(context.Background(), 1, p); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		order = append(order, p)
+		mu.Unlock()
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go wait(priority.Low)
+	}
+	time.Sleep(5 * time.Millisecond)
+	wg.Add(1)
+	go wait(priority.High)
+	wg.Wait()
+
+	if order[0] != priority.High && order[1] != priority.High {
+		t.Fatalf("the high priority waiter should overtake the queued low ones: %v", order)
+	}
+}
+
+func TestWaitCancelAndClose(t *testing.T) {
+	l := priority.New(10, time.Hour, 9)
+	if !l.TakeWithPriority(1, priority.Low) {
+		t.Fatal("one token is above the reserve")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.WaitWithPriority(ctx, 1, priority.Low); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+	if err := l.WaitWithPriority(context.Background(), 2, priority.Low); err != priority.ErrTooLarge {
+		t.Fatalf("expecting too large above the reserve, got %v", err)
+	}
+	if at := l.TakeBlocked(11); !at.IsZero() {
+		t.Fatalf("TakeBlocked beyond the capacity should fail, got %v", at)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- l.WaitWithPriority(context.Background(), 1, priority.Low) }()
+	time.Sleep(10 * time.Millisecond)
+	l.SetReserve(10)
+	if err := <-errs; err != priority.ErrTooLarge {
+		t.Fatalf("a waiter no longer fitting the reserve should fail, got %v", err)
+	}
+
+	go func() { errs <- l.WaitWithPriority(context.Background(), 10, priority.High) }()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	if err := <-errs; err != priority.ErrClosed {
+		t.Fatalf("expecting closed, got %v", err)
+	}
+}
+
+func TestFromNew(t *testing.T) {
+	l, ok := rate.New(rate.PriorityTokenBucket, 100, time.Second).(priority.Limiter)
+	if !ok {
+		t.Fatal("expecting a priority.Limiter")
+	}
+	defer l.Close()
+	if l.Reserve() != 10 {
+		t.Fatalf("expecting 10%% of capacity reserved, got %v", l.Reserve())
+	}
+}
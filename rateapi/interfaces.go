@@ -2,6 +2,7 @@
 package rateapi
 
 import (
+	"context"
 	"time"
 )
 
@@ -25,6 +26,22 @@ type Limiter interface {
 	SetEnabled(b bool)
 }
 
+// Semaphore is a Limiter of the concurrent executions rather than of the
+// rate: the allows assigned by Take, TakeBlocked and Acquire are held
+// until they are released. TakeBlocked returns the zero time if the allows
+// are not assigned, such as if the semaphore closed, so the callers which
+// release them should use Take or Acquire instead.
+type Semaphore interface {
+	Limiter
+	// Acquire assigns n of allows, it waits until they are released by
+	// the others or ctx is done.
+	Acquire(ctx context.Context, n int) error
+	// TryAcquire assigns n of allows without blocking, the same as Take.
+	TryAcquire(n int) bool
+	// Release returns n of allows assigned before.
+	Release(n int)
+}
+
 type endMeasurable interface {
 	// Ticks represents the end-point in nanoseconds
 	Ticks() int64
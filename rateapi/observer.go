@@ -0,0 +1,49 @@
+package rateapi
+
+import (
+	"errors"
+	"time"
+)
+
+// Observer is notified of the decisions and the lifecycle of a limiter,
+// see rate.WithObserver.
+//
+// The callbacks run synchronously on the calling goroutine, so they
+// should be fast and must not block.
+type Observer interface {
+	// OnAllow is called after count of allows assigned
+	OnAllow(l Limiter, count int)
+	// OnDeny is called after a request for count of allows rejected
+	OnDeny(l Limiter, count int)
+	// OnWait is called after TakeBlocked waited d for count of allows
+	OnWait(l Limiter, count int, d time.Duration)
+	// OnClose is called after the limiter closed
+	OnClose(l Limiter)
+	// OnReconfigure is called after the limiter reconfigured to maxCount per d
+	OnReconfigure(l Limiter, maxCount int64, d time.Duration)
+}
+
+// Named is implemented by the limiters which know their name and
+// algorithm, such as the ones built by rate.New with rate.WithName.
+type Named interface {
+	Name() string
+	Algorithm() string
+}
+
+// Reconfigurable is implemented by the limiters whose rate can be
+// changed at runtime, such as the ones built by rate.New with options.
+type Reconfigurable interface {
+	Reconfigure(maxCount int64, d time.Duration) error
+}
+
+// Snapshotter is implemented by the limiters whose state can be saved and
+// restored, such as across the restarts. The times in a snapshot are
+// absolute, so that the downtime is credited on restore.
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// ErrNoSnapshot is returned by Snapshot and Restore of a decorator whose
+// limiter cannot snapshot its state.
+var ErrNoSnapshot = errors.New("the limiter cannot snapshot its state")
@@ -0,0 +1,285 @@
+package rateconfig
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/route"
+	"github.com/hedzr/rate/store"
+)
+
+// Limiter is a built definition, it holds a limiter per key
+type Limiter struct {
+	Definition
+	// KeyFunc extracts the key of a request, it fits middleware.KeyFunc
+	KeyFunc func(r *http.Request) (string, error)
+	// Limiters holds the limiters of the keys, the keys unlimited by the
+	// policies get none. The other policies are applied by Set.Limit only.
+	Limiters *keyed.Limiters
+
+	params *atomic.Pointer[params] // shared by the updates of the definition
+}
+
+// params is what the limiters of the keys are made of
+type params struct {
+	algorithm rate.Algorithm
+	maxCount  int64
+	period    time.Duration
+	policies  *policy.List
+	stored    bool // the algorithm can run on a store
+}
+
+func paramsOf(d *Definition) *params {
+	p := &params{algorithm: d.AlgorithmOf()}
+	p.maxCount, p.period, _ = d.Params()
+	p.policies, _ = d.PolicyList()
+	p.stored = rate.NewAlgorithm(p.algorithm, p.maxCount, p.period) != nil
+	return p
+}
+
+// unlimited tells if the key is not limited by a policy
+func (p *params) unlimited(key string) bool {
+	d, ok := p.policies.Lookup(key, netip.Addr{})
+	return ok && d.Action == policy.Unlimited
+}
+
+// Set is the limiters built from a Config. The states of the keys live
+// in an in-memory store, so they survive the changes of the rates applied
+// by Apply, if the algorithm can run on a store.
+type Set struct {
+	view  atomic.Pointer[view]
+	store *store.Memory
+	opts  []rate.Option
+	rw    sync.Mutex // serializes Apply and Close
+}
+
+type view struct {
+	limiters []*Limiter // sorted by priority
+	byName   map[string]*Limiter
+	routes   *route.Matcher
+}
+
+// Build validates c and makes its limiters, opts are applied to the
+// limiter of each key besides rate.WithName and rate.WithKey, such as
+// rate.WithObserver. Two definitions of the same route and priority are
+// an error, a definition without routes is of "/*".
+func (c *Config) Build(opts ...rate.Option) (*Set, error) {
+	if err := errors.Join(c.Validate(), c.validateRoutes()); err != nil {
+		return nil, err
+	}
+	s := &Set{store: store.NewMemory(), opts: opts}
+	var ls []*Limiter
+	for i := range c.Limiters {
+		ls = append(ls, s.newLimiter(c.Limiters[i]))
+	}
+	if err := s.publish(ls); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newLimiter builds a validated definition
+func (s *Set) newLimiter(d Definition) *Limiter {
+	l := &Limiter{Definition: d, params: new(atomic.Pointer[params])}
+	l.KeyFunc, _ = KeyFunc(d.Key)
+	l.params.Store(paramsOf(&d))
+	name, current := d.Name, l.params
+	l.Limiters = keyed.New(func(key string) rateapi.Limiter {
+		p := current.Load()
+		if p.unlimited(key) {
+			return nil
+		}
+		opts := append([]rate.Option{rate.WithName(name), rate.WithKey(key)}, s.opts...)
+		if p.stored {
+			return rate.NewWithStore(p.algorithm, p.maxCount, p.period, s.store, stateKey(name, key), opts...)
+		}
+		return rate.New(p.algorithm, p.maxCount, p.period, opts...)
+	})
+	return l
+}
+
+func stateKey(name, key string) string { return name + "|" + key }
+
+// publish makes ls the live limiters, the routes are checked by
+// Config.validateRoutes already
+func (s *Set) publish(ls []*Limiter) error {
+	v := &view{limiters: ls, byName: make(map[string]*Limiter, len(ls)), routes: route.New()}
+	for _, l := range ls {
+		v.byName[l.Name] = l
+		patterns := l.Routes
+		if len(patterns) == 0 {
+			patterns = []string{"/*"}
+		}
+		for _, pattern := range patterns {
+			if err := v.routes.Add(route.Route{Pattern: pattern, Priority: l.Priority, Value: l}); err != nil {
+				return err
+			}
+		}
+	}
+	sort.SliceStable(v.limiters, func(i, j int) bool { return v.limiters[i].Priority > v.limiters[j].Priority })
+	s.view.Store(v)
+	return nil
+}
+
+// Route returns the limiter of the most specific route of the request,
+// or nil.
+func (s *Set) Route(method, path string) *Limiter {
+	if rt, ok := s.view.Load().routes.Match(method, path); ok {
+		return rt.Value.(*Limiter)
+	}
+	return nil
+}
+
+// Limit picks the limiter of r by its route and the policies, and the
+// key of r. A nil limiter means r is not limited, a request denied by the
+// policies results in policy.ErrDenied. It fits middleware.LimiterFunc,
+// so that one middleware applies all definitions:
+//
+//	h := middleware.ForHTTPFunc(set.Limit, next)
+func (s *Set) Limit(r *http.Request) (key string, l rateapi.Limiter, err error) {
+	def := s.Route(r.Method, r.URL.Path)
+	if def == nil {
+		return
+	}
+	if key, err = def.KeyFunc(r); err != nil {
+		return
+	}
+	if d, ok := def.params.Load().policies.Lookup(key, policy.AddrOf(r.RemoteAddr)); ok {
+		switch d.Action {
+		case policy.Unlimited:
+			return key, nil, nil
+		case policy.Deny:
+			return key, nil, policy.ErrDenied
+		case policy.Limit:
+			if alt := s.Get(d.Limit); alt != nil {
+				def = alt
+			}
+		}
+	}
+	return key, def.Limiters.Get(key), nil
+}
+
+// Get returns the limiter named name, or nil. Get it per request rather
+// than keeping it, to see the replacements made by Apply.
+func (s *Set) Get(name string) *Limiter { return s.view.Load().byName[name] }
+
+// All returns the limiters sorted by priority, the higher one first
+func (s *Set) All() []*Limiter { return s.view.Load().limiters }
+
+// Close closes the limiters of all keys
+func (s *Set) Close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	for _, l := range s.All() {
+		l.Limiters.Close()
+	}
+}
+
+// Changes are the names of the definitions changed by Apply
+type Changes struct {
+	Added []string
+	// Updated are changed in place, the states of the keys are kept
+	Updated []string
+	// Replaced are rebuilt since the algorithm or the key changed, the
+	// states of the keys are dropped.
+	Replaced []string
+	Removed  []string
+}
+
+// Empty tells if nothing changed
+func (c Changes) Empty() bool {
+	return len(c.Added)+len(c.Updated)+len(c.Replaced)+len(c.Removed) == 0
+}
+
+// Apply validates c and applies its differences to the live limiters:
+// the changed rates and capacities are reconfigured in place, the new
+// definitions are added and the removed ones are closed. If c is
+// invalid, nothing changes.
+//
+// The states of the keys survive the reconfiguration if the algorithm
+// can run on a store, otherwise the limiters of the keys start over.
+func (s *Set) Apply(c *Config) (ch Changes, err error) {
+	if err = errors.Join(c.Validate(), c.validateRoutes()); err != nil {
+		return
+	}
+	s.rw.Lock()
+	defer s.rw.Unlock()
+
+	old := s.view.Load().byName
+	var ls []*Limiter
+	for i := range c.Limiters {
+		d := c.Limiters[i]
+		l, ok := old[d.Name]
+		switch {
+		case !ok:
+			ch.Added = append(ch.Added, d.Name)
+			l = s.newLimiter(d)
+		case l.AlgorithmOf() != d.AlgorithmOf() || l.Key != d.Key:
+			ch.Replaced = append(ch.Replaced, d.Name)
+			s.drop(l)
+			l = s.newLimiter(d)
+		case !reflect.DeepEqual(l.Definition, d):
+			ch.Updated = append(ch.Updated, d.Name)
+			l = s.update(l, d)
+		}
+		ls = append(ls, l)
+	}
+	for name, l := range old {
+		if !c.has(name) {
+			ch.Removed = append(ch.Removed, name)
+			s.drop(l)
+		}
+	}
+	err = s.publish(ls)
+	return
+}
+
+func (c *Config) has(name string) bool {
+	for i := range c.Limiters {
+		if c.Limiters[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies d to the limiters of l in place
+func (s *Set) update(l *Limiter, d Definition) *Limiter {
+	p, prev := paramsOf(&d), (*params)(nil)
+	// the keys made from prev are all seen by the Range below
+	l.Limiters.Update(func() { prev = l.params.Swap(p) })
+	nl := &Limiter{Definition: d, KeyFunc: l.KeyFunc, Limiters: l.Limiters, params: l.params}
+	l.Limiters.Range(func(key string, kl rateapi.Limiter) bool {
+		if p.unlimited(key) {
+			l.Limiters.Delete(key)
+			_ = s.store.Delete(stateKey(l.Name, key))
+			return true
+		}
+		if p.maxCount != prev.maxCount || p.period != prev.period {
+			if r, ok := kl.(rateapi.Reconfigurable); ok {
+				_ = r.Reconfigure(p.maxCount, p.period)
+			}
+		}
+		return true
+	})
+	return nl
+}
+
+// drop closes the limiters of l and forgets the states of the keys
+func (s *Set) drop(l *Limiter) {
+	l.Limiters.Range(func(key string, _ rateapi.Limiter) bool {
+		l.Limiters.Delete(key)
+		_ = s.store.Delete(stateKey(l.Name, key))
+		return true
+	})
+}
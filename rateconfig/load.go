@@ -0,0 +1,201 @@
+package rateconfig
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the syntax of a config file
+type Format string
+
+// The formats
+const (
+	YAML Format = "yaml"
+	JSON Format = "json"
+	TOML Format = "toml"
+)
+
+// FormatOf returns the format of a file by its extension, default is YAML
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return JSON
+	case ".toml":
+		return TOML
+	}
+	return YAML
+}
+
+// Load reads, parses and validates the config file at path
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, FormatOf(path), path)
+}
+
+// Parse parses and validates a config in format, file names the source
+// in the errors. The error joins an *Error per problem.
+func Parse(data []byte, format Format, file string) (c *Config, err error) {
+	c = &Config{file: file}
+	switch format {
+	case YAML:
+		err = c.parseYAML(data)
+	case JSON:
+		err = c.parseJSON(data)
+	case TOML:
+		err = c.parseTOML(data)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// yamlLine matches the location in the messages of yaml.v3
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+func (c *Config) yamlError(err error) error {
+	msgs := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+	var errs []error
+	for _, msg := range msgs {
+		e := &Error{File: c.file, Err: errors.New(msg)}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Err = errors.New(m[2])
+		}
+		errs = append(errs, e)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) parseYAML(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return c.yamlError(err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return err
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "limiters" {
+			for _, item := range root.Content[i+1].Content {
+				c.lines = append(c.lines, item.Line)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) parseJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		e := &Error{File: c.file, Err: err}
+		var se *json.SyntaxError
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &se) {
+			e.Line = lineOf(data, se.Offset)
+		} else if errors.As(err, &te) {
+			e.Line = lineOf(data, te.Offset)
+		}
+		return errors.Join(e)
+	}
+
+	// walk the tokens again for the offsets of the definitions
+	dec = json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if key != "limiters" {
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return nil
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return nil
+		}
+		for dec.More() {
+			off := dec.InputOffset()
+			for off < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[off]) >= 0 {
+				off++
+			}
+			c.lines = append(c.lines, lineOf(data, off))
+			var skip json.RawMessage
+			if dec.Decode(&skip) != nil {
+				return nil
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
+
+func (c *Config) parseTOML(data []byte) error {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		e := &Error{File: c.file, Err: err}
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			e.Line, e.Err = pe.Position.Line, errors.New(pe.Message)
+		}
+		return errors.Join(e)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return errors.Join(&Error{File: c.file, Err: fmt.Errorf("unknown fields %v", keys)})
+	}
+
+	// the definitions are located by their [[limiters]] headers, the
+	// inline array of tables is not located.
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(s, "[[") && strings.TrimSpace(strings.Trim(s, "[]")) == "limiters" {
+			c.lines = append(c.lines, line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+// Package rateconfig loads the limiter definitions from YAML, JSON or
+// TOML files, validates them and builds the limiters.
+//
+//	# limits.yaml
+//	limiters:
+//	  - name: by-api-key
+//	    algorithm: token-bucket
+//	    rate: 100/s
+//	    burst: 200
+//	    key: header:X-API-KEY
+//	    exceptions: [internal-test-key]
+//	    policies:
+//	      - cidr: 10.0.0.0/8
+//	        action: unlimited
+//	      - prefix: partner-
+//	        limit: partners
+//	    routes: ["GET /v1/*"]
+//	    priority: 10
+//
+//	c, err := rateconfig.Load("limits.yaml")
+//	...
+//	set, err := c.Build(rate.WithObserver(metrics))
+//	...
+//	l := set.Get("by-api-key")
+//	h := middleware.ForHTTP(l.KeyFunc, l.Limiters, next)
+//
+// A validation error points at the file and the line of the bad entry,
+// see Error.
+package rateconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/route"
+)
+
+// Config is the content of a limiter config file
+type Config struct {
+	Limiters []Definition `yaml:"limiters" json:"limiters" toml:"limiters"`
+
+	file  string
+	lines []int // the line of each definition, 0 if unknown
+}
+
+// Definition describes a limiter per key
+type Definition struct {
+	Name        string `yaml:"name" json:"name" toml:"name"`
+	Description string `yaml:"description" json:"description,omitempty" toml:"description"`
+	// Algorithm is the name registered in package rate, default is rate.TokenBucket
+	Algorithm string `yaml:"algorithm" json:"algorithm,omitempty" toml:"algorithm"`
+	// Rate is the sustained rate such as "100/s", "5/min" or "1000/1h", see ParseRate
+	Rate string `yaml:"rate" json:"rate" toml:"rate"`
+	// Burst is the capacity of the limiter, default is the count of Rate.
+	// The period is stretched to keep the rate, so "100/s" with burst 200
+	// makes a limiter of 200 per 2s.
+	Burst int64 `yaml:"burst" json:"burst,omitempty" toml:"burst"`
+	// Key tells how to extract the key of a request, see KeyFunc
+	Key string `yaml:"key" json:"key,omitempty" toml:"key"`
+	// Exceptions are the keys which are not limited, the shorthand of
+	// the policies of action unlimited.
+	Exceptions []string `yaml:"exceptions" json:"exceptions,omitempty" toml:"exceptions"`
+	// Policies treat the keys and the client addresses specially, such as
+	// denying them or applying another definition to them, see package
+	// policy.
+	Policies []policy.Rule `yaml:"policies" json:"policies,omitempty" toml:"policies"`
+	// Routes are the patterns such as "POST /v1/upload" or "/v1/*" which
+	// the limiter applies to, see package route. Empty means "/*", the
+	// least specific one.
+	Routes []string `yaml:"routes" json:"routes,omitempty" toml:"routes"`
+	// Priority orders the limiters, and breaks the tie between the
+	// routes of the same path, the higher one first.
+	Priority int `yaml:"priority" json:"priority,omitempty" toml:"priority"`
+}
+
+// AlgorithmOf returns the algorithm of d with the default applied
+func (d *Definition) AlgorithmOf() rate.Algorithm {
+	if d.Algorithm == "" {
+		return rate.TokenBucket
+	}
+	return rate.Algorithm(d.Algorithm)
+}
+
+// Params returns the arguments of rate.New for d
+func (d *Definition) Params() (maxCount int64, period time.Duration, err error) {
+	r, err := ParseRate(d.Rate)
+	if err != nil {
+		return
+	}
+	if d.Burst < 0 {
+		return 0, 0, errors.New("burst must not be negative")
+	}
+	maxCount, period = r.Count, r.Per
+	if d.Burst > 0 && d.Burst != r.Count {
+		maxCount, period = d.Burst, time.Duration(int64(r.Per)*d.Burst/r.Count)
+	}
+	return
+}
+
+// PolicyList compiles the exceptions and the policies of d
+func (d *Definition) PolicyList() (*policy.List, error) {
+	rules := make([]policy.Rule, 0, len(d.Exceptions)+len(d.Policies))
+	for _, k := range d.Exceptions {
+		rules = append(rules, policy.Rule{Key: k, Action: "unlimited"})
+	}
+	return policy.Compile(append(rules, d.Policies...))
+}
+
+// Plans validates c and takes its definitions as a table of plans, by
+// their names, algorithms, rates and bursts. See package plan.
+func (c *Config) Plans() ([]plan.Plan, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	plans := make([]plan.Plan, 0, len(c.Limiters))
+	for i := range c.Limiters {
+		d := &c.Limiters[i]
+		p := plan.Plan{Name: d.Name, Algorithm: d.AlgorithmOf()}
+		p.MaxCount, p.Period, _ = d.Params()
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// validate checks d without its location, known holds the names seen
+func (d *Definition) validate(known map[string]bool) error {
+	if d.Name == "" {
+		return errors.New("name is required")
+	}
+	if known[d.Name] {
+		return fmt.Errorf("name %q is defined twice", d.Name)
+	}
+	known[d.Name] = true
+
+	maxCount, period, err := d.Params()
+	if err != nil {
+		return err
+	}
+	if _, err = KeyFunc(d.Key); err != nil {
+		return err
+	}
+	if _, err = d.PolicyList(); err != nil {
+		return err
+	}
+	m := route.New()
+	for _, pattern := range d.Routes {
+		if err = m.Add(route.Route{Pattern: pattern}); err != nil {
+			return err
+		}
+	}
+	l := rate.New(d.AlgorithmOf(), maxCount, period)
+	if l == nil {
+		return fmt.Errorf("algorithm %q cannot make a limiter of %d per %v", d.AlgorithmOf(), maxCount, period)
+	}
+	l.Close()
+	return nil
+}
+
+// Validate checks all definitions, the result joins an *Error per bad
+// definition.
+func (c *Config) Validate() error {
+	var errs []error
+	known := make(map[string]bool)
+	for i := range c.Limiters {
+		if err := c.Limiters[i].validate(known); err != nil {
+			errs = append(errs, c.errorAt(i, err))
+		}
+	}
+	for i := range c.Limiters {
+		for _, p := range c.Limiters[i].Policies {
+			if p.Limit != "" && !known[p.Limit] {
+				errs = append(errs, c.errorAt(i, fmt.Errorf("policy refers to the unknown limiter %q", p.Limit)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateRoutes checks that no two definitions share a route and a
+// priority, only one of them would ever apply to the requests. A
+// definition without routes is of "/*". The plans do not route, so it is
+// checked by Build and Apply rather than Validate.
+func (c *Config) validateRoutes() error {
+	type slot struct {
+		pattern  string
+		priority int
+	}
+	var errs []error
+	taken := make(map[slot]string)
+	for i := range c.Limiters {
+		d := &c.Limiters[i]
+		patterns := d.Routes
+		if len(patterns) == 0 {
+			patterns = []string{"/*"}
+		}
+		for _, pattern := range patterns {
+			if name, ok := taken[slot{pattern, d.Priority}]; ok {
+				errs = append(errs, c.errorAt(i, fmt.Errorf("route %q of priority %d is taken by %q, only one of them would apply", pattern, d.Priority, name)))
+				continue
+			}
+			taken[slot{pattern, d.Priority}] = d.Name
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) errorAt(i int, err error) *Error {
+	e := &Error{File: c.file, Name: c.Limiters[i].Name, Err: err}
+	if i < len(c.lines) {
+		e.Line = c.lines[i]
+	}
+	return e
+}
+
+// Error is a problem of a config file, located by the line if known
+type Error struct {
+	File string
+	Line int
+	// Name is the name of the bad definition, if any
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	if e.File != "" {
+		sb.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&sb, ":%d", e.Line)
+		}
+		sb.WriteString(": ")
+	} else if e.Line > 0 {
+		fmt.Fprintf(&sb, "line %d: ", e.Line)
+	}
+	if e.Name != "" {
+		fmt.Fprintf(&sb, "limiter %q: ", e.Name)
+	}
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Rate is a count of requests per period
+type Rate struct {
+	Count int64
+	Per   time.Duration
+}
+
+func (r Rate) String() string { return fmt.Sprintf("%d/%v", r.Count, r.Per) }
+
+var units = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+}
+
+// ParseRate parses a rate such as "100/s", "5/min", "10/2h", "1/1m30s"
+// or "1000/day".
+func ParseRate(s string) (r Rate, err error) {
+	count, per, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return r, fmt.Errorf("rate %q should be like 100/s", s)
+	}
+	if r.Count, err = strconv.ParseInt(strings.TrimSpace(count), 10, 64); err != nil || r.Count < 1 {
+		return Rate{}, fmt.Errorf("rate %q should have a positive count", s)
+	}
+
+	per = strings.TrimSpace(per)
+	unit := strings.TrimLeft(per, "0123456789")
+	if u, ok := units[unit]; ok {
+		n := int64(1)
+		if unit != per {
+			n, _ = strconv.ParseInt(per[:len(per)-len(unit)], 10, 64)
+		}
+		r.Per = time.Duration(n) * u
+	} else if r.Per, err = time.ParseDuration(per); err != nil {
+		return Rate{}, fmt.Errorf("rate %q has an unknown period", s)
+	}
+	if r.Per <= 0 {
+		return Rate{}, fmt.Errorf("rate %q should have a positive period", s)
+	}
+	return
+}
+
+// KeyFunc returns the key extractor described by spec:
+//
+//   - "" or "global": all requests share one key
+//   - "ip": the client address of the connection
+//   - "header:NAME": the header NAME, the request without it is rejected
+//   - "query:NAME": the query parameter NAME
+//   - "cookie:NAME": the cookie NAME
+//
+// The result fits middleware.KeyFunc.
+func KeyFunc(spec string) (func(r *http.Request) (string, error), error) {
+	source, name, _ := strings.Cut(spec, ":")
+	switch source {
+	case "", "global":
+		return func(*http.Request) (string, error) { return "global", nil }, nil
+	case "ip":
+		return func(r *http.Request) (string, error) {
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				return host, nil
+			}
+			return r.RemoteAddr, nil
+		}, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("key %q should be like header:X-API-KEY", spec)
+	}
+	var value func(r *http.Request) string
+	switch source {
+	case "header":
+		value = func(r *http.Request) string { return r.Header.Get(name) }
+	case "query":
+		value = func(r *http.Request) string { return r.URL.Query().Get(name) }
+	case "cookie":
+		value = func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}
+	default:
+		return nil, fmt.Errorf("key %q has an unknown source %q", spec, source)
+	}
+	return func(r *http.Request) (string, error) {
+		if key := value(r); key != "" {
+			return key, nil
+		}
+		return "", fmt.Errorf("%s key %q is missing", source, name)
+	}, nil
+}
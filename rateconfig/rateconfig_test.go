@@ -0,0 +1,370 @@
+package rateconfig_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/rateconfig"
+)
+
+const yamlConfig = `limiters:
+  - name: by-api-key
+    rate: 2/s
+    burst: 4
+    key: header:X-API-KEY
+    exceptions: [test-key]
+    routes: ["GET /v1/*"]
+    priority: 10
+  - name: upload
+    algorithm: counter
+    rate: 5/min
+    key: ip
+    routes: ["POST /v1/upload"]
+    priority: 20
+`
+
+const jsonConfig = `{
+  "limiters": [
+    {"name": "by-api-key", "rate": "2/s", "burst": 4, "key": "header:X-API-KEY",
+     "exceptions": ["test-key"], "routes": ["GET /v1/*"], "priority": 10},
+    {"name": "upload", "algorithm": "counter", "rate": "5/min", "key": "ip",
+     "routes": ["POST /v1/upload"], "priority": 20}
+  ]
+}`
+
+const tomlConfig = `[[limiters]]
+name = "by-api-key"
+rate = "2/s"
+burst = 4
+key = "header:X-API-KEY"
+exceptions = ["test-key"]
+routes = ["GET /v1/*"]
+priority = 10
+
+[[limiters]]
+name = "upload"
+algorithm = "counter"
+rate = "5/min"
+key = "ip"
+routes = ["POST /v1/upload"]
+priority = 20
+`
+
+func TestFormats(t *testing.T) {
+	for format, data := range map[rateconfig.Format]string{
+		rateconfig.YAML: yamlConfig,
+		rateconfig.JSON: jsonConfig,
+		rateconfig.TOML: tomlConfig,
+	} {
+		c, err := rateconfig.Parse([]byte(data), format, "limits")
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if len(c.Limiters) != 2 || c.Limiters[0].Burst != 4 || c.Limiters[1].Algorithm != "counter" ||
+			c.Limiters[0].Exceptions[0] != "test-key" || c.Limiters[1].Routes[0] != "POST /v1/upload" {
+			t.Fatalf("%v: unexpected definitions %+v", format, c.Limiters)
+		}
+		maxCount, period, _ := c.Limiters[0].Params()
+		if maxCount != 4 || period != 2*time.Second {
+			t.Fatalf("%v: the burst should stretch the period, got %v per %v", format, maxCount, period)
+		}
+	}
+}
+
+func TestErrorLines(t *testing.T) {
+	for _, tc := range []struct {
+		format rateconfig.Format
+		data   string
+		lines  []int
+	}{
+		{rateconfig.YAML, "limiters:\n  - name: a\n    rate: 1/s\n  - name: b\n    rate: 0/s\n  - name: c\n    rate: 1/fortnight\n", []int{4, 6}},
+		{rateconfig.YAML, "limiters:\n  - name: a\n    rate: 1/s\n    brust: 3\n", []int{4}},
+		{rateconfig.JSON, "{\"limiters\": [\n {\"name\": \"a\", \"rate\": \"1/s\"},\n {\"name\": \"a\", \"rate\": \"1/s\"}\n]}", []int{3}},
+		{rateconfig.JSON, "{\"limiters\": [\n {\"name\": \"a\",\n \"rate\": 1}]}", []int{3}},
+		{rateconfig.TOML, "[[limiters]]\nname = \"a\"\nrate = \"1/s\"\n\n[[limiters]]\nname = \"b\"\nrate = \"1/s\"\nkey = \"body:x\"\n", []int{5}},
+		{rateconfig.TOML, "[[limiters]]\nname = \"a\"\nrate = \"1/s\"\nalgorithm = \"nope\"\n", []int{1}},
+	} {
+		_, err := rateconfig.Parse([]byte(tc.data), tc.format, "limits."+string(tc.format))
+		if err == nil {
+			t.Fatalf("%v: expecting errors in %q", tc.format, tc.data)
+		}
+		var lines []int
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var ce *rateconfig.Error
+			if !errors.As(e, &ce) {
+				t.Fatalf("%v: expecting *rateconfig.Error, got %v", tc.format, e)
+			}
+			lines = append(lines, ce.Line)
+		}
+		if len(lines) != len(tc.lines) || lines[0] != tc.lines[0] || lines[len(lines)-1] != tc.lines[len(tc.lines)-1] {
+			t.Fatalf("%v: expecting the lines %v, got %v: %v", tc.format, tc.lines, lines, err)
+		}
+		if !strings.HasPrefix(err.Error(), "limits."+string(tc.format)+":") {
+			t.Fatalf("%v: the error should be located, got %v", tc.format, err)
+		}
+	}
+}
+
+func TestLoadAndBuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rateconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	if all := set.All(); len(all) != 2 || all[0].Name != "upload" {
+		t.Fatal("the limiters should be sorted by priority")
+	}
+
+	l := set.Get("by-api-key")
+	r := httptest.NewRequest("GET", "/v1/users", nil)
+	if _, err = l.KeyFunc(r); err == nil {
+		t.Fatal("a request without the key should be rejected")
+	}
+	r.Header.Set("X-API-KEY", "k1")
+	key, _ := l.KeyFunc(r)
+	limiter := l.Limiters.Get(key)
+	if limiter == nil || limiter.Capacity() != 4 {
+		t.Fatal("the limiter should have the burst as capacity")
+	}
+	if l.Limiters.Get("test-key") != nil {
+		t.Fatal("an exception should not be limited")
+	}
+
+	key, _ = set.Get("upload").KeyFunc(r)
+	if key != "192.0.2.1" {
+		t.Fatalf("expecting the client address, got %q", key)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"100/s": time.Second, "5/min": time.Minute, "10/2h": 2 * time.Hour,
+		"1/1m30s": 90 * time.Second, "1000/day": 24 * time.Hour, "3/500ms": 500 * time.Millisecond,
+	} {
+		if r, err := rateconfig.ParseRate(s); err != nil || r.Per != want {
+			t.Fatalf("%q: expecting the period %v, got %v, %v", s, want, r.Per, err)
+		}
+	}
+	for _, s := range []string{"", "100", "x/s", "-1/s", "1/0s", "1/-5s"} {
+		if _, err := rateconfig.ParseRate(s); err == nil {
+			t.Fatalf("%q should be rejected", s)
+		}
+	}
+}
+
+func parse(t *testing.T, data string) *rateconfig.Config {
+	t.Helper()
+	c, err := rateconfig.Parse([]byte(data), rateconfig.YAML, "limits.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestApply(t *testing.T) {
+	set, err := parse(t, yamlConfig).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	l := set.Get("by-api-key").Limiters.Get("k1")
+	for i := 0; i < 3; i++ {
+		l.Take(1)
+	}
+
+	ch, err := set.Apply(parse(t, `limiters:
+  - name: by-api-key
+    rate: 5/s
+    burst: 10
+    key: header:X-API-KEY
+    exceptions: [test-key, k2]
+  - name: search
+    rate: 1/s
+    routes: ["GET /v1/search"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.Updated) != 1 || len(ch.Added) != 1 || len(ch.Removed) != 1 || len(ch.Replaced) != 0 {
+		t.Fatalf("unexpected changes %+v", ch)
+	}
+	if l.Capacity() != 10 || l.Available() != 1 {
+		t.Fatalf("the limiter should be reconfigured in place, got %v of %v", l.Available(), l.Capacity())
+	}
+	if set.Get("by-api-key").Limiters.Get("k2") != nil || set.Get("upload") != nil || set.Get("search") == nil {
+		t.Fatal("the exceptions and the definitions should be applied")
+	}
+
+	ch, err = set.Apply(parse(t, "limiters:\n  - name: search\n    rate: 1/s\n    key: ip\n"))
+	if err != nil || len(ch.Replaced) != 1 || len(ch.Removed) != 1 {
+		t.Fatalf("a new key should replace the limiter: %+v, %v", ch, err)
+	}
+	if _, err = set.Apply(&rateconfig.Config{Limiters: []rateconfig.Definition{{Name: "bad", Rate: "1/0s"}}}); err == nil {
+		t.Fatal("an invalid config should be rejected")
+	}
+	if _, err = set.Apply(parse(t, "limiters:\n  - name: by-key\n    rate: 100/s\n  - name: by-ip\n    rate: 1/min\n    key: ip\n")); err == nil {
+		t.Fatal("two definitions of the same route and priority should be rejected")
+	}
+	if set.Get("search") == nil || len(set.All()) != 1 {
+		t.Fatal("the rejected config should change nothing")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := rateconfig.Load(path)
+	set, _ := c.Build()
+	defer set.Close()
+
+	reloads := make(chan error, 10)
+	w := set.Watch(path, rateconfig.WithInterval(10*time.Millisecond), rateconfig.WithReloadHook(func(ch rateconfig.Changes, err error) {
+		reloads <- err
+	}))
+	defer w.Close()
+
+	if err := os.WriteFile(path, []byte("limiters:\n  - name: upload\n    rate: 0/s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reloads; err == nil || !strings.Contains(err.Error(), "limits.yaml:2:") {
+		t.Fatalf("the invalid file should be rejected, got %v", err)
+	}
+	if len(set.All()) != 2 {
+		t.Fatal("the old config should keep running")
+	}
+
+	if err := os.WriteFile(path, []byte("limiters:\n  - name: upload\n    rate: 7/min\n    key: ip\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reloads; err != nil || len(set.All()) != 1 || set.Get("upload").Rate != "7/min" {
+		t.Fatalf("the fixed file should be applied, got %v", err)
+	}
+}
+
+func TestWatchReaders(t *testing.T) {
+	set, _ := parse(t, yamlConfig).Build()
+	defer set.Close()
+	ch := make(chan io.Reader)
+	reloads := make(chan rateconfig.Changes, 1)
+	w := set.WatchReaders(ch, rateconfig.JSON, rateconfig.WithReloadHook(func(c rateconfig.Changes, err error) { reloads <- c }))
+	ch <- bytes.NewBufferString(jsonConfig) // the same definitions
+	ch <- bytes.NewBufferString(`{"limiters": [{"name": "upload", "algorithm": "counter", "rate": "5/min", "key": "ip"}]}`)
+	if c := <-reloads; len(c.Removed) != 1 || len(c.Updated) != 1 {
+		t.Fatalf("unexpected changes %+v", c)
+	}
+	close(ch)
+	w.Close()
+}
+
+func TestLimit(t *testing.T) {
+	set, _ := parse(t, yamlConfig+"  - name: fallback\n    rate: 1/s\n").Build()
+	defer set.Close()
+	for _, tc := range []struct{ method, path, want string }{
+		{"POST", "/v1/upload", "upload"},
+		{"GET", "/v1/upload", "by-api-key"},
+		{"DELETE", "/v1/users", "fallback"},
+	} {
+		if l := set.Route(tc.method, tc.path); l == nil || l.Name != tc.want {
+			t.Fatalf("%v %v: expecting %v", tc.method, tc.path, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/v1/users", nil)
+	r.Header.Set("X-API-KEY", "test-key")
+	if key, l, err := set.Limit(r); err != nil || key != "test-key" || l != nil {
+		t.Fatalf("an exception should not be limited: %v, %v, %v", key, l, err)
+	}
+	r.Header.Del("X-API-KEY")
+	if _, _, err := set.Limit(r); err == nil {
+		t.Fatal("a request without the key should be rejected")
+	}
+	if key, l, err := set.Limit(httptest.NewRequest("POST", "/v1/upload", nil)); err != nil || key != "192.0.2.1" || l.Capacity() != 5 {
+		t.Fatalf("unexpected limiter: %v, %v", key, err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	set, err := parse(t, `limiters:
+  - name: api
+    rate: 1/min
+    key: header:X-API-KEY
+    exceptions: [internal]
+    policies:
+      - hash: `+policy.HashKey("leaked")+`
+        action: deny
+      - prefix: partner-
+        limit: partners
+      - cidr: 10.0.0.0/8
+  - name: partners
+    rate: 5/min
+    key: header:X-API-KEY
+    routes: ["/partners/*"]
+`).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+	limit := func(key, remoteAddr string) (rateapi.Limiter, error) {
+		r := httptest.NewRequest("GET", "/v1/users", nil)
+		r.Header.Set("X-API-KEY", key)
+		r.RemoteAddr = remoteAddr
+		_, l, err := set.Limit(r)
+		return l, err
+	}
+	if l, err := limit("internal", "192.0.2.1:1234"); l != nil || err != nil {
+		t.Fatal("an exception should not be limited")
+	}
+	if _, err := limit("leaked", "192.0.2.1:1234"); !errors.Is(err, policy.ErrDenied) {
+		t.Fatalf("a denied key should be rejected, got %v", err)
+	}
+	if l, _ := limit("partner-acme", "192.0.2.1:1234"); l == nil || l.Capacity() != 5 {
+		t.Fatal("a partner should be on the partners limit")
+	}
+	if l, _ := limit("k1", "10.1.2.3:1234"); l != nil {
+		t.Fatal("the internal network should not be limited")
+	}
+	if l, _ := limit("k1", "192.0.2.1:1234"); l == nil || l.Capacity() != 1 {
+		t.Fatal("the other keys should be limited")
+	}
+
+	_, err = rateconfig.Parse([]byte("limiters:\n  - name: api\n    rate: 1/s\n    policies:\n      - prefix: p-\n        limit: nope\n"), rateconfig.YAML, "limits.yaml")
+	if err == nil || !strings.Contains(err.Error(), `limits.yaml:2: limiter "api": policy refers to the unknown limiter "nope"`) {
+		t.Fatalf("an unknown limit should be rejected, got %v", err)
+	}
+}
+
+func TestPlans(t *testing.T) {
+	plans, err := parse(t, "limiters:\n  - name: free\n    rate: 10/min\n  - name: pro\n    rate: 100/s\n    burst: 200\n    algorithm: leaky-bucket\n").Plans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []plan.Plan{
+		{Name: "free", Algorithm: rate.TokenBucket, MaxCount: 10, Period: time.Minute},
+		{Name: "pro", Algorithm: rate.LeakyBucket, MaxCount: 200, Period: 2 * time.Second},
+	}
+	if !reflect.DeepEqual(plans, want) {
+		t.Fatalf("expecting %v, got %v", want, plans)
+	}
+}
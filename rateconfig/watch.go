@@ -0,0 +1,137 @@
+package rateconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+)
+
+// WatchOption configures the Watcher built by Set.Watch and Set.WatchReaders
+type WatchOption func(w *Watcher)
+
+// WithInterval sets how often the file is polled, default is 1s
+func WithInterval(d time.Duration) WatchOption {
+	return func(w *Watcher) { w.interval = d }
+}
+
+// WithReloadHook sets fn to be called after each reload which changed
+// something or was rejected, err tells why the new config was rejected.
+func WithReloadHook(fn func(ch Changes, err error)) WatchOption {
+	return func(w *Watcher) { w.hook = fn }
+}
+
+// Watcher applies the new configs to a Set until it is closed
+type Watcher struct {
+	set      *Set
+	interval time.Duration
+	hook     func(ch Changes, err error)
+
+	closeOnce sync.Once
+	exitCh    chan struct{}
+	doneCh    chan struct{}
+}
+
+func (s *Set) newWatcher(opts []WatchOption) *Watcher {
+	w := &Watcher{set: s, interval: time.Second, exitCh: make(chan struct{}), doneCh: make(chan struct{})}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Watch polls the file at path and applies it to s whenever its content
+// changes. An invalid content is rejected, the running config keeps
+// working until the file is fixed.
+//
+// The file is polled rather than watched by inotify, so it works with the
+// editors replacing the file and with the symlinks swapped by Kubernetes.
+func (s *Set) Watch(path string, opts ...WatchOption) *Watcher {
+	w := s.newWatcher(opts)
+	go func() {
+		defer close(w.doneCh)
+		var modTime time.Time
+		var size int64
+		var sum [sha256.Size]byte
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			if fi, err := os.Stat(path); err != nil {
+				logger.Debugf("rateconfig: stat %v failed: %v", path, err)
+			} else if !fi.ModTime().Equal(modTime) || fi.Size() != size {
+				modTime, size = fi.ModTime(), fi.Size()
+				if data, err := os.ReadFile(path); err != nil {
+					logger.Debugf("rateconfig: read %v failed: %v", path, err)
+				} else if h := sha256.Sum256(data); h != sum {
+					sum = h
+					w.reload(data, FormatOf(path), path)
+				}
+			}
+			select {
+			case <-w.exitCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return w
+}
+
+// WatchReaders applies the configs in format read from ch to s, until ch
+// is closed or the Watcher is closed.
+func (s *Set) WatchReaders(ch <-chan io.Reader, format Format, opts ...WatchOption) *Watcher {
+	w := s.newWatcher(opts)
+	go func() {
+		defer close(w.doneCh)
+		for {
+			select {
+			case <-w.exitCh:
+				return
+			case r, ok := <-ch:
+				if !ok {
+					return
+				}
+				var buf bytes.Buffer
+				if _, err := buf.ReadFrom(r); err != nil {
+					w.report(Changes{}, err)
+					continue
+				}
+				w.reload(buf.Bytes(), format, "")
+			}
+		}
+	}()
+	return w
+}
+
+func (w *Watcher) reload(data []byte, format Format, file string) {
+	c, err := Parse(data, format, file)
+	var ch Changes
+	if err == nil {
+		ch, err = w.set.Apply(c)
+	}
+	if err == nil && ch.Empty() {
+		return
+	}
+	w.report(ch, err)
+}
+
+func (w *Watcher) report(ch Changes, err error) {
+	if err != nil {
+		logger.Warnf("rateconfig: the new config is rejected: %v", err)
+	} else {
+		logger.Infof("rateconfig: reloaded, added %v, updated %v, replaced %v, removed %v", ch.Added, ch.Updated, ch.Replaced, ch.Removed)
+	}
+	if w.hook != nil {
+		w.hook(ch, err)
+	}
+}
+
+// Close stops watching and waits for the pending reload
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() { close(w.exitCh) })
+	<-w.doneCh
+}
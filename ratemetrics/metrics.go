@@ -0,0 +1,301 @@
+// Package ratemetrics exports the decisions of the limiters as metrics,
+// in the Prometheus text format or as an expvar.Var, without the
+// dependency of the Prometheus client.
+//
+//	m := ratemetrics.New()
+//	l := rate.New(rate.TokenBucket, 100, time.Second, rate.WithName("api"), rate.WithObserver(m))
+//	m.Track(l)
+//	http.Handle("/metrics", m.Handler())
+//
+// The series are labelled by the name and the algorithm of the limiters,
+// see rateapi.Named.
+package ratemetrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate/rateapi"
+)
+
+// DefaultBuckets are the upper bounds of the wait-time histogram, in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Option configures the Metrics built by New
+type Option func(m *Metrics)
+
+// WithBuckets sets the upper bounds of the wait-time histogram in
+// seconds, default is DefaultBuckets.
+func WithBuckets(buckets ...float64) Option {
+	return func(m *Metrics) {
+		m.buckets = append([]float64(nil), buckets...)
+		sort.Float64s(m.buckets)
+	}
+}
+
+// New make a new instance of Metrics, which is a rateapi.Observer
+func New(opts ...Option) *Metrics {
+	m := &Metrics{buckets: DefaultBuckets}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Metrics collects the decisions of the limiters it observes
+type Metrics struct {
+	buckets []float64
+	series  sync.Map // labels -> *series
+
+	rw       sync.Mutex
+	limiters []rateapi.Limiter
+	keys     []keyCounter
+}
+
+type labels struct {
+	limiter, algorithm string
+}
+
+type series struct {
+	allowed uint64
+	denied  uint64
+	waits   []uint64 // per bucket, not cumulative, the last one is +Inf
+	waitSum uint64   // float64 bits of the seconds
+}
+
+type keyCounter struct {
+	labels
+	fn func() int
+}
+
+func labelsOf(l rateapi.Limiter) labels {
+	if n, ok := l.(rateapi.Named); ok {
+		return labels{n.Name(), n.Algorithm()}
+	}
+	return labels{}
+}
+
+func (m *Metrics) seriesOf(l rateapi.Limiter) *series {
+	lbl := labelsOf(l)
+	if s, ok := m.series.Load(lbl); ok {
+		return s.(*series)
+	}
+	s, _ := m.series.LoadOrStore(lbl, &series{waits: make([]uint64, len(m.buckets)+1)})
+	return s.(*series)
+}
+
+// OnAllow implements rateapi.Observer, it counts the tokens allowed
+func (m *Metrics) OnAllow(l rateapi.Limiter, count int) {
+	atomic.AddUint64(&m.seriesOf(l).allowed, uint64(count))
+}
+
+// OnDeny implements rateapi.Observer, it counts the tokens denied
+func (m *Metrics) OnDeny(l rateapi.Limiter, count int) {
+	atomic.AddUint64(&m.seriesOf(l).denied, uint64(count))
+}
+
+// OnWait implements rateapi.Observer
+func (m *Metrics) OnWait(l rateapi.Limiter, count int, d time.Duration) {
+	s, secs := m.seriesOf(l), d.Seconds()
+	atomic.AddUint64(&s.waits[sort.SearchFloat64s(m.buckets, secs)], 1)
+	for {
+		old := atomic.LoadUint64(&s.waitSum)
+		if atomic.CompareAndSwapUint64(&s.waitSum, old, math.Float64bits(math.Float64frombits(old)+secs)) {
+			return
+		}
+	}
+}
+
+// OnClose implements rateapi.Observer, the gauges of l are no longer exported
+func (m *Metrics) OnClose(l rateapi.Limiter) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	for i, t := range m.limiters {
+		if t == l {
+			m.limiters = append(m.limiters[:i], m.limiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// OnReconfigure implements rateapi.Observer
+func (m *Metrics) OnReconfigure(l rateapi.Limiter, maxCount int64, d time.Duration) {}
+
+// Track exports the available tokens and the capacity of l as gauges.
+// The limiters tracked of the same name and algorithm, such as the ones
+// per key, are summed into one series.
+func (m *Metrics) Track(l rateapi.Limiter) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.limiters = append(m.limiters, l)
+}
+
+// TrackKeys exports the count of live keys returned by fn as a gauge,
+// such as the Len of a store.Memory shared by the keyed limiters.
+func (m *Metrics) TrackKeys(name, algorithm string, fn func() int) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.keys = append(m.keys, keyCounter{labels{name, algorithm}, fn})
+}
+
+// snapshot of a series
+type sample struct {
+	labels
+	allowed, denied uint64
+	waits           []uint64
+	waitSum         float64
+}
+
+func (m *Metrics) samples() (ss []sample) {
+	m.series.Range(func(k, v interface{}) bool {
+		s := v.(*series)
+		smp := sample{labels: k.(labels), allowed: atomic.LoadUint64(&s.allowed), denied: atomic.LoadUint64(&s.denied),
+			waitSum: math.Float64frombits(atomic.LoadUint64(&s.waitSum))}
+		for i := range s.waits {
+			smp.waits = append(smp.waits, atomic.LoadUint64(&s.waits[i]))
+		}
+		ss = append(ss, smp)
+		return true
+	})
+	sort.Slice(ss, func(i, j int) bool { return less(ss[i].labels, ss[j].labels) })
+	return
+}
+
+func less(a, b labels) bool {
+	if a.limiter != b.limiter {
+		return a.limiter < b.limiter
+	}
+	return a.algorithm < b.algorithm
+}
+
+type gauge struct {
+	labels
+	available, capacity int64
+}
+
+func (m *Metrics) gauges() (gs []gauge, keys []keyCounter) {
+	m.rw.Lock()
+	limiters := append([]rateapi.Limiter(nil), m.limiters...)
+	keys = append(keys, m.keys...)
+	m.rw.Unlock()
+	index := make(map[labels]int)
+	for _, l := range limiters {
+		lbl := labelsOf(l)
+		i, ok := index[lbl]
+		if !ok {
+			i, index[lbl] = len(gs), len(gs)
+			gs = append(gs, gauge{labels: lbl})
+		}
+		gs[i].available += l.Available()
+		gs[i].capacity += l.Capacity()
+	}
+	sort.Slice(gs, func(i, j int) bool { return less(gs[i].labels, gs[j].labels) })
+	return
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	ss := m.samples()
+	fmt.Fprint(w, "# HELP rate_tokens_total The tokens allowed and denied by the limiters.\n# TYPE rate_tokens_total counter\n")
+	for _, s := range ss {
+		fmt.Fprintf(w, "rate_tokens_total{%s,decision=\"allowed\"} %d\n", s.labels, s.allowed)
+		fmt.Fprintf(w, "rate_tokens_total{%s,decision=\"denied\"} %d\n", s.labels, s.denied)
+	}
+
+	fmt.Fprint(w, "# HELP rate_wait_seconds The time waited by TakeBlocked.\n# TYPE rate_wait_seconds histogram\n")
+	for _, s := range ss {
+		var cum uint64
+		for i, n := range s.waits {
+			cum += n
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = strconv.FormatFloat(m.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "rate_wait_seconds_bucket{%s,le=%q} %d\n", s.labels, le, cum)
+		}
+		fmt.Fprintf(w, "rate_wait_seconds_sum{%s} %s\n", s.labels, strconv.FormatFloat(s.waitSum, 'g', -1, 64))
+		fmt.Fprintf(w, "rate_wait_seconds_count{%s} %d\n", s.labels, cum)
+	}
+
+	gs, keys := m.gauges()
+	fmt.Fprint(w, "# HELP rate_available_tokens The remains of the limiters, summed per label set.\n# TYPE rate_available_tokens gauge\n")
+	for _, g := range gs {
+		fmt.Fprintf(w, "rate_available_tokens{%s} %d\n", g.labels, g.available)
+	}
+	fmt.Fprint(w, "# HELP rate_capacity_tokens The capacity of the limiters, summed per label set.\n# TYPE rate_capacity_tokens gauge\n")
+	for _, g := range gs {
+		fmt.Fprintf(w, "rate_capacity_tokens{%s} %d\n", g.labels, g.capacity)
+	}
+	fmt.Fprint(w, "# HELP rate_live_keys The count of keys which have a state.\n# TYPE rate_live_keys gauge\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "rate_live_keys{%s} %d\n", k.labels, k.fn())
+	}
+}
+
+func (l labels) String() string {
+	return fmt.Sprintf("limiter=\"%s\",algorithm=\"%s\"", escape(l.limiter), escape(l.algorithm))
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string { return escaper.Replace(s) }
+
+// Expvar returns the metrics as an expvar.Var, for the people avoiding
+// Prometheus:
+//
+//	expvar.Publish("rate", m.Expvar())
+//
+// It is a JSON object keyed by the limiter names, then by the algorithms,
+// since the limiters of a name may be of several algorithms.
+func (m *Metrics) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		out := make(map[string]map[string]map[string]interface{})
+		entry := func(l labels) map[string]interface{} {
+			byAlg, ok := out[l.limiter]
+			if !ok {
+				byAlg = make(map[string]map[string]interface{})
+				out[l.limiter] = byAlg
+			}
+			e, ok := byAlg[l.algorithm]
+			if !ok {
+				e = make(map[string]interface{})
+				byAlg[l.algorithm] = e
+			}
+			return e
+		}
+		for _, s := range m.samples() {
+			e := entry(s.labels)
+			var waits uint64
+			for _, n := range s.waits {
+				waits += n
+			}
+			e["allowed"], e["denied"], e["wait_count"], e["wait_seconds"] = s.allowed, s.denied, waits, s.waitSum
+		}
+		gs, keys := m.gauges()
+		for _, g := range gs {
+			e := entry(g.labels)
+			e["available"], e["capacity"] = g.available, g.capacity
+		}
+		for _, k := range keys {
+			entry(k.labels)["live_keys"] = k.fn()
+		}
+		return out
+	})
+}
@@ -0,0 +1,94 @@
+package ratemetrics_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/ratemetrics"
+	"github.com/hedzr/rate/store"
+)
+
+func TestPrometheus(t *testing.T) {
+	m := ratemetrics.New(ratemetrics.WithBuckets(0.001, 1))
+	l := rate.New(rate.TokenBucket, 2, time.Minute, rate.WithName("api"), rate.WithObserver(m))
+	defer l.Close()
+	m.Track(l)
+	keys := store.NewMemory()
+	_, _ = keys.Update("a", func(st store.State, exists bool) store.State { return st })
+	m.TrackKeys("api", string(rate.TokenBucket), keys.Len)
+
+	l.Take(1)
+	l.TakeBlocked(1)
+	l.Take(2)
+	// the limiters of the keys share the labels, their gauges are summed
+	other := rate.New(rate.TokenBucket, 2, time.Minute, rate.WithName("api"), rate.WithObserver(m))
+	defer other.Close()
+	m.Track(other)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`# TYPE rate_tokens_total counter`,
+		`rate_tokens_total{limiter="api",algorithm="token-bucket",decision="allowed"} 2`,
+		`rate_tokens_total{limiter="api",algorithm="token-bucket",decision="denied"} 2`,
+		`rate_wait_seconds_bucket{limiter="api",algorithm="token-bucket",le="0.001"} 1`,
+		`rate_wait_seconds_bucket{limiter="api",algorithm="token-bucket",le="+Inf"} 1`,
+		`rate_wait_seconds_count{limiter="api",algorithm="token-bucket"} 1`,
+		`rate_available_tokens{limiter="api",algorithm="token-bucket"} 2`,
+		`rate_capacity_tokens{limiter="api",algorithm="token-bucket"} 4`,
+		`rate_live_keys{limiter="api",algorithm="token-bucket"} 1`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if n := strings.Count(string(body), "rate_available_tokens{"); n != 1 {
+		t.Errorf("expecting one series of the available tokens, got %v", n)
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	m := ratemetrics.New()
+	l := rate.New(rate.TokenBucket, 10, time.Second, rate.WithName(`a "quoted" name`), rate.WithObserver(m))
+	defer l.Close()
+	l.Take(1)
+	// the same name of another algorithm is another entry
+	other := rate.New(rate.Counter, 10, time.Second, rate.WithName(`a "quoted" name`), rate.WithObserver(m))
+	defer other.Close()
+	other.Take(3)
+
+	var v expvar.Var = m.Expvar()
+	var out map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(v.String()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if e := out[`a "quoted" name`]["token-bucket"]; e == nil || e["allowed"] != 1.0 {
+		t.Fatalf("unexpected expvar %v", v)
+	}
+	if e := out[`a "quoted" name`]["counter"]; e == nil || e["allowed"] != 3.0 {
+		t.Fatalf("unexpected expvar %v", v)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `limiter="a \"quoted\" name"`) {
+		t.Fatalf("the label values should be escaped:\n%s", rec.Body)
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	l := rate.New(rate.Counter, 10, time.Second, rate.WithObserver(ratemetrics.New()))
+	if rate.Unwrap(l) == l {
+		t.Fatal("the observed limiter should be a decorator")
+	}
+	if bare := rate.New(rate.Counter, 10, time.Second); rate.Unwrap(bare) != bare {
+		t.Fatal("a limiter without options should not be decorated")
+	}
+}
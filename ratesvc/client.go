@@ -0,0 +1,139 @@
+package ratesvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+)
+
+// ClientOption configures the Client built by NewClient
+type ClientOption func(c *Client)
+
+// WithHTTPClient sets the http.Client used to reach the service, default
+// is a client with 1s timeout.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) { c.hc = hc }
+}
+
+// WithFailOpen sets whether the requests are allowed while the service is
+// unreachable, default is true.
+func WithFailOpen(b bool) ClientOption {
+	return func(c *Client) { c.failOpen = b }
+}
+
+// NewClient returns a rateapi.Limiter for key of the limiter named
+// limiter, which is hosted by the service at baseURL, such as
+// "http://ratelimitd:8080".
+func NewClient(baseURL, limiter, key string, opts ...ClientOption) *Client {
+	c := &Client{
+		enabled:  true,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		limiter:  limiter,
+		key:      key,
+		hc:       &http.Client{Timeout: time.Second},
+		failOpen: true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Client is a rateapi.Limiter talking to the service
+type Client struct {
+	enabled  bool
+	baseURL  string
+	limiter  string
+	key      string
+	hc       *http.Client
+	failOpen bool
+	capacity int64 // cached from the last decision
+}
+
+func (c *Client) Enabled() bool     { return c.enabled }
+func (c *Client) SetEnabled(b bool) { c.enabled = b }
+func (c *Client) Close()            { c.hc.CloseIdleConnections() }
+
+// Decide asks the service with path "take", "reserve" or "status"
+func (c *Client) Decide(ctx context.Context, path string, count int, maxWait time.Duration) (d Decision, err error) {
+	body, err := json.Marshal(Request{Limiter: c.limiter, Key: c.key, Count: count, MaxWait: Duration(maxWait)})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return d, fmt.Errorf("ratesvc: %s: %s", resp.Status, e.Error)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&d); err == nil {
+		atomic.StoreInt64(&c.capacity, d.Limit)
+	}
+	return
+}
+
+func (c *Client) decide(path string, count int) (d Decision, ok bool) {
+	d, err := c.Decide(context.Background(), path, count, 0)
+	if err != nil {
+		logger.Warnf("ratesvc: %s %s/%s failed: %v", path, c.limiter, c.key, err)
+		return d, false
+	}
+	return d, true
+}
+
+func (c *Client) Take(count int) bool {
+	d, ok := c.decide("take", count)
+	if !ok {
+		return c.failOpen
+	}
+	return d.Allowed
+}
+
+func (c *Client) TakeBlocked(count int) (requestAt time.Time) {
+	requestAt = time.Now().UTC()
+	for {
+		d, ok := c.decide("take", count)
+		if !ok {
+			if c.failOpen {
+				return
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if d.Allowed {
+			return
+		}
+		time.Sleep(d.RetryAfter + time.Millisecond)
+	}
+}
+
+func (c *Client) Available() int64 {
+	d, _ := c.decide("status", 0)
+	return d.Remaining
+}
+
+func (c *Client) Capacity() int64 {
+	if n := atomic.LoadInt64(&c.capacity); n > 0 {
+		return n
+	}
+	d, _ := c.decide("status", 0)
+	return d.Limit
+}
@@ -0,0 +1,99 @@
+package ratesvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewHandler exposes the service as an HTTP/JSON API:
+//
+//	POST /v1/take     {"limiter": "api", "key": "tenant-1", "count": 1}
+//	POST /v1/reserve  {"limiter": "api", "key": "tenant-1", "count": 1, "max-wait": "500ms"}
+//	POST /v1/status   {"limiter": "api", "key": "tenant-1"}
+//	GET  /v1/status?limiter=api&key=tenant-1
+//	GET  /v1/limiters
+//
+// The decisions are answered with status 200 whether allowed or not:
+//
+//	{"allowed": false, "limit": 100, "remaining": 0, "reset_ms": 1000, "retry_after_ms": 10}
+//
+// and the headers 'X-RateLimit-Limit', 'X-RateLimit-Remaining',
+// 'X-RateLimit-Reset' (in seconds) and 'Retry-After' (in seconds, denied
+// only). An unknown limiter is answered with 404, an invalid request with 400.
+func NewHandler(svc *Service) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/take", func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, func(req Request) (Decision, error) { return svc.Take(req) })
+	})
+	mux.HandleFunc("/v1/reserve", func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, func(req Request) (Decision, error) { return svc.Reserve(r.Context(), req) })
+	})
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			count, _ := strconv.Atoi(q.Get("count"))
+			d, err := svc.Status(Request{Limiter: q.Get("limiter"), Key: q.Get("key"), Count: count})
+			reply(w, d, err)
+			return
+		}
+		serve(w, r, svc.Status)
+	})
+	mux.HandleFunc("/v1/limiters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Config{Limiters: svc.Definitions()})
+	})
+	return mux
+}
+
+func serve(w http.ResponseWriter, r *http.Request, decide func(req Request) (Decision, error)) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		replyError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrBadRequest, err))
+		return
+	}
+	d, err := decide(req)
+	reply(w, d, err)
+}
+
+func reply(w http.ResponseWriter, d Decision, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownLimiter):
+		replyError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, ErrBadRequest):
+		replyError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		replyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(d.Reset), 10))
+	if !d.Allowed && d.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(d.RetryAfter), 10))
+	}
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+func replyError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
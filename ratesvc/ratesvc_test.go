@@ -0,0 +1,174 @@
+package ratesvc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/ratesvc"
+	"github.com/hedzr/rate/store"
+)
+
+const config = `{
+  "limiters": [
+    { "name": "api", "interval": "1s", "max-requests": 10 },
+    { "name": "login", "algorithm": "counter", "interval": "1m", "max-requests": 3 }
+  ]
+}`
+
+func newService(t *testing.T) *ratesvc.Service {
+	defs, err := ratesvc.LoadConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := ratesvc.NewService(defs, store.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestServiceTake(t *testing.T) {
+	svc := newService(t)
+	for i := 0; i < 3; i++ {
+		if d, err := svc.Take(ratesvc.Request{Limiter: "login", Key: "u1"}); err != nil || !d.Allowed || d.Remaining != int64(2-i) {
+			t.Fatalf("take #%d: %+v, %v", i, d, err)
+		}
+	}
+	d, err := svc.Take(ratesvc.Request{Limiter: "login", Key: "u1"})
+	if err != nil || d.Allowed || d.RetryAfter <= 0 || d.Reset <= 0 || d.Limit != 3 {
+		t.Fatalf("the 4th take should be denied with a retry-after: %+v, %v", d, err)
+	}
+	if d, _ = svc.Take(ratesvc.Request{Limiter: "login", Key: "u2"}); !d.Allowed {
+		t.Fatal("the keys should be independent")
+	}
+	if _, err = svc.Take(ratesvc.Request{Limiter: "nope", Key: "u1"}); !errors.Is(err, ratesvc.ErrUnknownLimiter) {
+		t.Fatalf("expecting ErrUnknownLimiter, got %v", err)
+	}
+	if _, err = svc.Take(ratesvc.Request{Limiter: "login"}); !errors.Is(err, ratesvc.ErrBadRequest) {
+		t.Fatalf("expecting ErrBadRequest, got %v", err)
+	}
+}
+
+func TestServiceReserve(t *testing.T) {
+	svc := newService(t)
+	req := ratesvc.Request{Limiter: "api", Key: "k", Count: 10}
+	if d, _ := svc.Take(req); !d.Allowed {
+		t.Fatal("the bucket should be full at first")
+	}
+	req.Count = 1
+	if d, _ := svc.Reserve(context.Background(), req); d.Allowed {
+		t.Fatal("reserve without max-wait should not wait")
+	}
+	req.MaxWait = ratesvc.Duration(time.Second)
+	start := time.Now()
+	if d, err := svc.Reserve(context.Background(), req); err != nil || !d.Allowed {
+		t.Fatalf("reserve should wait for a refill: %+v, %v", d, err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("reserve returned before the refill")
+	}
+
+	defer func(d time.Duration) { ratesvc.MaxReserveWait = d }(ratesvc.MaxReserveWait)
+	ratesvc.MaxReserveWait = 10 * time.Millisecond
+	req.MaxWait = ratesvc.Duration(time.Hour)
+	if d, _ := svc.Reserve(context.Background(), req); d.Allowed {
+		t.Fatal("the max-wait should be capped")
+	}
+}
+
+func TestServiceBadConfig(t *testing.T) {
+	for _, c := range []string{
+		`{"limiters": [{"name": "a", "interval": "1s", "max-requests": 0}]}`,
+		`{"limiters": [{"name": "a", "algorithm": "nope", "interval": "1s", "max-requests": 1}]}`,
+		`{"limiters": [{"name": "a", "interval": "1s", "max-requests": 1}, {"name": "a", "interval": "1s", "max-requests": 1}]}`,
+		`{"limiters": [{"name": "a", "interval": "10ns", "max-requests": 100}]}`,
+		`{"limiters": [{"name": "a", "algorithm": "counter", "interval": "10ns", "max-requests": 100}]}`,
+	} {
+		defs, err := ratesvc.LoadConfig(strings.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ratesvc.NewService(defs, store.NewMemory()); err == nil {
+			t.Fatalf("expecting an error for %s", c)
+		}
+	}
+	if _, err := ratesvc.LoadConfig(strings.NewReader(`{"limiters": [{"name": "a", "period": "1s"}]}`)); err == nil {
+		t.Fatal("the unknown fields should be rejected")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(ratesvc.NewHandler(newService(t)))
+	defer srv.Close()
+
+	for i, want := range []int{200, 200, 200, 200} {
+		resp, err := http.Post(srv.URL+"/v1/take", "application/json", strings.NewReader(`{"limiter":"login","key":"u1"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want || resp.Header.Get("X-RateLimit-Limit") != "3" {
+			t.Fatalf("take #%d: %v %v", i, resp.Status, resp.Header)
+		}
+		if i == 3 && resp.Header.Get("Retry-After") == "" {
+			t.Fatal("a denied take should have Retry-After")
+		}
+	}
+
+	for body, want := range map[string]int{
+		`{"limiter":"nope","key":"u1"}`: http.StatusNotFound,
+		`{"limiter":"login"}`:           http.StatusBadRequest,
+		`not json`:                      http.StatusBadRequest,
+	} {
+		resp, err := http.Post(srv.URL+"/v1/take", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s: expecting %v, got %v", body, want, resp.Status)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/status?limiter=login&key=u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("status: %v %v", resp.Status, resp.Header)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(ratesvc.NewHandler(newService(t)))
+	defer srv.Close()
+
+	var l rateapi.Limiter = ratesvc.NewClient(srv.URL, "login", "u1")
+	defer l.Close()
+	if l.Capacity() != 3 || l.Available() != 3 {
+		t.Fatalf("expecting capacity 3 and available 3, got %v, %v", l.Capacity(), l.Available())
+	}
+	for i := 0; i < 3; i++ {
+		if !l.Take(1) {
+			t.Fatalf("take #%d should be allowed", i)
+		}
+	}
+	if l.Take(1) || l.Available() != 0 {
+		t.Fatal("the 4th take should be denied")
+	}
+
+	c := ratesvc.NewClient(srv.URL, "nope", "u1", ratesvc.WithFailOpen(false))
+	if c.Take(1) {
+		t.Fatal("a failed request should be denied with WithFailOpen(false)")
+	}
+	if !ratesvc.NewClient("http://127.0.0.1:1", "login", "u1").Take(1) {
+		t.Fatal("the client should fail open by default")
+	}
+}
@@ -0,0 +1,275 @@
+// Package ratesvc implements a rate-limit decision service.
+//
+// A Service hosts the named limiters and answers allow/deny, remaining,
+// reset and retry-after for the (limiter, key) pairs. NewHandler exposes
+// it as an HTTP/JSON API, and Client is a rateapi.Limiter talking to that
+// API, so that the remote and local limiters are interchangeable.
+package ratesvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/store"
+)
+
+// Definition describes a named limiter
+type Definition struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Algorithm   string   `json:"algorithm,omitempty"` // default is token-bucket
+	Interval    Duration `json:"interval"`
+	MaxRequests int64    `json:"max-requests"`
+}
+
+// Config is the content of a config file of the service
+type Config struct {
+	Limiters []Definition `json:"limiters"`
+}
+
+// LoadConfig reads the definitions from a JSON document like:
+//
+//	{
+//	  "limiters": [
+//	    { "name": "api", "algorithm": "token-bucket", "interval": "1s", "max-requests": 100 },
+//	    { "name": "login", "algorithm": "counter", "interval": "1m", "max-requests": 5 }
+//	  ]
+//	}
+func LoadConfig(r io.Reader) ([]Definition, error) {
+	var c Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return c.Limiters, nil
+}
+
+// Duration is a time.Duration which is "1m30s" in JSON, a number of
+// nanoseconds is accepted too.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case float64:
+		*d = Duration(x)
+	case string:
+		dd, err := time.ParseDuration(x)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dd)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// Request asks a decision for Count of Key from the limiter named Limiter
+type Request struct {
+	Limiter string `json:"limiter"`
+	Key     string `json:"key"`
+	Count   int    `json:"count,omitempty"` // default is 1
+	// MaxWait is how long Reserve may wait for the tokens, default is 0,
+	// capped to MaxReserveWait
+	MaxWait Duration `json:"max-wait,omitempty"`
+}
+
+// Decision is the answer of the service
+type Decision struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// Reset is how long the key takes to recover to the full capacity
+	Reset time.Duration
+	// RetryAfter is how long a denied caller should wait before retrying
+	RetryAfter time.Duration
+}
+
+type decisionJSON struct {
+	Allowed      bool  `json:"allowed"`
+	Limit        int64 `json:"limit"`
+	Remaining    int64 `json:"remaining"`
+	ResetMs      int64 `json:"reset_ms"`
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// MarshalJSON implements json.Marshaler, the durations are in milliseconds
+func (d Decision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(decisionJSON{d.Allowed, d.Limit, d.Remaining, ceilMs(d.Reset), ceilMs(d.RetryAfter)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Decision) UnmarshalJSON(b []byte) error {
+	var v decisionJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*d = Decision{v.Allowed, v.Limit, v.Remaining, time.Duration(v.ResetMs) * time.Millisecond, time.Duration(v.RetryAfterMs) * time.Millisecond}
+	return nil
+}
+
+func ceilMs(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// MaxReserveWait caps the MaxWait of the requests to Reserve, so that a
+// client cannot hold a request of the service for long
+var MaxReserveWait = time.Minute
+
+var (
+	// ErrUnknownLimiter is returned for a request to a limiter not defined
+	ErrUnknownLimiter = errors.New("ratesvc: unknown limiter")
+	// ErrBadRequest is returned for a request with invalid fields
+	ErrBadRequest = errors.New("ratesvc: bad request")
+)
+
+// Service hosts the named limiters
+type Service struct {
+	store    store.Store
+	limiters map[string]*hosted
+}
+
+type hosted struct {
+	Definition
+	alg store.Algorithm
+}
+
+// NewService make a new instance of the service with the definitions, the
+// states of all keys live in s.
+func NewService(defs []Definition, s store.Store) (*Service, error) {
+	svc := &Service{store: s, limiters: make(map[string]*hosted)}
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, errors.New("ratesvc: a limiter must have a name")
+		}
+		if _, ok := svc.limiters[def.Name]; ok {
+			return nil, fmt.Errorf("ratesvc: limiter %q defined twice", def.Name)
+		}
+		if def.Algorithm == "" {
+			def.Algorithm = string(rate.TokenBucket)
+		}
+		if def.MaxRequests < 1 || def.Interval <= 0 {
+			return nil, fmt.Errorf("ratesvc: limiter %q needs positive interval and max-requests", def.Name)
+		}
+		if time.Duration(def.Interval)/time.Duration(def.MaxRequests) < time.Microsecond {
+			return nil, fmt.Errorf("ratesvc: limiter %q: the rate cannot be more than a request per microsecond", def.Name)
+		}
+		alg := rate.NewAlgorithm(rate.Algorithm(def.Algorithm), def.MaxRequests, time.Duration(def.Interval))
+		if alg == nil {
+			return nil, fmt.Errorf("ratesvc: limiter %q: algorithm %q cannot be hosted", def.Name, def.Algorithm)
+		}
+		svc.limiters[def.Name] = &hosted{def, alg}
+	}
+	return svc, nil
+}
+
+// Definitions returns the definitions of the limiters sorted by name
+func (s *Service) Definitions() []Definition {
+	defs := make([]Definition, 0, len(s.limiters))
+	for _, h := range s.limiters {
+		defs = append(defs, h.Definition)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+func (s *Service) lookup(req *Request) (*hosted, error) {
+	if req.Key == "" || req.Count < 0 {
+		return nil, ErrBadRequest
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	h, ok := s.limiters[req.Limiter]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownLimiter, req.Limiter)
+	}
+	return h, nil
+}
+
+func (h *hosted) decision(st store.State, exists, allowed bool, wait time.Duration, now int64) Decision {
+	d := Decision{Allowed: allowed, Limit: h.alg.Capacity(), Remaining: h.alg.Available(st, exists, now)}
+	if r, ok := h.alg.(store.Resetter); ok {
+		d.Reset = r.Reset(st, exists, now)
+	}
+	if !allowed {
+		d.RetryAfter = wait
+	}
+	return d
+}
+
+func storeKey(limiter, key string) string { return limiter + "/" + key }
+
+// Take assigns req.Count of allows without blocking
+func (s *Service) Take(req Request) (d Decision, err error) {
+	h, err := s.lookup(&req)
+	if err != nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	var ok bool
+	var wait time.Duration
+	st, err := s.store.Update(storeKey(req.Limiter, req.Key), func(st store.State, exists bool) (next store.State) {
+		next, ok, wait = h.alg.Decide(st, exists, now, req.Count)
+		return
+	})
+	if err != nil {
+		return
+	}
+	return h.decision(st, true, ok, wait, now), nil
+}
+
+// Reserve assigns req.Count of allows, it waits for them at most
+// req.MaxWait capped to MaxReserveWait, or until ctx is done.
+func (s *Service) Reserve(ctx context.Context, req Request) (d Decision, err error) {
+	maxWait := time.Duration(req.MaxWait)
+	if maxWait > MaxReserveWait {
+		maxWait = MaxReserveWait
+	}
+	deadline := time.Now().Add(maxWait)
+	for {
+		if d, err = s.Take(req); err != nil || d.Allowed {
+			return
+		}
+		if time.Now().Add(d.RetryAfter).After(deadline) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return d, ctx.Err()
+		case <-time.After(d.RetryAfter):
+		}
+	}
+}
+
+// Status returns the state of req.Key without taking
+func (s *Service) Status(req Request) (d Decision, err error) {
+	h, err := s.lookup(&req)
+	if err != nil {
+		return
+	}
+	st, exists, err := s.store.Load(storeKey(req.Limiter, req.Key))
+	if err != nil {
+		return
+	}
+	d = h.decision(st, exists, true, 0, time.Now().UnixNano())
+	d.Allowed = d.Remaining >= int64(req.Count)
+	return
+}
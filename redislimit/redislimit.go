@@ -0,0 +1,225 @@
+// Package redislimit implements rateapi.Limiter on top of the atomic lua
+// scripts in a redis-compatible store, so that the replicas of a service
+// share one budget per key.
+//
+// It is a standalone module to keep the dependencies of hedzr/rate away.
+package redislimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+// Algorithm represents the script used to decide
+type Algorithm string
+
+const (
+	// TokenBucket refills the bucket lazily from the elapsed time
+	TokenBucket Algorithm = "token-bucket"
+	// GCRA is the generic cell rate algorithm, which stores one timestamp per key
+	GCRA Algorithm = "gcra"
+	// SlidingWindow keeps a log of requests, it's exact but costs memory
+	// in proportion to maxCount
+	SlidingWindow Algorithm = "sliding-window"
+)
+
+var scripts = map[Algorithm]*redis.Script{
+	TokenBucket:   tokenBucketScript,
+	GCRA:          gcraScript,
+	SlidingWindow: slidingWindowScript,
+}
+
+// Option configures the limiter built by New
+type Option func(s *limiter)
+
+// WithPrefix sets the prefix of the redis keys, default is "rate:"
+func WithPrefix(prefix string) Option {
+	return func(s *limiter) { s.prefix = prefix }
+}
+
+// WithFallback sets the local limiter used while the store is
+// unreachable. By default, it's a token bucket with the same maxCount
+// and period built by rate.New.
+func WithFallback(l rateapi.Limiter) Option {
+	return func(s *limiter) { s.fallback = l }
+}
+
+// WithTimeout sets the timeout of each round-trip to the store, default is 100ms
+func WithTimeout(d time.Duration) Option {
+	return func(s *limiter) { s.timeout = d }
+}
+
+// WithRetryInterval sets how long the limiter stays on the fallback after
+// the store failed, before it tries the store again. Default is 1s.
+func WithRetryInterval(d time.Duration) Option {
+	return func(s *limiter) { s.retryInterval = d }
+}
+
+// New make a new instance of limiter which allows maxCount requests per d
+// for key, the state lives in the store behind client.
+//
+// client can be a *redis.Client, *redis.ClusterClient, *redis.Ring or
+// anything else implementing redis.Scripter.
+func New(client redis.Scripter, key string, algorithm Algorithm, maxCount int64, d time.Duration, opts ...Option) rateapi.Limiter {
+	script, ok := scripts[algorithm]
+	if !ok {
+		logger.Errorf("redislimit: unknown algorithm %q", algorithm)
+		return nil
+	}
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return nil
+	}
+	if int64(d)/maxCount < 1000 {
+		logger.Errorf("the rate cannot be less than 1000us, it's %v", int64(d)/maxCount)
+		return nil
+	}
+
+	s := &limiter{
+		enabled:       true,
+		client:        client,
+		script:        script,
+		algorithm:     algorithm,
+		key:           key,
+		prefix:        "rate:",
+		maxCount:      maxCount,
+		interval:      d / time.Duration(maxCount),
+		period:        d,
+		timeout:       100 * time.Millisecond,
+		retryInterval: time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.fallback == nil {
+		s.fallback = rate.New(rate.TokenBucket, maxCount, d)
+	}
+	return s
+}
+
+type limiter struct {
+	enabled       bool
+	client        redis.Scripter
+	script        *redis.Script
+	algorithm     Algorithm
+	key           string
+	prefix        string
+	maxCount      int64
+	interval      time.Duration
+	period        time.Duration
+	timeout       time.Duration
+	retryInterval time.Duration
+	fallback      rateapi.Limiter
+
+	seq       uint64
+	rw        sync.Mutex
+	downUntil time.Time
+}
+
+// result of a script run
+type result struct {
+	allowed   bool
+	remaining int64
+	wait      time.Duration
+}
+
+func (s *limiter) Enabled() bool     { return s.enabled }
+func (s *limiter) SetEnabled(b bool) { s.enabled = b }
+func (s *limiter) Capacity() int64   { return s.maxCount }
+
+func (s *limiter) Close() {
+	s.fallback.Close()
+}
+
+// Key returns the redis key of the state
+func (s *limiter) Key() string { return s.prefix + string(s.algorithm) + ":" + s.key }
+
+// Degraded tells if the limiter is working on the fallback
+func (s *limiter) Degraded() bool {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return time.Now().Before(s.downUntil)
+}
+
+func (s *limiter) args(count int) []interface{} {
+	switch s.algorithm {
+	case SlidingWindow:
+		id := fmt.Sprintf("%d-%d", atomic.AddUint64(&s.seq, 1), rand.Int63()) //nolint:gosec //not a secret
+		return []interface{}{s.maxCount, s.period.Microseconds(), count, id}
+	default:
+		return []interface{}{s.maxCount, s.interval.Microseconds(), count}
+	}
+}
+
+func (s *limiter) run(count int) (r result, err error) {
+	if s.Degraded() {
+		return r, errDegraded
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var v []int64
+	if v, err = s.script.Run(ctx, s.client, []string{s.Key()}, s.args(count)...).Int64Slice(); err == nil && len(v) != 3 {
+		err = fmt.Errorf("redislimit: unexpected reply %v", v)
+	}
+	if err != nil {
+		logger.Warnf("redislimit: the store is unreachable, fall back to the local limiter for %v: %v", s.retryInterval, err)
+		s.rw.Lock()
+		s.downUntil = time.Now().Add(s.retryInterval)
+		s.rw.Unlock()
+		return
+	}
+
+	r.allowed, r.remaining, r.wait = v[0] == 1, v[1], time.Duration(v[2])*time.Microsecond
+	return
+}
+
+func (s *limiter) Take(count int) bool {
+	r, err := s.run(count)
+	if err != nil {
+		return s.fallback.Take(count)
+	}
+	return r.allowed
+}
+
+// TakeBlocked waits until count is allowed, it returns the zero time at
+// once if count exceeds maxCount, which would never be allowed.
+func (s *limiter) TakeBlocked(count int) (requestAt time.Time) {
+	if int64(count) > s.maxCount {
+		logger.Errorf("redislimit: taking %v exceeds the maxCount %v", count, s.maxCount)
+		return time.Time{}
+	}
+	requestAt = time.Now().UTC()
+	for {
+		r, err := s.run(count)
+		if err != nil {
+			s.fallback.TakeBlocked(count)
+			return
+		}
+		if r.allowed {
+			return
+		}
+		time.Sleep(r.wait + time.Millisecond)
+	}
+}
+
+func (s *limiter) Available() int64 {
+	r, err := s.run(0)
+	if err != nil {
+		return s.fallback.Available()
+	}
+	return r.remaining
+}
+
+var errDegraded = errors.New("redislimit: degraded")
@@ -0,0 +1,96 @@
+package redislimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/hedzr/rate/redislimit"
+)
+
+func newClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { _ = client.Close() })
+	return mr, client
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, alg := range []redislimit.Algorithm{redislimit.TokenBucket, redislimit.GCRA, redislimit.SlidingWindow} {
+		t.Run(string(alg), func(t *testing.T) {
+			mr, client := newClient(t)
+			// two replicas share the budget of one key
+			l1 := redislimit.New(client, "tenant-1", alg, 10, time.Second)
+			l2 := redislimit.New(client, "tenant-1", alg, 10, time.Second)
+			defer l1.Close()
+			defer l2.Close()
+
+			var allowed int
+			for i := 0; i < 10; i++ {
+				if l1.Take(1) {
+					allowed++
+				}
+				if l2.Take(1) {
+					allowed++
+				}
+			}
+			if allowed != 10 {
+				t.Fatalf("expecting 10 allowed across the replicas, got %v", allowed)
+			}
+			if l1.Available() != 0 || l1.Capacity() != 10 {
+				t.Fatalf("available: %v, capacity: %v", l1.Available(), l1.Capacity())
+			}
+
+			mr.SetTime(time.Date(2021, 6, 1, 0, 0, 1, 0, time.UTC))
+			if !l2.Take(5) {
+				t.Fatal("the budget should be refilled after the period")
+			}
+
+			other := redislimit.New(client, "tenant-2", alg, 10, time.Second)
+			defer other.Close()
+			if !other.Take(1) {
+				t.Fatal("the keys should not share the budget")
+			}
+			if at := other.TakeBlocked(11); !at.IsZero() {
+				t.Fatalf("11 would never be allowed, got %v", at)
+			}
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	mr, client := newClient(t)
+	l := redislimit.New(client, "k", redislimit.GCRA, 3, time.Hour,
+		redislimit.WithTimeout(50*time.Millisecond), redislimit.WithRetryInterval(time.Hour))
+	defer l.Close()
+	if !l.Take(1) {
+		t.Fatal("expecting allowed")
+	}
+
+	mr.Close()
+	if !l.Take(1) {
+		t.Fatal("the local fallback should allow while the store is down")
+	}
+	if !l.(interface{ Degraded() bool }).Degraded() {
+		t.Fatal("expecting degraded")
+	}
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if l.Take(1) {
+			allowed++
+		}
+	}
+	if allowed >= 10 {
+		t.Fatal("the fallback should still limit")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, client := newClient(t)
+	if l := redislimit.New(client, "k", "unknown", 10, time.Second); l != nil {
+		t.Fatal("expecting nil for unknown algorithm")
+	}
+}
@@ -0,0 +1,125 @@
+package redislimit
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// All of the scripts take the time from the redis server, so the replicas
+// of a service agree on the clock. The times are in microseconds, which
+// are exact in the doubles of lua.
+//
+// Each script returns {allowed, remaining, wait-in-microseconds}. A
+// count of 0 peeks the state without taking.
+
+// tokenBucketScript refills the bucket lazily from the elapsed time.
+//
+// KEYS[1]: the bucket; ARGV: capacity, microseconds per token, count
+var tokenBucketScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local count = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens, ts = capacity, now
+end
+
+local delta = math.floor((now - ts) / interval)
+if delta > 0 then
+	tokens = math.min(capacity, tokens + delta)
+	ts = ts + delta * interval
+end
+if tokens >= capacity then
+	ts = now
+end
+
+local allowed, wait = 0, 0
+if tokens >= count then
+	tokens = tokens - count
+	allowed = 1
+else
+	wait = (count - tokens) * interval - (now - ts)
+end
+
+if count > 0 then
+	redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', ts)
+	redis.call('PEXPIRE', KEYS[1], math.ceil(capacity * interval / 1000) + 1000)
+end
+return {allowed, tokens, wait}
+`)
+
+// gcraScript implements the generic cell rate algorithm, it stores the
+// theoretical arrival time only.
+//
+// KEYS[1]: the tat; ARGV: burst, microseconds per request, count
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local count = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local tolerance = burst * interval
+local newTat = tat + count * interval
+local allowAt = newTat - tolerance
+
+local allowed, wait = 0, 0
+if allowAt <= now then
+	allowed = 1
+	if count > 0 then
+		tat = newTat
+		redis.call('SET', KEYS[1], tat, 'PX', math.ceil((tat - now) / 1000) + 1)
+	end
+else
+	wait = allowAt - now
+end
+
+local remaining = math.floor((now - (tat - tolerance)) / interval)
+if remaining < 0 then
+	remaining = 0
+end
+return {allowed, remaining, wait}
+`)
+
+// slidingWindowScript keeps a log of the requests in the last window.
+//
+// KEYS[1]: the log; ARGV: limit, window in microseconds, count, unique id
+var slidingWindowScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local count = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+
+local allowed, wait = 0, 0
+if n + count <= limit then
+	allowed = 1
+	for i = 1, count do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+	end
+	n = n + count
+	if count > 0 then
+		redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000) + 1)
+	end
+else
+	local oldest = redis.call('ZRANGE', KEYS[1], n + count - limit - 1, n + count - limit - 1, 'WITHSCORES')
+	if oldest[2] then
+		wait = tonumber(oldest[2]) + window - now
+	else
+		wait = window -- count exceeds the limit, never allowed
+	end
+end
+return {allowed, limit - n, wait}
+`)
@@ -0,0 +1,173 @@
+// Package route matches the requests against the route patterns, to
+// scope the limiters to some paths and methods.
+//
+// A pattern is an optional method and a path, such as "POST /v1/upload",
+// "GET /v1/users/:id" or "/v1/*". A segment ":name" or "{name}" matches
+// any one segment, a trailing "*" matches the rest of the path, even if
+// empty.
+//
+// The most specific pattern wins: the segments are compared from left to
+// right, a static one is more specific than a parameter, which is more
+// specific than the wildcard. On the same path, a pattern with the method
+// wins over the one without, then the higher priority, then the one added
+// first.
+//
+//	m := route.New()
+//	_ = m.Add(route.Route{Pattern: "GET /v1/*", Value: readLimiter})
+//	_ = m.Add(route.Route{Pattern: "POST /v1/upload", Value: uploadLimiter})
+//	if rt, ok := m.Match(r.Method, r.URL.Path); ok { ... rt.Value ... }
+package route
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Route binds a value to a pattern
+type Route struct {
+	Pattern string
+	// Priority breaks the tie between the patterns of the same path, the
+	// higher one wins.
+	Priority int
+	Value    interface{}
+}
+
+// Matcher is a compiled set of routes. It is not safe to Add while
+// matching, build a new one instead.
+type Matcher struct {
+	root  node
+	count int
+}
+
+type node struct {
+	static   map[string]*node
+	param    *node
+	entries  []*entry // the patterns ending here
+	wildcard []*entry // the patterns ending here with "*"
+}
+
+type entry struct {
+	method string // empty for any method
+	order  int
+	route  Route
+}
+
+// New returns an empty Matcher
+func New() *Matcher { return &Matcher{} }
+
+// Split splits a pattern into the method, empty for any, and the path
+func Split(pattern string) (method, path string, err error) {
+	path = strings.TrimSpace(pattern)
+	if m, p, ok := strings.Cut(path, " "); ok {
+		method, path = strings.ToUpper(m), strings.TrimSpace(p)
+	}
+	if method == "*" {
+		method = ""
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("route %q should be like \"GET /v1/*\"", pattern)
+	}
+	return
+}
+
+func segments(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Add compiles rt into m
+func (m *Matcher) Add(rt Route) error {
+	method, path, err := Split(rt.Pattern)
+	if err != nil {
+		return err
+	}
+	n, segs := &m.root, segments(path)
+	for i, seg := range segs {
+		switch {
+		case seg == "*" && i == len(segs)-1:
+			n.wildcard = insert(n.wildcard, &entry{method, m.count, rt})
+			m.count++
+			return nil
+		case seg == "*" || strings.HasPrefix(seg, "*"):
+			return fmt.Errorf("route %q: the wildcard must be the last segment", rt.Pattern)
+		case strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			if n.param == nil {
+				n.param = &node{}
+			}
+			n = n.param
+		default:
+			if n.static == nil {
+				n.static = make(map[string]*node)
+			}
+			c, ok := n.static[seg]
+			if !ok {
+				c = &node{}
+				n.static[seg] = c
+			}
+			n = c
+		}
+	}
+	n.entries = insert(n.entries, &entry{method, m.count, rt})
+	m.count++
+	return nil
+}
+
+// insert keeps the entries in the order of precedence
+func insert(es []*entry, e *entry) []*entry {
+	es = append(es, e)
+	sort.SliceStable(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		if (a.method != "") != (b.method != "") {
+			return a.method != ""
+		}
+		if a.route.Priority != b.route.Priority {
+			return a.route.Priority > b.route.Priority
+		}
+		return a.order < b.order
+	})
+	return es
+}
+
+// Len returns the count of the routes
+func (m *Matcher) Len() int { return m.count }
+
+// Match returns the most specific route of the request
+func (m *Matcher) Match(method, path string) (Route, bool) {
+	if e := m.root.match(segments(path), strings.ToUpper(method)); e != nil {
+		return e.route, true
+	}
+	return Route{}, false
+}
+
+func (n *node) match(segs []string, method string) *entry {
+	if len(segs) == 0 {
+		if e := pick(n.entries, method); e != nil {
+			return e
+		}
+	} else {
+		if c, ok := n.static[segs[0]]; ok {
+			if e := c.match(segs[1:], method); e != nil {
+				return e
+			}
+		}
+		if n.param != nil {
+			if e := n.param.match(segs[1:], method); e != nil {
+				return e
+			}
+		}
+	}
+	return pick(n.wildcard, method)
+}
+
+func pick(es []*entry, method string) *entry {
+	for _, e := range es {
+		if e.method == "" || e.method == method {
+			return e
+		}
+	}
+	return nil
+}
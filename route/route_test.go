@@ -0,0 +1,58 @@
+package route_test
+
+import (
+	"testing"
+
+	"github.com/hedzr/rate/route"
+)
+
+func TestMatch(t *testing.T) {
+	m := route.New()
+	for _, rt := range []route.Route{
+		{Pattern: "/*", Value: "fallback"},
+		{Pattern: "GET /v1/*", Value: "read"},
+		{Pattern: "POST /v1/upload", Value: "upload"},
+		{Pattern: "/v1/users/:id", Value: "user"},
+		{Pattern: "DELETE /v1/users/{id}", Value: "delete-user"},
+		{Pattern: "/v1/users/me", Value: "me"},
+		{Pattern: "/v1/users/me", Priority: 1, Value: "me-first"},
+	} {
+		if err := m.Add(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct{ method, path, want string }{
+		{"POST", "/v1/upload", "upload"},
+		{"GET", "/v1/upload", "read"},
+		{"PUT", "/v1/upload", "fallback"},
+		{"GET", "/v1/", "read"},
+		{"GET", "/v1", "read"},
+		{"get", "/v1/users/42", "user"},
+		{"DELETE", "/v1/users/42", "delete-user"},
+		{"GET", "/v1/users/me", "me-first"},
+		{"GET", "/v1/users/42/posts", "read"},
+		{"POST", "/v1/users/42/posts", "fallback"},
+		{"GET", "/", "fallback"},
+	} {
+		rt, ok := m.Match(tc.method, tc.path)
+		if !ok || rt.Value != tc.want {
+			t.Fatalf("%v %v: expecting %v, got %v", tc.method, tc.path, tc.want, rt.Value)
+		}
+	}
+	if m.Len() != 7 {
+		t.Fatalf("expecting 7 routes, got %v", m.Len())
+	}
+}
+
+func TestBadPatterns(t *testing.T) {
+	m := route.New()
+	for _, p := range []string{"v1/users", "GET v1", "/v1/*/users", "/v1/*rest"} {
+		if m.Add(route.Route{Pattern: p}) == nil {
+			t.Fatalf("%q should be rejected", p)
+		}
+	}
+	m.Add(route.Route{Pattern: "POST /upload"})
+	if _, ok := m.Match("GET", "/upload"); ok {
+		t.Fatal("the method should be matched")
+	}
+}
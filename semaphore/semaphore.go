@@ -0,0 +1,192 @@
+// Package semaphore implements a weighted semaphore, which caps the
+// concurrent executions rather than the rate, such as of the expensive
+// endpoints:
+//
+//	sem := semaphore.New(10)
+//	if err := sem.Acquire(ctx, 1); err != nil {
+//		return err
+//	}
+//	defer sem.Release(1)
+//
+// It is a rateapi.Limiter, so the semaphores per key are held by
+// keyed.Limiters, and the HTTP middleware releases the allow taken by a
+// request when its handler returns.
+package semaphore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+var (
+	// ErrClosed is returned by Acquire after the semaphore closed
+	ErrClosed = errors.New("semaphore: closed")
+	// ErrTooLarge is returned by Acquire if n exceeds the capacity, it
+	// would never be assigned
+	ErrTooLarge = errors.New("semaphore: acquiring more than the capacity")
+)
+
+// New returns a semaphore of capacity allows
+func New(capacity int64) rateapi.Semaphore {
+	if capacity < 1 {
+		logger.Errorf("the capacity of a semaphore must be positive, it's %v", capacity)
+		return nil
+	}
+	return &semaphore{enabled: true, capacity: capacity, waiters: list.New()}
+}
+
+// NewKeyed returns a semaphore of capacity allows per key, see also
+// keyed.Limiters.Semaphore.
+func NewKeyed(capacity int64) *keyed.Limiters {
+	return keyed.New(func(string) rateapi.Limiter {
+		if s := New(capacity); s != nil {
+			return s
+		}
+		return nil
+	})
+}
+
+type semaphore struct {
+	enabled  bool
+	capacity int64
+
+	rw      sync.Mutex
+	held    int64
+	waiters *list.List // of *waiter, in the order of arrival
+	closed  bool
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{} // closed when the allows are assigned, or closed
+}
+
+func (s *semaphore) Enabled() bool     { return s.enabled }
+func (s *semaphore) SetEnabled(b bool) { s.enabled = b }
+func (s *semaphore) Capacity() int64   { return s.capacity }
+
+// Available returns the allows not held
+func (s *semaphore) Available() int64 {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return s.capacity - s.held
+}
+
+// Take is TryAcquire, the allows must be released
+func (s *semaphore) Take(count int) bool { return s.TryAcquire(count) }
+
+// TakeBlocked is Acquire without a deadline, the allows must be released.
+// It returns the zero time if they are not assigned, such as of
+// ErrTooLarge or ErrClosed; Acquire tells the error.
+func (s *semaphore) TakeBlocked(count int) (requestAt time.Time) {
+	requestAt = time.Now().UTC()
+	if err := s.Acquire(context.Background(), count); err != nil {
+		logger.Errorf("semaphore: %v", err)
+		return time.Time{}
+	}
+	return
+}
+
+// TryAcquire assigns n of allows if they are free and nobody waits before
+func (s *semaphore) TryAcquire(n int) bool {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.closed || s.held+int64(n) > s.capacity || s.waiters.Len() > 0 {
+		return false
+	}
+	s.held += int64(n)
+	return true
+}
+
+// Acquire assigns n of allows, the waiters are served in the order of
+// arrival, so a large n is not starved by the small ones.
+func (s *semaphore) Acquire(ctx context.Context, n int) error {
+	s.rw.Lock()
+	switch {
+	case s.closed:
+		s.rw.Unlock()
+		return ErrClosed
+	case int64(n) > s.capacity:
+		s.rw.Unlock()
+		return ErrTooLarge
+	case s.held+int64(n) <= s.capacity && s.waiters.Len() == 0:
+		s.held += int64(n)
+		s.rw.Unlock()
+		return nil
+	}
+	w := &waiter{n: int64(n), ready: make(chan struct{})}
+	e := s.waiters.PushBack(w)
+	s.rw.Unlock()
+
+	select {
+	case <-w.ready:
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		if s.closed {
+			return ErrClosed
+		}
+		return nil // held by grant()
+	case <-ctx.Done():
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		select {
+		case <-w.ready:
+			if !s.closed {
+				// assigned just now, give them to the next ones
+				s.held -= w.n
+				s.grant()
+			}
+		default:
+			front := s.waiters.Front() == e
+			s.waiters.Remove(e)
+			if front {
+				s.grant() // the ones behind may fit now
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// Release returns n of allows and wakes up the waiters which fit
+func (s *semaphore) Release(n int) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.held -= int64(n); s.held < 0 {
+		logger.Errorf("semaphore: released more than held, %v", -s.held)
+		s.held = 0
+	}
+	s.grant()
+}
+
+// grant assigns the allows to the waiters in order while the first one
+// fits, the caller must hold the lock
+func (s *semaphore) grant() {
+	for e := s.waiters.Front(); e != nil; e = s.waiters.Front() {
+		w := e.Value.(*waiter)
+		if s.held+w.n > s.capacity {
+			break
+		}
+		s.held += w.n
+		s.waiters.Remove(e)
+		close(w.ready)
+	}
+}
+
+// Close wakes up the waiters with ErrClosed, the allows held can still be
+// released.
+func (s *semaphore) Close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.closed = true
+	for e := s.waiters.Front(); e != nil; e = e.Next() {
+		close(e.Value.(*waiter).ready)
+	}
+	s.waiters.Init()
+}
@@ -0,0 +1,141 @@
+package semaphore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/semaphore"
+)
+
+func TestAcquireRelease(t *testing.T) {
+	s := semaphore.New(3)
+	defer s.Close()
+
+	if !s.TryAcquire(2) || !s.Take(1) || s.TryAcquire(1) {
+		t.Fatal("3 allows should be assigned, and no more")
+	}
+	if s.Available() != 0 || s.Capacity() != 3 {
+		t.Fatalf("unexpected available %v of %v", s.Available(), s.Capacity())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline exceeded, got %v", err)
+	}
+	if err := s.Acquire(context.Background(), 4); err != semaphore.ErrTooLarge {
+		t.Fatalf("expecting too large, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Acquire(context.Background(), 2); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Release(1)
+	select {
+	case <-done:
+		t.Fatal("2 allows should not be assigned while 1 is free")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.Release(2)
+	<-done
+	if s.Available() != 1 {
+		t.Fatalf("expecting 1 available, got %v", s.Available())
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	s := semaphore.New(4)
+	defer s.Close()
+	s.TakeBlocked(4)
+
+	// the large one waits first, the small ones after it do not overtake
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, n := range []int{4, 1, 1} {
+		wg.Add(1)
+		go func(i, n int) {
+			defer wg.Done()
+			if err := s.Acquire(context.Background(), n); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			s.Release(n)
+		}(i, n)
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Release(2)
+	time.Sleep(10 * time.Millisecond)
+	if len(order) != 0 || s.TryAcquire(1) {
+		t.Fatalf("no one should overtake the large waiter, got %v", order)
+	}
+	s.Release(2)
+	wg.Wait()
+	if len(order) != 3 || order[0] != 0 {
+		t.Fatalf("expecting the large one first, got %v", order)
+	}
+}
+
+func TestCancelAndClose(t *testing.T) {
+	s := semaphore.New(2)
+	s.TryAcquire(1)
+
+	// a canceled waiter in front lets the ones behind in
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { errs <- s.Acquire(ctx, 2) }()
+	time.Sleep(5 * time.Millisecond)
+	go func() { errs <- s.Acquire(context.Background(), 1) }()
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil && err != context.Canceled {
+			t.Fatal(err)
+		}
+	}
+	if s.Available() != 0 {
+		t.Fatalf("the one behind should be assigned, available %v", s.Available())
+	}
+
+	go func() { errs <- s.Acquire(context.Background(), 1) }()
+	time.Sleep(5 * time.Millisecond)
+	s.Close()
+	if err := <-errs; err != semaphore.ErrClosed {
+		t.Fatalf("expecting closed, got %v", err)
+	}
+	if !s.TakeBlocked(1).IsZero() {
+		t.Fatal("TakeBlocked should not report the allows of a closed semaphore")
+	}
+	s.Release(2)
+	if s.Available() != 2 {
+		t.Fatalf("the allows held should be released after closed, got %v", s.Available())
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	sems := semaphore.NewKeyed(1)
+	defer sems.Close()
+	if !sems.Semaphore("a").TryAcquire(1) || sems.Get("a").Take(1) {
+		t.Fatal("a semaphore of 1 should be held once")
+	}
+	if !sems.Semaphore("b").TryAcquire(1) {
+		t.Fatal("the keys should be independent")
+	}
+	sems.Semaphore("a").Release(1)
+	if sems.Get("a").Available() != 1 {
+		t.Fatal("the allow should be released")
+	}
+	if semaphore.New(0) != nil {
+		t.Fatal("a semaphore needs a positive capacity")
+	}
+}
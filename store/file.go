@@ -0,0 +1,372 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+)
+
+const (
+	walName      = "states.wal"
+	snapshotName = "states.snap"
+
+	opPut    = 1
+	opDelete = 2
+
+	// recordHeader is the length and the checksum of the payload of a record
+	recordHeader = 8
+	// compactCheck is how often the size of the log is checked for compaction
+	compactCheck = time.Second
+
+	// the default batch of the fsyncs, see WithSyncBatch
+	defaultSyncEvery    = 64
+	defaultSyncInterval = 100 * time.Millisecond
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// FileOption configures a File store
+type FileOption func(f *File)
+
+// WithSyncBatch batches the fsyncs of the log: it is synced after n updates,
+// or every d if some updates are not synced, whichever comes first. The
+// default is 64 updates or 100ms. WithSyncBatch(1, 0) syncs every update,
+// which costs an fsync per Update with the store locked, so the updates
+// of all keys queue up behind the disk. If both are not positive, the log
+// is synced only on the compactions and Close.
+//
+// The updates are written to the log before they return in any case, so
+// a crash of the process loses nothing; the unsynced ones may be lost on
+// a crash of the machine.
+func WithSyncBatch(n int, d time.Duration) FileOption {
+	return func(f *File) { f.syncEvery, f.syncInterval = n, d }
+}
+
+// WithCompactSize sets the size of the log to compact at, default is 4MiB
+func WithCompactSize(bytes int64) FileOption {
+	return func(f *File) { f.compactSize = bytes }
+}
+
+// File is a store persisted in a local directory, for the quotas of a
+// single node to survive the crashes and the restarts.
+//
+// Each update is appended to a write-ahead log as the full state of the
+// key, the log is compacted into a snapshot of all keys periodically when
+// it grows over WithCompactSize. On open, the states are rebuilt from the
+// snapshot and the log; a torn record at the end of the log, which a crash
+// in the middle of a write leaves, is dropped.
+type File struct {
+	mu           sync.Mutex
+	dir          string
+	wal          *os.File
+	walSize      int64
+	states       map[string]State
+	pending      int // the updates not synced
+	syncEvery    int
+	syncInterval time.Duration
+	compactSize  int64
+	buf          []byte
+	exitCh       chan struct{}
+	wg           sync.WaitGroup
+	closed       bool
+}
+
+// OpenFile opens the store in dir, creating dir if missing. The fsyncs of
+// the log are batched by default, see WithSyncBatch for the updates which
+// may be lost on a crash of the machine.
+func OpenFile(dir string, opts ...FileOption) (*File, error) {
+	f := &File{dir: dir, syncEvery: defaultSyncEvery, syncInterval: defaultSyncInterval, compactSize: 4 << 20, exitCh: make(chan struct{})}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := f.recover(); err != nil {
+		return nil, err
+	}
+	f.wg.Add(1)
+	go f.looper()
+	return f, nil
+}
+
+// recover loads the snapshot and replays the log on it
+func (f *File) recover() error {
+	f.states = make(map[string]State)
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if len(data) < 4 || crc32.Checksum(data[4:], castagnoli) != binary.LittleEndian.Uint32(data) {
+			return fmt.Errorf("store: %v: %w", snapshotName, ErrBadSnapshot)
+		}
+		if f.states, err = unmarshalEntries(data[4:]); err != nil {
+			return fmt.Errorf("store: %v: %w", snapshotName, err)
+		}
+	}
+	_ = os.Remove(filepath.Join(f.dir, snapshotName+".tmp")) // of a crashed compaction
+
+	if f.wal, err = os.OpenFile(filepath.Join(f.dir, walName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+		return err
+	}
+	if data, err = io.ReadAll(f.wal); err != nil {
+		f.wal.Close()
+		return err
+	}
+	for len(data[f.walSize:]) > 0 {
+		n := f.replay(data[f.walSize:])
+		if n == 0 {
+			logger.Warnf("store: dropped a torn record at %d of %v", f.walSize, walName)
+			if err = f.wal.Truncate(f.walSize); err == nil {
+				err = f.wal.Sync()
+			}
+			if err != nil {
+				f.wal.Close()
+				return err
+			}
+			break
+		}
+		f.walSize += int64(n)
+	}
+	return nil
+}
+
+// replay applies the record at the head of b, and returns its length, or
+// 0 if it is torn or corrupted.
+func (f *File) replay(b []byte) int {
+	if len(b) < recordHeader {
+		return 0
+	}
+	size := binary.LittleEndian.Uint32(b)
+	if uint64(size) > uint64(len(b)-recordHeader) {
+		return 0
+	}
+	payload := b[recordHeader : recordHeader+int(size)]
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(b[4:]) || len(payload) == 0 {
+		return 0
+	}
+	d := &decoder{b: payload[1:]}
+	key := d.string()
+	switch payload[0] {
+	case opPut:
+		st := State{Count: d.varint(), Stamp: d.varint()}
+		if d.err != nil || len(d.b) > 0 {
+			return 0
+		}
+		f.states[key] = st
+	case opDelete:
+		if d.err != nil || len(d.b) > 0 {
+			return 0
+		}
+		delete(f.states, key)
+	default:
+		return 0
+	}
+	return recordHeader + int(size)
+}
+
+// append writes a record to the log, and syncs it by WithSyncBatch
+func (f *File) append(op byte, key string, st State) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	b := append(f.buf[:0], make([]byte, recordHeader)...)
+	b = append(b, op)
+	b = appendString(b, key)
+	if op == opPut {
+		b = binary.AppendVarint(b, st.Count)
+		b = binary.AppendVarint(b, st.Stamp)
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-recordHeader))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b[recordHeader:], castagnoli))
+	f.buf = b
+
+	n, err := f.wal.Write(b)
+	f.walSize += int64(n)
+	if err != nil {
+		// drop the partial record, or the following ones are lost on recovery
+		if f.wal.Truncate(f.walSize-int64(n)) == nil {
+			f.walSize -= int64(n)
+		}
+		return err
+	}
+	if f.pending++; f.syncEvery > 0 && f.pending >= f.syncEvery {
+		return f.sync()
+	}
+	return nil
+}
+
+func (f *File) sync() error {
+	f.pending = 0
+	return f.wal.Sync()
+}
+
+func (f *File) looper() {
+	defer f.wg.Done()
+	var syncCh <-chan time.Time
+	if f.syncInterval > 0 {
+		t := time.NewTicker(f.syncInterval)
+		defer t.Stop()
+		syncCh = t.C
+	}
+	compactTicker := time.NewTicker(compactCheck)
+	defer compactTicker.Stop()
+	for {
+		select {
+		case <-f.exitCh:
+			return
+		case <-syncCh:
+			f.mu.Lock()
+			if f.pending > 0 && !f.closed {
+				if err := f.sync(); err != nil {
+					logger.Errorf("store: sync %v: %v", walName, err)
+				}
+			}
+			f.mu.Unlock()
+		case <-compactTicker.C:
+			f.mu.Lock()
+			if f.walSize >= f.compactSize && !f.closed {
+				if err := f.compact(); err != nil {
+					logger.Errorf("store: compact %v: %v", f.dir, err)
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Compact writes the states of all keys into the snapshot and empties the
+// log. It is done periodically when the log grows over WithCompactSize.
+func (f *File) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return f.compact()
+}
+
+// compact replaces the snapshot atomically by renaming, then empties the
+// log. A crash before emptying it is harmless, its records are the full
+// states, which the snapshot already has.
+func (f *File) compact() error {
+	data := marshalEntries(f.states)
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(data, castagnoli))
+	b = append(b, data...)
+
+	tmp := filepath.Join(f.dir, snapshotName+".tmp")
+	if err := writeSynced(tmp, b); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, snapshotName)); err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	f.walSize = 0
+	return f.sync()
+}
+
+func writeSynced(path string, data []byte) error {
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err == nil {
+		err = w.Sync()
+	}
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err // some platforms cannot sync a directory
+	}
+	return nil
+}
+
+// Update implements Store, the state is logged before it is returned
+func (f *File) Update(key string, fn UpdateFunc) (State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st, exists := f.states[key]
+	next := fn(st, exists)
+	if err := f.append(opPut, key, next); err != nil {
+		return st, err
+	}
+	f.states[key] = next
+	return next, nil
+}
+
+// Load implements Store
+func (f *File) Load(key string) (st State, exists bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st, exists = f.states[key]
+	return
+}
+
+// Delete implements Store
+func (f *File) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.states[key]; !ok {
+		return nil
+	}
+	if err := f.append(opDelete, key, State{}); err != nil {
+		return err
+	}
+	delete(f.states, key)
+	return nil
+}
+
+// Len returns the count of keys
+func (f *File) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.states)
+}
+
+// Close implements Store, it syncs and closes the log
+func (f *File) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.mu.Unlock()
+	close(f.exitCh)
+	f.wg.Wait()
+
+	err := f.wal.Sync()
+	if e := f.wal.Close(); err == nil {
+		err = e
+	}
+	return err
+}
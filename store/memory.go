@@ -0,0 +1,116 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const shards = 32
+
+// NewMemory returns an in-memory store, which implements both of Store
+// and CASStore.
+func NewMemory() *Memory {
+	m := &Memory{}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]*entry)
+	}
+	return m
+}
+
+// Memory is a sharded in-memory store
+type Memory struct {
+	shards [shards]shard
+}
+
+type shard struct {
+	rw      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	State
+	version uint64
+}
+
+func (m *Memory) shard(key string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &m.shards[h.Sum32()%shards]
+}
+
+// Update implements Store
+func (m *Memory) Update(key string, fn UpdateFunc) (State, error) {
+	sh := m.shard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
+	e, exists := sh.entries[key]
+	if !exists {
+		e = &entry{}
+		sh.entries[key] = e
+	}
+	e.State = fn(e.State, exists)
+	e.version++
+	return e.State, nil
+}
+
+// Load implements Store
+func (m *Memory) Load(key string) (st State, exists bool, err error) {
+	sh := m.shard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
+	if e, ok := sh.entries[key]; ok {
+		return e.State, true, nil
+	}
+	return
+}
+
+// Get implements CASStore
+func (m *Memory) Get(key string) (st State, version uint64, exists bool, err error) {
+	sh := m.shard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
+	if e, ok := sh.entries[key]; ok {
+		return e.State, e.version, true, nil
+	}
+	return
+}
+
+// CompareAndSwap implements CASStore
+func (m *Memory) CompareAndSwap(key string, version uint64, st State) (swapped bool, err error) {
+	sh := m.shard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
+	e, ok := sh.entries[key]
+	switch {
+	case !ok && version == 0:
+		sh.entries[key] = &entry{st, 1}
+		return true, nil
+	case ok && e.version == version:
+		e.State = st
+		e.version++
+		return true, nil
+	}
+	return false, nil
+}
+
+// Delete implements Store and CASStore
+func (m *Memory) Delete(key string) error {
+	sh := m.shard(key)
+	sh.rw.Lock()
+	defer sh.rw.Unlock()
+	delete(sh.entries, key)
+	return nil
+}
+
+// Len returns the count of keys
+func (m *Memory) Len() (n int) {
+	for i := range m.shards {
+		m.shards[i].rw.Lock()
+		n += len(m.shards[i].entries)
+		m.shards[i].rw.Unlock()
+	}
+	return
+}
+
+// Close implements Store and CASStore
+func (m *Memory) Close() error { return nil }
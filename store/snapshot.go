@@ -0,0 +1,204 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// snapshotVersion is the version of the encodings of MarshalStates and
+// Memory.Snapshot
+const snapshotVersion = 1
+
+// ErrBadSnapshot is returned when a snapshot cannot be decoded
+var ErrBadSnapshot = errors.New("store: bad snapshot")
+
+// MarshalStates encodes the states of a limiter of the algorithm, for
+// rateapi.Snapshotter. The encoding is versioned and compact: the version,
+// the algorithm, then the varints of the states. The stamps of the states
+// must be absolute, so that the downtime is credited on restore.
+func MarshalStates(algorithm string, states ...State) []byte {
+	b := []byte{snapshotVersion}
+	b = appendString(b, algorithm)
+	b = binary.AppendUvarint(b, uint64(len(states)))
+	for _, st := range states {
+		b = binary.AppendVarint(b, st.Count)
+		b = binary.AppendVarint(b, st.Stamp)
+	}
+	return b
+}
+
+// UnmarshalStates decodes the states encoded by MarshalStates, which must
+// be of the algorithm.
+func UnmarshalStates(data []byte, algorithm string) ([]State, error) {
+	d, err := newDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	if name := d.string(); d.err == nil && name != algorithm {
+		return nil, fmt.Errorf("store: the snapshot of %q cannot restore a %q limiter", name, algorithm)
+	}
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(data)) {
+		return nil, ErrBadSnapshot
+	}
+	states := make([]State, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		states = append(states, State{Count: d.varint(), Stamp: d.varint()})
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.err = ErrBadSnapshot
+	}
+	return states, d.err
+}
+
+// UnmarshalState decodes the state of a single-state limiter, exists is
+// false if the snapshot has no state, such as of a limiter never used.
+func UnmarshalState(data []byte, algorithm string) (st State, exists bool, err error) {
+	states, err := UnmarshalStates(data, algorithm)
+	switch {
+	case err != nil:
+	case len(states) > 1:
+		err = ErrBadSnapshot
+	case len(states) == 1:
+		st, exists = states[0], true
+	}
+	return
+}
+
+// AlgorithmName returns the name of alg for MarshalStates, it is the
+// result of String if alg implements fmt.Stringer.
+func AlgorithmName(alg Algorithm) string {
+	if s, ok := alg.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
+
+// Snapshot encodes the states of all keys, in the order of the keys
+func (m *Memory) Snapshot() ([]byte, error) {
+	entries := make(map[string]State)
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.rw.Lock()
+		for key, e := range sh.entries {
+			entries[key] = e.State
+		}
+		sh.rw.Unlock()
+	}
+	return marshalEntries(entries), nil
+}
+
+// Restore puts the states of a Snapshot into m, replacing the ones of the
+// same keys. Nothing is restored if data is bad.
+func (m *Memory) Restore(data []byte) error {
+	entries, err := unmarshalEntries(data)
+	if err != nil {
+		return err
+	}
+	for key, st := range entries {
+		st := st
+		_, _ = m.Update(key, func(State, bool) State { return st })
+	}
+	return nil
+}
+
+// marshalEntries encodes the states of the keys, in the order of the keys
+func marshalEntries(entries map[string]State) []byte {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := []byte{snapshotVersion}
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, key := range keys {
+		b = appendString(b, key)
+		b = binary.AppendVarint(b, entries[key].Count)
+		b = binary.AppendVarint(b, entries[key].Stamp)
+	}
+	return b
+}
+
+func unmarshalEntries(data []byte) (map[string]State, error) {
+	d, err := newDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(data)) {
+		return nil, ErrBadSnapshot
+	}
+	entries := make(map[string]State, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		key := d.string()
+		entries[key] = State{Count: d.varint(), Stamp: d.varint()}
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.err = ErrBadSnapshot
+	}
+	return entries, d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads the varints and the strings, the first error sticks
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func newDecoder(data []byte) (*decoder, error) {
+	if len(data) == 0 {
+		return nil, ErrBadSnapshot
+	}
+	if data[0] != snapshotVersion {
+		return nil, fmt.Errorf("store: unsupported snapshot version %d", data[0])
+	}
+	return &decoder{b: data[1:]}, nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrBadSnapshot
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrBadSnapshot
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrBadSnapshot
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
@@ -0,0 +1,202 @@
+// Package store separates the state of the rate limiters from their algorithms.
+//
+// An algorithm is a pure decision on a State (see Algorithm), the State
+// of each key lives in a Store. The in-memory Store and the File store
+// persisted in a local directory are shipped here; an external backend
+// (SQL, etcd, redis, ...) implements Store directly, or implements the
+// simpler CASStore and is adapted by FromCAS.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/rateapi"
+)
+
+// State is the per-key state of an algorithm
+type State struct {
+	// Count is the tokens, the water level or the requests in window, it
+	// depends on the algorithm.
+	Count int64
+	// Stamp is an absolute unix time in nanoseconds, such as the last
+	// refill or the end of window, it depends on the algorithm.
+	Stamp int64
+}
+
+// UpdateFunc computes the new state from the current one. exists is
+// false if the key has no state yet.
+type UpdateFunc func(st State, exists bool) State
+
+// Store keeps the states of many keys
+type Store interface {
+	// Update applies fn to the state of key atomically, and returns the
+	// state stored. fn may be called more than once if the store retries
+	// on conflicts, so it must have no side effects.
+	Update(key string, fn UpdateFunc) (State, error)
+	// Load returns the state of key
+	Load(key string) (st State, exists bool, err error)
+	// Delete removes the state of key
+	Delete(key string) error
+	// Close releases the store
+	Close() error
+}
+
+// CASStore is a store with the compare-and-swap operation only, which is
+// what most of the remote backends offer.
+type CASStore interface {
+	// Get returns the state of key and its version, the version of a
+	// missing key is 0.
+	Get(key string) (st State, version uint64, exists bool, err error)
+	// CompareAndSwap stores st if the version of key is still version.
+	CompareAndSwap(key string, version uint64, st State) (swapped bool, err error)
+	// Delete removes the state of key
+	Delete(key string) error
+	// Close releases the store
+	Close() error
+}
+
+// ErrContention is returned by the Store adapted by FromCAS, when it
+// cannot update a key after too many conflicts.
+var ErrContention = errors.New("store: too many conflicts")
+
+// FromCAS adapts a CASStore to Store by retrying the compare-and-swap on conflicts.
+func FromCAS(cas CASStore) Store { return &casStore{cas, 64} }
+
+type casStore struct {
+	CASStore
+	maxRetries int
+}
+
+func (s *casStore) Update(key string, fn UpdateFunc) (State, error) {
+	for i := 0; i < s.maxRetries; i++ {
+		st, version, exists, err := s.Get(key)
+		if err != nil {
+			return st, err
+		}
+		next := fn(st, exists)
+		swapped, err := s.CompareAndSwap(key, version, next)
+		if err != nil {
+			return st, err
+		}
+		if swapped {
+			return next, nil
+		}
+	}
+	return State{}, ErrContention
+}
+
+func (s *casStore) Load(key string) (st State, exists bool, err error) {
+	st, _, exists, err = s.Get(key)
+	return
+}
+
+// Algorithm is the decision of a rate limiter on a stored state.
+type Algorithm interface {
+	// Decide returns the next state and whether count of allows can be
+	// assigned at now (in unix nanoseconds). If not, wait is a hint of
+	// how long the caller should wait before retrying.
+	Decide(st State, exists bool, now int64, count int) (next State, ok bool, wait time.Duration)
+	// Available returns the remains in st at now
+	Available(st State, exists bool, now int64) int64
+	// Capacity returns the maximal count
+	Capacity() int64
+}
+
+// Resetter is implemented by the algorithms which can tell how long a
+// state takes to recover to the full capacity, for 'X-RateLimit-Reset'.
+type Resetter interface {
+	Reset(st State, exists bool, now int64) time.Duration
+}
+
+// NewLimiter returns a rateapi.Limiter which runs alg on the state of key in s.
+//
+// The limiter fails open: if the store fails, the request is allowed and
+// a warning is logged.
+func NewLimiter(s Store, key string, alg Algorithm) rateapi.Limiter {
+	return &limiter{true, s, key, alg}
+}
+
+type limiter struct {
+	enabled bool
+	store   Store
+	key     string
+	alg     Algorithm
+}
+
+func (s *limiter) Enabled() bool     { return s.enabled }
+func (s *limiter) SetEnabled(b bool) { s.enabled = b }
+func (s *limiter) Capacity() int64   { return s.alg.Capacity() }
+func (s *limiter) Close()            {}
+
+// Key returns the key of the state in the store
+func (s *limiter) Key() string { return s.key }
+
+func (s *limiter) take(count int) (ok bool, wait time.Duration) {
+	now := time.Now().UnixNano()
+	_, err := s.store.Update(s.key, func(st State, exists bool) (next State) {
+		next, ok, wait = s.alg.Decide(st, exists, now, count)
+		return
+	})
+	if err != nil {
+		logger.Warnf("store: update %q failed: %v", s.key, err)
+		return true, 0
+	}
+	return
+}
+
+func (s *limiter) Take(count int) bool {
+	ok, _ := s.take(count)
+	return ok
+}
+
+// TakeBlocked waits until count is allowed, it returns the zero time at
+// once if count exceeds the capacity, which would never be allowed.
+func (s *limiter) TakeBlocked(count int) (requestAt time.Time) {
+	if c := s.alg.Capacity(); int64(count) > c {
+		logger.Errorf("store: taking %v exceeds the capacity %v", count, c)
+		return time.Time{}
+	}
+	requestAt = time.Now().UTC()
+	for ok, wait := s.take(count); !ok; ok, wait = s.take(count) {
+		time.Sleep(wait)
+	}
+	return
+}
+
+// Snapshot implements rateapi.Snapshotter, it encodes the state of the
+// key by MarshalStates.
+func (s *limiter) Snapshot() ([]byte, error) {
+	st, exists, err := s.store.Load(s.key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return MarshalStates(AlgorithmName(s.alg)), nil
+	}
+	return MarshalStates(AlgorithmName(s.alg), st), nil
+}
+
+// Restore implements rateapi.Snapshotter, it puts the state of a Snapshot
+// into the store.
+func (s *limiter) Restore(data []byte) error {
+	st, exists, err := UnmarshalState(data, AlgorithmName(s.alg))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return s.store.Delete(s.key)
+	}
+	_, err = s.store.Update(s.key, func(State, bool) State { return st })
+	return err
+}
+
+func (s *limiter) Available() int64 {
+	st, exists, err := s.store.Load(s.key)
+	if err != nil {
+		logger.Warnf("store: load %q failed: %v", s.key, err)
+		return 0
+	}
+	return s.alg.Available(st, exists, time.Now().UnixNano())
+}
@@ -0,0 +1,291 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
+	"github.com/hedzr/rate/tokenbucket"
+)
+
+func increment(st store.State, exists bool) store.State {
+	st.Count++
+	return st
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	m := store.NewMemory()
+	defer m.Close()
+	hammer(t, m)
+	if m.Len() != 2 {
+		t.Fatalf("expecting 2 keys, got %v", m.Len())
+	}
+	_ = m.Delete("a")
+	if _, ok, _ := m.Load("a"); ok || m.Len() != 1 {
+		t.Fatal("the key should be deleted")
+	}
+}
+
+func TestFromCAS(t *testing.T) {
+	s := store.FromCAS(store.NewMemory())
+	defer s.Close()
+	hammer(t, s)
+}
+
+func hammer(t *testing.T, s store.Store) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := s.Update("a", increment); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.Update("b", increment); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, key := range []string{"a", "b"} {
+		if st, ok, err := s.Load(key); err != nil || !ok || st.Count != 800 {
+			t.Fatalf("key %q: expecting 800 updates, got %+v, %v, %v", key, st, ok, err)
+		}
+	}
+}
+
+// conflicting never swaps
+type conflicting struct{ *store.Memory }
+
+func (conflicting) CompareAndSwap(key string, version uint64, st store.State) (bool, error) {
+	return false, nil
+}
+
+func TestContention(t *testing.T) {
+	s := store.FromCAS(conflicting{store.NewMemory()})
+	if _, err := s.Update("a", increment); !errors.Is(err, store.ErrContention) {
+		t.Fatalf("expecting contention, got %v", err)
+	}
+}
+
+func TestLimiterSharesState(t *testing.T) {
+	m := store.NewMemory()
+	l1 := store.NewLimiter(m, "k", tokenbucket.NewAlgorithm(5, time.Hour))
+	l2 := store.NewLimiter(m, "k", tokenbucket.NewAlgorithm(5, time.Hour))
+	var allowed int
+	for i := 0; i < 5; i++ {
+		if l1.Take(1) {
+			allowed++
+		}
+		if l2.Take(1) {
+			allowed++
+		}
+	}
+	if allowed != 5 || l1.Available() != 0 || l2.Capacity() != 5 {
+		t.Fatalf("allowed: %v, available: %v", allowed, l1.Available())
+	}
+	if at := l1.TakeBlocked(6); !at.IsZero() {
+		t.Fatalf("6 would never fit the capacity, got %v", at)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := store.NewMemory()
+	_, _ = m.Update("a", increment)
+	_, _ = m.Update("b", increment)
+	_, _ = m.Update("b", increment)
+	data, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := store.NewMemory()
+	if err = restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if st, ok, _ := restored.Load("b"); !ok || st.Count != 2 {
+		t.Fatalf("expecting the state of b restored, got %+v", st)
+	}
+	if err = restored.Restore(data[:len(data)-1]); !errors.Is(err, store.ErrBadSnapshot) {
+		t.Fatalf("expecting a bad snapshot, got %v", err)
+	}
+	if err = restored.Restore(append([]byte{9}, data[1:]...)); err == nil {
+		t.Fatal("expecting an unsupported version")
+	}
+
+	now := time.Now().UnixNano()
+	l := store.NewLimiter(m, "k", tokenbucket.NewAlgorithm(5, time.Hour))
+	if !l.Take(5) {
+		t.Fatal("a new bucket should be full")
+	}
+	if data, err = l.(rateapi.Snapshotter).Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	l2 := store.NewLimiter(store.NewMemory(), "k", tokenbucket.NewAlgorithm(5, time.Hour))
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil || l2.Available() != 0 {
+		t.Fatalf("expecting the empty bucket restored, got %v, %v", l2.Available(), err)
+	}
+
+	// the downtime is credited by the absolute stamp
+	data = store.MarshalStates("token-bucket", store.State{Count: 0, Stamp: now - int64(time.Hour)})
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil || l2.Available() != 5 {
+		t.Fatalf("expecting the bucket refilled in the downtime, got %v, %v", l2.Available(), err)
+	}
+	data = store.MarshalStates("counter", store.State{Count: 1, Stamp: now})
+	if err = l2.(rateapi.Snapshotter).Restore(data); err == nil {
+		t.Fatal("a snapshot of another algorithm should not be restored")
+	}
+}
+
+func openFile(t *testing.T, dir string, opts ...store.FileOption) *store.File {
+	t.Helper()
+	f, err := store.OpenFile(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func walSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	fi, err := os.Stat(filepath.Join(dir, "states.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f := openFile(t, dir, store.WithSyncBatch(16, 10*time.Millisecond))
+	for i := 0; i < 10; i++ {
+		_, _ = f.Update("a", increment)
+	}
+	_, _ = f.Update("b", increment)
+	_, _ = f.Update("c", increment)
+	_ = f.Delete("c")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Update("a", increment); err == nil {
+		t.Fatal("a closed store should not be updated")
+	}
+
+	f = openFile(t, dir)
+	defer f.Close()
+	if st, ok, _ := f.Load("a"); !ok || st.Count != 10 || f.Len() != 2 {
+		t.Fatalf("expecting the states rebuilt, got %+v of %v keys", st, f.Len())
+	}
+
+	// a monthly quota survives the restart
+	l := store.NewLimiter(f, "q", tokenbucket.NewAlgorithm(5, 30*24*time.Hour))
+	l.Take(5)
+	_ = f.Close()
+	f = openFile(t, dir)
+	defer f.Close()
+	if l = store.NewLimiter(f, "q", tokenbucket.NewAlgorithm(5, 30*24*time.Hour)); l.Take(1) {
+		t.Fatal("the quota should be used up after the restart")
+	}
+}
+
+func TestFileTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	f := openFile(t, dir)
+	_, _ = f.Update("a", increment)
+	_, _ = f.Update("b", increment)
+	before := walSize(t, dir)
+	_, _ = f.Update("a", increment)
+	after := walSize(t, dir)
+	_ = f.Close()
+	good, err := os.ReadFile(filepath.Join(dir, "states.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, wal []byte, count int64) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "states.wal"), wal, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		f := openFile(t, dir)
+		if st, _, _ := f.Load("a"); st.Count != count {
+			t.Fatalf("%v: expecting a of %v, got %+v", name, count, st)
+		}
+		if st, _, _ := f.Load("b"); st.Count != 1 {
+			t.Fatalf("%v: the records before the torn one should be kept, got %+v", name, st)
+		}
+		// the torn record is dropped, the new ones are not lost behind it
+		_, _ = f.Update("a", increment)
+		_ = f.Close()
+		f = openFile(t, dir)
+		if st, _, _ := f.Load("a"); st.Count != count+1 {
+			t.Fatalf("%v: expecting the update after the recovery, got %+v", name, st)
+		}
+		_ = f.Close()
+	}
+	for n := before; n < after; n++ {
+		check(fmt.Sprintf("torn at %d", n), good[:n], 1)
+	}
+	flipped := append([]byte(nil), good...)
+	flipped[len(flipped)-1] ^= 0xff
+	check("flipped", flipped, 1)
+	check("garbage", append(append([]byte(nil), good...), 0x11, 0, 0, 0, 0xde, 0xad), 2)
+	check("intact", good, 2)
+}
+
+func TestFileCompaction(t *testing.T) {
+	dir := t.TempDir()
+	f := openFile(t, dir, store.WithSyncBatch(0, 0), store.WithCompactSize(1))
+	for i := 0; i < 100; i++ {
+		_, _ = f.Update(fmt.Sprint("k", i%10), increment)
+	}
+	stale, _ := os.ReadFile(filepath.Join(dir, "states.wal"))
+	if err := f.Compact(); err != nil || walSize(t, dir) != 0 {
+		t.Fatalf("expecting the log emptied, got %v, %v", walSize(t, dir), err)
+	}
+	_ = f.Delete("k0")
+	_ = f.Close()
+
+	f = openFile(t, dir)
+	if st, ok, _ := f.Load("k9"); !ok || st.Count != 10 || f.Len() != 9 {
+		t.Fatalf("expecting the states rebuilt from the snapshot, got %+v of %v keys", st, f.Len())
+	}
+	_ = f.Close()
+
+	// a crash between the snapshot and emptying the log replays the stale
+	// records, which end in the states of the snapshot
+	if err := os.WriteFile(filepath.Join(dir, "states.wal"), stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f = openFile(t, dir)
+	if st, _, _ := f.Load("k9"); st.Count != 10 {
+		t.Fatalf("expecting the stale log harmless, got %+v", st)
+	}
+	_ = f.Close()
+
+	// the periodic compaction
+	f = openFile(t, dir, store.WithCompactSize(1))
+	defer f.Close()
+	_, _ = f.Update("k1", increment)
+	deadline := time.Now().Add(3 * time.Second)
+	for walSize(t, dir) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if walSize(t, dir) != 0 {
+		t.Fatal("expecting the log compacted in the background")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "states.snap"), []byte("bad"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OpenFile(dir); !errors.Is(err, store.ErrBadSnapshot) {
+		t.Fatalf("expecting a bad snapshot, got %v", err)
+	}
+}
@@ -1,11 +1,11 @@
-// Package middleware provides the middlewares for http servers such as gin, echo(to-do)...
-
 //go:build ignore
 // +build ignore
 
 package middleware
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,6 +13,8 @@ import (
 	"github.com/hedzr/cmdr/conf"
 	"github.com/hedzr/rate"
 	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/rateconfig"
 )
 
 // Config is an abstract structure for a rate limiter.
@@ -24,8 +26,18 @@ type Config struct {
 	Interval      time.Duration `yaml:"interval" json:"interval,omitempty"`
 	MaxRequests   int64         `yaml:"max-requests" json:"max-requests,omitempty"`
 	HeaderKeyName string        `yaml:"header-key-name" json:"header-key-name,omitempty"`
-	ExceptionKeys []string      `yaml:"exception-keys" json:"exception-keys,omitempty"`
-	Routes        []string      `yaml:"routes" json:"routes,omitempty"` // Not Yet. Reserved for the future: [optional for routes builder]
+	ExceptionKeys []string      `yaml:"exception-keys" json:"exception-keys,omitempty"` // not limited
+	Policies      []policy.Rule `yaml:"policies" json:"policies,omitempty"`             // see package policy
+	Routes        []string      `yaml:"routes" json:"routes,omitempty"`                 // the patterns such as "POST /v1/upload", see ForGinConfigs
+}
+
+// PolicyList compiles the exception keys and the policies of the config
+func (c *Config) PolicyList() (*policy.List, error) {
+	rules := make([]policy.Rule, 0, len(c.ExceptionKeys)+len(c.Policies))
+	for _, k := range c.ExceptionKeys {
+		rules = append(rules, policy.Rule{Key: k, Action: "unlimited"})
+	}
+	return policy.Compile(append(rules, c.Policies...))
 }
 
 // LoadConfig loads limiter config from cmdr config file and option store.
@@ -62,14 +74,56 @@ func LoadConfig(keyPath string) []Config {
 	if err != nil {
 		logger.Warnf("load '%v' failed: %v", keyPath, err)
 	}
-	for _, c := range dd {
-		if c.Algorithm == "" {
-			c.Algorithm = string(rate.TokenBucket)
+	for i := range dd {
+		if dd[i].Algorithm == "" {
+			dd[i].Algorithm = string(rate.TokenBucket)
 		}
 	}
 	return dd
 }
 
+// LoadConfigFile loads limiter config from a YAML, JSON or TOML file
+// without cmdr, see package rateconfig for the format:
+//
+// ```yaml
+// limiters:
+//   - name: by-api-key
+//     rate: 30/ms
+//     key: header:X-API-KEY
+//     exceptions: [voxr-apps-test-api-key-fndsfjn]
+//
+// ```
+//
+// ForGin takes the key from a header only, so the key of each definition
+// must be like 'header:NAME'.
+func LoadConfigFile(path string) ([]Config, error) {
+	c, err := rateconfig.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	dd := make([]Config, 0, len(c.Limiters))
+	for _, d := range c.Limiters {
+		source, name, _ := strings.Cut(d.Key, ":")
+		if source != "header" {
+			return nil, fmt.Errorf("%v: limiter %q: key %q is not a header", path, d.Name, d.Key)
+		}
+		maxCount, period, _ := d.Params()
+		dd = append(dd, Config{
+			Name:          d.Name,
+			Description:   d.Description,
+			Enabled:       true,
+			Algorithm:     string(d.AlgorithmOf()),
+			Interval:      period,
+			MaxRequests:   maxCount,
+			HeaderKeyName: name,
+			ExceptionKeys: d.Exceptions,
+			Policies:      d.Policies,
+			Routes:        d.Routes,
+		})
+	}
+	return dd, nil
+}
+
 // Router is an abstract interface for any gin router objects (gin.Engine, gin.RouterGroup, ...)
 type Router interface {
 	gin.IRouter
@@ -91,13 +145,21 @@ type Router interface {
 //	        max-requests: 30
 //	        header-key-name: X-API-KEY
 //	        exception-keys: [voxr-apps-test-api-key-fndsfjn]
+//	      - name: uploads
+//	        interval: 1m
+//	        max-requests: 5
+//	        header-key-name: X-API-KEY
+//	        routes: ["POST /v1/upload"]
 //
 // ```
+//
+// All of the configs are applied by one middleware, each to its routes;
+// the configs without routes apply to every request, see ForGinConfigs.
 func LoadConfigForGin(keyPath string, rg Router) {
-	limiterConfigs := LoadConfig(keyPath)
-	for _, cfg := range limiterConfigs {
-		// if cfg.Enabled {
-		rg.Use(ForGin(&cfg))
-		// }
+	h, err := ForGinConfigs(LoadConfig(keyPath))
+	if err != nil {
+		logger.Errorf("bind '%v' failed: %v", keyPath, err)
+		return
 	}
+	rg.Use(h)
 }
@@ -6,10 +6,18 @@ package middleware
 import (
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/concurrency"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/multiwindow"
+	"github.com/hedzr/rate/pkg/logger"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/policy"
 	"github.com/hedzr/rate/rateapi"
 )
 
@@ -26,6 +34,112 @@ func ForGin(config *Config) gin.HandlerFunc {
 	return l.Middleware()
 }
 
+// ForGinFunc limits the requests with the limiters picked by pick, such as
+// the result of Routes or rateconfig.Set.Limit. See also ForHTTPFunc.
+func ForGinFunc(pick LimiterFunc) gin.HandlerFunc {
+	return forGinFuncs([]LimiterFunc{pick})
+}
+
+// forGinFuncs applies the limiters picked by each of picks in order, as
+// if each was a middleware of its own: a request passes if all of them
+// allow it.
+func forGinFuncs(picks []LimiterFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		for _, pick := range picks {
+			_, limiter, err := pick(ctx.Request)
+			if err != nil {
+				code := 2901
+				if errors.Is(err, policy.ErrDenied) {
+					code = 2902
+				}
+				ctx.AbortWithStatusJSON(403, gin.H{"code": code, "message": err.Error()})
+				return
+			}
+			if limiter == nil || !limiter.Enabled() {
+				continue
+			}
+			allowed := limiter.Take(1)
+			setLimitHeaders(ctx.Writer.Header(), limiter.Available(), limiter.Capacity())
+			if !allowed {
+				ctx.AbortWithError(429, errors.New("Too many requests"))
+				return
+			}
+			if sem, ok := rate.Unwrap(limiter).(rateapi.Semaphore); ok { // such as decorated by otelrate.Wrap
+				defer sem.Release(1) // held while the handlers are running
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// ForGinConfigs builds one gin.HandlerFunc applying each Config to its
+// Routes, the most specific route of a request wins. The Configs without
+// Routes apply to every request, one after another, as if each was
+// chained by gin.Use. The exception keys and the policies are applied, a
+// policy of action limit refers to another Config by name.
+func ForGinConfigs(configs []Config) (gin.HandlerFunc, error) {
+	var rls []RouteLimiter
+	for _, config := range configs {
+		config := config
+		policies, err := config.PolicyList()
+		if err != nil {
+			return nil, fmt.Errorf("rate-limit %q: %w", config.Name, err)
+		}
+		if config.Algorithm == "" {
+			config.Algorithm = string(rate.TokenBucket)
+		}
+		rls = append(rls, RouteLimiter{
+			Name:     config.Name,
+			Routes:   config.Routes,
+			KeyFunc:  HeaderKey(config.HeaderKeyName),
+			Policies: policies,
+			Limiters: keyed.New(func(key string) rateapi.Limiter {
+				return rate.New(rate.Algorithm(config.Algorithm), config.MaxRequests, config.Interval)
+			}),
+		})
+	}
+	byName := namesOf(rls)
+	var picks []LimiterFunc
+	var routed []RouteLimiter
+	for i := range rls {
+		if len(rls[i].Routes) > 0 {
+			routed = append(routed, rls[i])
+			continue
+		}
+		pick, err := routesOf(rls[i:i+1], byName) // validates the policies
+		if err != nil {
+			return nil, err
+		}
+		picks = append(picks, pick)
+	}
+	if len(routed) > 0 {
+		pick, err := routesOf(routed, byName)
+		if err != nil {
+			return nil, err
+		}
+		picks = append(picks, pick)
+	}
+	return forGinFuncs(picks), nil
+}
+
+// ForGinPlans limits each key taken from the header headerKeyName by the
+// limits of its plan, see package plan:
+//
+//	pl, err := plan.New(billing, plans, plan.WithFallback("free"))
+//	ginApp.Use(middleware.ForGinPlans("X-API-KEY", pl))
+//
+// Call pl.Refresh when the plan of a key changes.
+func ForGinPlans(headerKeyName string, limiters *plan.Limiters) gin.HandlerFunc {
+	keyFunc := HeaderKey(headerKeyName)
+	return ForGinFunc(func(r *http.Request) (string, rateapi.Limiter, error) {
+		key, err := keyFunc(r)
+		if err != nil {
+			return "", nil, err
+		}
+		return key, limiters.Get(key), nil
+	})
+}
+
 // Middleware interface
 type Middleware interface {
 	Middleware() gin.HandlerFunc
@@ -41,16 +155,56 @@ func NewLimiterForGin(interval time.Duration, capacity int64, keyGen KeygenFunc)
 		capacity,
 		keyGen,
 		limiters,
+		nil,
+	}
+}
+
+// NewMultiWindowLimiterForGin builds a limiter wrapper which applies all of
+// the windows to each key, such as 10/s, 300/min and 10000/day.
+//
+// The response headers describe the window which rejected the request,
+// or the one which has the least remains.
+func NewMultiWindowLimiterForGin(keyGen KeygenFunc, windows ...multiwindow.Window) Middleware {
+	return &exLimiter{
+		enabled:    true,
+		rateKeygen: keyGen,
+		limiters:   make(map[string]rateapi.Limiter),
+		newLimiter: func() rateapi.Limiter { return multiwindow.New(windows...) },
+	}
+}
+
+// ForGinConcurrency limits the in-flight requests with an adaptive
+// concurrency limiter, see also ConcurrencyForHTTP.
+func ForGinConcurrency(limiter concurrency.Limiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		release, err := limiter.Acquire(ctx.Request.Context())
+		setLimitHeaders(ctx.Writer.Header(), limiter.Available(), limiter.Capacity())
+		if err != nil {
+			ctx.AbortWithError(429, err)
+			return
+		}
+		defer func() { release(outcomeOf(ctx.Writer.Status(), ctx.Request)) }()
+		ctx.Next()
 	}
 }
 
 func (r *exLimiter) buildKeyFunc(config *Config) KeygenFunc {
+	policies, err := config.PolicyList()
+	if err != nil {
+		logger.Errorf("rate-limit %q: %v", config.Name, err)
+	} else if names := policies.Limits(); len(names) > 0 {
+		logger.Warnf("rate-limit %q: the policies of the limits %v need ForGinConfigs, they are ignored", config.Name, names)
+	}
 	return func(ctx *gin.Context) (string, error) {
 		key := ctx.Request.Header.Get(config.HeaderKeyName)
 		if key != "" {
-			for _, k := range config.ExceptionKeys {
-				if key == k {
-					return passedBucketName, ErrRateLimitPassed
+			if d, ok := policies.Lookup(key, policy.AddrOf(ctx.Request.RemoteAddr)); ok {
+				switch d.Action {
+				case policy.Unlimited:
+					return key, ErrRateLimitPassed
+				case policy.Deny:
+					ctx.JSON(403, gin.H{"code": 2902, "message": policy.ErrDenied.Error()})
+					return "", policy.ErrDenied
 				}
 			}
 			return key, nil
@@ -71,38 +225,47 @@ type exLimiter struct {
 	capacity   int64
 	rateKeygen KeygenFunc
 	limiters   map[string]rateapi.Limiter
+	newLimiter func() rateapi.Limiter // optional, overrides algorithm/d/capacity
 }
 
 func (r *exLimiter) get(ctx *gin.Context) (rateapi.Limiter, error) {
 	key, err := r.rateKeygen(ctx)
 
+	if err == ErrRateLimitPassed {
+		return nil, nil // not limited
+	}
 	if err != nil {
-		if err != ErrRateLimitPassed {
-			return nil, err
-		}
-		err, key = nil, passedBucketName
+		return nil, err
 	}
 
 	if limiter, existed := r.limiters[key]; existed {
 		return limiter, nil
 	}
 
-	if key == passedBucketName {
-		limiter := rate.New(rate.TokenBucket, int64(time.Minute/1000), time.Minute)
-		r.limiters[key] = limiter
-		return limiter, nil
+	var limiter rateapi.Limiter
+	if r.newLimiter != nil {
+		limiter = r.newLimiter()
+	} else {
+		limiter = rate.New(r.algorithmOf(), r.capacity, r.d)
 	}
-
-	limiter := rate.New(rate.TokenBucket, r.capacity, r.d)
 	r.limiters[key] = limiter
 	return limiter, nil
 }
 
+func (r *exLimiter) algorithmOf() rate.Algorithm {
+	if r.algorithm == "" {
+		return rate.TokenBucket
+	}
+	return rate.Algorithm(r.algorithm)
+}
+
 func (r *exLimiter) Middleware() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		limiter, err := r.get(ctx)
 		if err != nil {
 			ctx.AbortWithError(429, err)
+		} else if mw, ok := limiter.(multiwindow.Limiter); ok && mw.Enabled() {
+			r.decide(ctx, mw)
 		} else if limiter != nil && limiter.Enabled() {
 			if limiter.Take(1) {
 				ctx.Writer.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", limiter.Available()))
@@ -122,6 +285,19 @@ func (r *exLimiter) Middleware() gin.HandlerFunc {
 	}
 }
 
+func (r *exLimiter) decide(ctx *gin.Context, limiter multiwindow.Limiter) {
+	d := limiter.Decide(1)
+	ctx.Writer.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", d.Remaining))
+	ctx.Writer.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", d.Limit))
+	ctx.Writer.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", d.Reset.Unix()))
+	if d.Allowed {
+		ctx.Next()
+		return
+	}
+	ctx.Writer.Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(d.RetryAfter().Seconds()))))
+	ctx.AbortWithError(429, fmt.Errorf("Too many requests, the window %v exhausted", d.Window))
+}
+
 //func (r *exLimiter) getRL(ctx gin.Context) rateapi.exLimiter {
 //	if r.limiter == nil {
 //		r.limiter = leakybucket.New(100, time.Second, false)
@@ -154,7 +330,6 @@ func (r *exLimiter) Middleware() gin.HandlerFunc {
 //}
 
 // ErrRateLimitPassed identify a special state that an exception key was found.
-// The limiter shouldn't be applied to the request which has been tagged with the exception key.
+// The limiter shouldn't be applied to the request which has been tagged with the exception key,
+// a KeygenFunc returns it to let the request go unlimited.
 var ErrRateLimitPassed = errors.New("always passed up for exceptions")
-
-const passedBucketName = "exceptions-met"
@@ -0,0 +1,259 @@
+// Package middleware provides the middlewares for http servers such as net/http, gin, echo(to-do)...
+//
+// The net/http middlewares depend on the standard library only. The gin
+// ones are tagged with `ignore` to avoid the dependencies, you must copy
+// their codes to use them.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/concurrency"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/route"
+)
+
+// KeyFunc extracts the key of a request, such as an API key header or
+// the client address.
+type KeyFunc func(r *http.Request) (key string, err error)
+
+// HeaderKey returns a KeyFunc which takes the key from the header name
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if key := r.Header.Get(name); key != "" {
+			return key, nil
+		}
+		return "", fmt.Errorf("header key %q is missing", name)
+	}
+}
+
+// DecisionHook is called after the decision on a request, such as to
+// annotate the tracing span or to log it.
+type DecisionHook func(r *http.Request, key string, allowed bool)
+
+// HTTPOption configures the middleware built by ForHTTP
+type HTTPOption func(m *httpLimiter)
+
+// WithDecisionHook adds a hook called after each decision
+func WithDecisionHook(hook DecisionHook) HTTPOption {
+	return func(m *httpLimiter) { m.hooks = append(m.hooks, hook) }
+}
+
+type httpLimiter struct {
+	hooks []DecisionHook
+}
+
+// LimiterFunc picks the limiter of a request and its key, such as by the
+// route of the request. A nil limiter means the request is not limited.
+type LimiterFunc func(r *http.Request) (key string, limiter rateapi.Limiter, err error)
+
+// ForHTTP limits the requests to next per key, with the limiter of the
+// key in limiters.
+//
+// A request without key is answered with 403, a rejected one with 429.
+// The headers 'X-RateLimit-Remaining' and 'X-RateLimit-Limit' are set
+// on both of the allowed and rejected requests. If the limiter is, or
+// decorates, a rateapi.Semaphore, such as of semaphore.NewKeyed, the allow
+// is released when next returns.
+func ForHTTP(keyFunc KeyFunc, limiters *keyed.Limiters, next http.Handler, opts ...HTTPOption) http.Handler {
+	return ForHTTPFunc(func(r *http.Request) (string, rateapi.Limiter, error) {
+		key, err := keyFunc(r)
+		if err != nil {
+			return "", nil, err
+		}
+		return key, limiters.Get(key), nil
+	}, next, opts...)
+}
+
+// ForHTTPFunc limits the requests to next with the limiters picked by
+// pick, see also ForHTTP and Routes.
+func ForHTTPFunc(pick LimiterFunc, next http.Handler, opts ...HTTPOption) http.Handler {
+	m := &httpLimiter{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, limiter, err := pick(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if limiter == nil || !limiter.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := limiter.Take(1)
+		for _, hook := range m.hooks {
+			hook(r, key, allowed)
+		}
+		setLimitHeaders(w.Header(), limiter.Available(), limiter.Capacity())
+		if !allowed {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if sem, ok := rate.Unwrap(limiter).(rateapi.Semaphore); ok { // such as decorated by otelrate.Wrap
+			defer sem.Release(1) // held while next is running
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteLimiter scopes the limiters of the keys to some routes
+type RouteLimiter struct {
+	// Name is referred by the policies of action limit
+	Name string
+	// Routes are the patterns such as "POST /v1/upload" or "GET /v1/*",
+	// see package route. Empty means "/*", the least specific one.
+	Routes []string
+	// Priority breaks the tie between the routes of the same path
+	Priority int
+	// KeyFunc and Limiters are required, Routes fails without them
+	KeyFunc  KeyFunc
+	Limiters *keyed.Limiters
+	// Policies are optional, a request denied by them is answered with
+	// 403, one of action limit is limited by the Limiters of the
+	// RouteLimiter named by the policy.
+	Policies *policy.List
+}
+
+// Routes compiles the route limiters into a LimiterFunc, which picks the
+// limiter of the most specific route of a request:
+//
+//	pick, err := middleware.Routes([]middleware.RouteLimiter{
+//		{Routes: []string{"POST /v1/upload"}, KeyFunc: byKey, Limiters: uploads},
+//		{Routes: []string{"GET /v1/*"}, KeyFunc: byKey, Limiters: reads},
+//	})
+//	h := middleware.ForHTTPFunc(pick, mux)
+//
+// The requests matching no route are not limited. Two route limiters of
+// the same pattern and priority are an error, only one of them would
+// ever apply.
+func Routes(rls []RouteLimiter) (LimiterFunc, error) {
+	rls = append([]RouteLimiter(nil), rls...)
+	return routesOf(rls, namesOf(rls))
+}
+
+// namesOf indexes the named route limiters, for the policies of action limit
+func namesOf(rls []RouteLimiter) map[string]*RouteLimiter {
+	byName := make(map[string]*RouteLimiter)
+	for i := range rls {
+		if rls[i].Name != "" {
+			byName[rls[i].Name] = &rls[i]
+		}
+	}
+	return byName
+}
+
+// routesOf compiles rls, whose policies refer to the limiters in byName
+func routesOf(rls []RouteLimiter, byName map[string]*RouteLimiter) (LimiterFunc, error) {
+	type slot struct {
+		pattern  string
+		priority int
+	}
+	m, seen := route.New(), make(map[slot]*RouteLimiter)
+	for i := range rls {
+		if rls[i].KeyFunc == nil || rls[i].Limiters == nil {
+			return nil, fmt.Errorf("route limiter %q: the KeyFunc and the Limiters are required", rls[i].Name)
+		}
+		for _, name := range rls[i].Policies.Limits() {
+			if byName[name] == nil {
+				return nil, fmt.Errorf("policy refers to the unknown limiter %q", name)
+			}
+		}
+		patterns := rls[i].Routes
+		if len(patterns) == 0 {
+			patterns = []string{"/*"}
+		}
+		for _, pattern := range patterns {
+			if rl := seen[slot{pattern, rls[i].Priority}]; rl != nil {
+				return nil, fmt.Errorf("route %q of priority %d is of both %q and %q, the latter would never apply", pattern, rls[i].Priority, rl.Name, rls[i].Name)
+			}
+			seen[slot{pattern, rls[i].Priority}] = &rls[i]
+			if err := m.Add(route.Route{Pattern: pattern, Priority: rls[i].Priority, Value: &rls[i]}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return func(r *http.Request) (string, rateapi.Limiter, error) {
+		rt, ok := m.Match(r.Method, r.URL.Path)
+		if !ok {
+			return "", nil, nil
+		}
+		return rt.Value.(*RouteLimiter).pick(r, byName)
+	}, nil
+}
+
+// pick returns the limiter of the key of r, after the policies
+func (rl *RouteLimiter) pick(r *http.Request, byName map[string]*RouteLimiter) (string, rateapi.Limiter, error) {
+	key, err := rl.KeyFunc(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if d, ok := rl.Policies.Lookup(key, policy.AddrOf(r.RemoteAddr)); ok {
+		switch d.Action {
+		case policy.Unlimited:
+			return key, nil, nil
+		case policy.Deny:
+			return key, nil, policy.ErrDenied
+		case policy.Limit:
+			rl = byName[d.Limit]
+		}
+	}
+	return key, rl.Limiters.Get(key), nil
+}
+
+// ConcurrencyForHTTP limits the in-flight requests to next with an adaptive
+// concurrency limiter.
+//
+// A request waits for a free slot until its context is done. The slot is
+// released when next returns, a response with status 5xx or 429 is
+// reported to the limiter as a drop so the limit backs off.
+func ConcurrencyForHTTP(limiter concurrency.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := limiter.Acquire(r.Context())
+		setLimitHeaders(w.Header(), limiter.Available(), limiter.Capacity())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Too many requests: %v", err), http.StatusTooManyRequests)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() { release(outcomeOf(rec.status, r)) }()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func outcomeOf(status int, r *http.Request) concurrency.Outcome {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		return concurrency.Ignored
+	}
+	if status >= 500 || status == http.StatusTooManyRequests {
+		return concurrency.Dropped
+	}
+	return concurrency.Success
+}
+
+func setLimitHeaders(h http.Header, remaining, limit int64) {
+	h.Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+	h.Set("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
+}
+
+// statusRecorder captures the status code written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
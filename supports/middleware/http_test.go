@@ -0,0 +1,246 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/concurrency"
+	"github.com/hedzr/rate/keyed"
+	"github.com/hedzr/rate/policy"
+	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/semaphore"
+	"github.com/hedzr/rate/supports/middleware"
+)
+
+func TestConcurrencyForHTTP(t *testing.T) {
+	l := concurrency.New(&concurrency.AIMD{Initial: 4, MaxLimit: 4})
+	defer l.Close()
+
+	failing := true
+	h := middleware.ConcurrencyForHTTP(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.InFlight() != 1 {
+			t.Errorf("the request should hold a slot, in-flight: %v", l.InFlight())
+		}
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-RateLimit-Limit") != "4" {
+		t.Fatalf("unexpected response: %v, %v", rec.Code, rec.Header())
+	}
+	if l.InFlight() != 0 || l.Limit() != 3 {
+		t.Fatalf("a 503 should be reported as a drop, limit: %v", l.Limit())
+	}
+
+	failing = false
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %v", rec.Code)
+	}
+
+	var held []concurrency.ReleaseFunc
+	for release, ok := l.TryAcquire(); ok; release, ok = l.TryAcquire() {
+		held = append(held, release)
+	}
+	defer func() {
+		for _, release := range held {
+			release(concurrency.Ignored)
+		}
+	}()
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expecting 429 while the limiter is full, got %v", rec.Code)
+	}
+}
+
+func TestForHTTP(t *testing.T) {
+	limiters := keyed.New(func(key string) rateapi.Limiter { return rate.New(rate.Counter, 1, time.Minute) })
+	defer limiters.Close()
+	var decisions []bool
+	h := middleware.ForHTTP(middleware.HeaderKey("X-API-KEY"), limiters, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		middleware.WithDecisionHook(func(r *http.Request, key string, allowed bool) { decisions = append(decisions, allowed) }))
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if key != "" {
+			req.Header.Set("X-API-KEY", key)
+		}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("k1"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("unexpected response: %v, %v", rec.Code, rec.Header())
+	}
+	if rec := serve("k1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("the 2nd request should be rejected, got %v", rec.Code)
+	}
+	if rec := serve("k2"); rec.Code != http.StatusOK {
+		t.Fatalf("the keys should be independent, got %v", rec.Code)
+	}
+	if rec := serve(""); rec.Code != http.StatusForbidden {
+		t.Fatalf("a request without key should be forbidden, got %v", rec.Code)
+	}
+	if len(decisions) != 3 || !decisions[0] || decisions[1] || !decisions[2] {
+		t.Fatalf("unexpected decisions %v", decisions)
+	}
+}
+
+func TestSemaphoreForHTTP(t *testing.T) {
+	sems := semaphore.NewKeyed(1)
+	defer sems.Close()
+	entered, leave := make(chan struct{}), make(chan struct{})
+	h := middleware.ForHTTP(middleware.HeaderKey("X-API-KEY"), sems, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-leave
+	}))
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-KEY", "k")
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	codes := make(chan int)
+	go func() { codes <- serve() }()
+	<-entered
+	go func() { codes <- serve() }()
+	if code := <-codes; code != http.StatusTooManyRequests {
+		t.Fatalf("the 2nd request should be rejected while the 1st is running, got %v", code)
+	}
+	close(leave)
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("unexpected response %v", code)
+	}
+	if sems.Get("k").Available() != 1 {
+		t.Fatal("the allow should be released when the handler returned")
+	}
+	go func() { <-entered }()
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("expecting the next request allowed, got %v", code)
+	}
+}
+
+func TestWrappedSemaphore(t *testing.T) {
+	// a decorator promoting only the methods of rateapi.Limiter
+	_ = rate.Register("semaphore", func(maxCount int64, d time.Duration) rateapi.Limiter { return semaphore.New(maxCount) })
+	defer rate.Unregister("semaphore")
+	sems := keyed.New(func(key string) rateapi.Limiter {
+		return rate.New("semaphore", 1, time.Second, rate.WithName("exports"))
+	})
+	defer sems.Close()
+	h := middleware.ForHTTP(middleware.HeaderKey("X-API-KEY"), sems, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-KEY", "k")
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("the allow of the wrapped semaphore should be released, got %v", rec.Code)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	newLimiters := func(maxCount int64) *keyed.Limiters {
+		return keyed.New(func(key string) rateapi.Limiter { return rate.New(rate.Counter, maxCount, time.Minute) })
+	}
+	pick, err := middleware.Routes([]middleware.RouteLimiter{
+		{Routes: []string{"POST /v1/upload"}, KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1)},
+		{Routes: []string{"GET /v1/*"}, KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := middleware.ForHTTPFunc(pick, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-KEY", "k1")
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("POST", "/v1/upload"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("unexpected response: %v, %v", rec.Code, rec.Header())
+	}
+	if rec := serve("POST", "/v1/upload"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("the second upload should be rejected, got %v", rec.Code)
+	}
+	if rec := serve("GET", "/v1/users"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "3" {
+		t.Fatalf("the reads should have their own limit, got %v, %v", rec.Code, rec.Header())
+	}
+	if rec := serve("DELETE", "/v1/users"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatal("a request matching no route should not be limited")
+	}
+	if _, err = middleware.Routes([]middleware.RouteLimiter{{Routes: []string{"/v1/*"}, Limiters: newLimiters(1)}}); err == nil {
+		t.Fatal("a route limiter without KeyFunc should be rejected")
+	}
+	if _, err = middleware.Routes([]middleware.RouteLimiter{{Routes: []string{"/v1/*"}, KeyFunc: middleware.HeaderKey("X-API-KEY")}}); err == nil {
+		t.Fatal("a route limiter without Limiters should be rejected")
+	}
+	if _, err = middleware.Routes([]middleware.RouteLimiter{{Routes: []string{"v1"}, KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1)}}); err == nil {
+		t.Fatal("a bad pattern should be rejected")
+	}
+	if _, err = middleware.Routes([]middleware.RouteLimiter{
+		{Name: "a", KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1)},
+		{Name: "b", KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1)},
+	}); err == nil {
+		t.Fatal("two route limiters of the same pattern should be rejected")
+	}
+}
+
+func TestRoutePolicies(t *testing.T) {
+	policies, err := policy.Compile([]policy.Rule{
+		{Key: "internal"},
+		{Key: "abuser", Action: "deny"},
+		{Prefix: "partner-", Limit: "partners"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLimiters := func(maxCount int64) *keyed.Limiters {
+		return keyed.New(func(key string) rateapi.Limiter { return rate.New(rate.Counter, maxCount, time.Minute) })
+	}
+	pick, err := middleware.Routes([]middleware.RouteLimiter{
+		{Name: "api", KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1), Policies: policies},
+		{Name: "partners", Routes: []string{"/partners/*"}, KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := middleware.ForHTTPFunc(pick, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/users", nil)
+		req.Header.Set("X-API-KEY", key)
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("internal"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatal("an unlimited key should not be limited")
+	}
+	if rec := serve("abuser"); rec.Code != http.StatusForbidden {
+		t.Fatalf("a denied key should be rejected with 403, got %v", rec.Code)
+	}
+	if rec := serve("partner-acme"); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Fatalf("a partner should be on the partners limit, got %v", rec.Header())
+	}
+
+	if _, err = middleware.Routes([]middleware.RouteLimiter{{Name: "api", KeyFunc: middleware.HeaderKey("X-API-KEY"), Limiters: newLimiters(1), Policies: policies}}); err == nil {
+		t.Fatal("a policy referring to an unknown limiter should be rejected")
+	}
+}
@@ -2,98 +2,139 @@
 package tokenbucket
 
 import (
-	"sync/atomic"
 	"time"
 
 	"github.com/hedzr/rate/pkg/logger"
 	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 )
 
-// New make a new instance of limiter
+// name is the name of the algorithm in the snapshots, the same as rate.TokenBucket
+const name = "token-bucket"
+
+// New make a new instance of limiter. It is the algorithm of NewAlgorithm
+// on a private in-memory store, so that the tokens are built lazily from
+// the elapsed time rather than by a looper goroutine.
 func New(maxCount int64, d time.Duration) rateapi.Limiter {
-	return (&tokenBucket{
-		true,
-		int32(maxCount),
-		d,
-		int64(d) / int64(maxCount),
-		make(chan struct{}),
-		int32(maxCount),
-	}).start(d)
+	if !valid(maxCount, d) {
+		return nil
+	}
+	m := store.NewMemory()
+	alg := algorithm{maxCount, int64(d) / maxCount}
+	return &tokenBucket{store.NewLimiter(m, name, alg), m, alg}
 }
 
-type tokenBucket struct {
-	enabled bool
-	Maximal int32
-	period  time.Duration
-	rate    int64
-	exitCh  chan struct{}
-	count   int32
+// NewWithStore make a new instance of limiter whose state of key lives in s
+func NewWithStore(maxCount int64, d time.Duration, s store.Store, key string) rateapi.Limiter {
+	if alg := NewAlgorithm(maxCount, d); alg != nil {
+		return store.NewLimiter(s, key, alg)
+	}
+	return nil
 }
 
-func (s *tokenBucket) Enabled() bool     { return s.enabled }
-func (s *tokenBucket) SetEnabled(b bool) { s.enabled = b }
-func (s *tokenBucket) Count() int32      { return atomic.LoadInt32(&s.count) }
-func (s *tokenBucket) Available() int64  { return int64(atomic.LoadInt32(&s.count)) }
-func (s *tokenBucket) Capacity() int64   { return int64(s.Maximal) }
-
-func (s *tokenBucket) Close() {
-	close(s.exitCh)
+// valid checks the arguments of New and NewAlgorithm, a token is built
+// every d/maxCount
+func valid(maxCount int64, d time.Duration) bool {
+	if maxCount < 1 {
+		logger.Errorf("the maxCount must be positive, it's %v", maxCount)
+		return false
+	}
+	if rate := int64(d) / maxCount; rate < 1000 {
+		logger.Errorf("the rate cannot be less than 1000us, it's %v", rate)
+		return false
+	}
+	return true
 }
 
-func (s *tokenBucket) start(d time.Duration) *tokenBucket {
-	if s.rate < 1000 {
-		logger.Errorf("the rate cannot be less than 1000us, it's %v", s.rate)
+// NewAlgorithm returns the token-bucket algorithm for store.NewLimiter.
+//
+// There is no looper to build the tokens, the bucket is refilled lazily
+// from the elapsed time. The state Count is the tokens, Stamp is the time
+// the last token was built. It returns nil for the arguments New rejects.
+func NewAlgorithm(maxCount int64, d time.Duration) store.Algorithm {
+	if !valid(maxCount, d) {
 		return nil
 	}
+	return algorithm{maxCount, int64(d) / maxCount}
+}
 
-	go s.looper(d)
-	return s
+type algorithm struct {
+	maximal int64
+	rate    int64
 }
 
-func (s *tokenBucket) looper(d time.Duration) {
-	ticker := time.NewTicker(d / time.Duration(s.Maximal))
-	// fmt.Printf("token building spped is: 1req/%v\n", d/time.Duration(s.Maximal))
-	defer func() {
-		ticker.Stop()
-	}()
-	for {
-		select {
-		case <-s.exitCh:
-			return
-		case <-ticker.C:
-			vn := atomic.AddInt32(&s.count, 1)
-			if vn < s.Maximal {
-				continue
-			}
-
-			vn %= s.Maximal
-			if vn > 0 {
-				atomic.StoreInt32(&s.count, s.Maximal)
-			}
-		}
+func (a algorithm) Capacity() int64 { return a.maximal }
+func (a algorithm) String() string  { return name }
+
+func (a algorithm) refill(st store.State, exists bool, now int64) store.State {
+	if !exists {
+		return store.State{Count: a.maximal, Stamp: now}
 	}
+	if n := (now - st.Stamp) / a.rate; n > 0 {
+		st.Count += n
+		st.Stamp += n * a.rate
+	}
+	if st.Count >= a.maximal {
+		st.Count, st.Stamp = a.maximal, now
+	}
+	return st
 }
 
-func (s *tokenBucket) take(count int) bool {
-	if vn := atomic.AddInt32(&s.count, -1*int32(count)); vn >= 0 {
-		return true
+func (a algorithm) Decide(st store.State, exists bool, now int64, count int) (store.State, bool, time.Duration) {
+	st = a.refill(st, exists, now)
+	if st.Count >= int64(count) {
+		st.Count -= int64(count)
+		return st, true, 0
 	}
-	atomic.StoreInt32(&s.count, 0)
-	return false
+	return st, false, time.Duration((int64(count)-st.Count)*a.rate - (now - st.Stamp))
 }
 
-func (s *tokenBucket) Take(count int) bool {
-	ok := s.take(count)
-	return ok
+func (a algorithm) Available(st store.State, exists bool, now int64) int64 {
+	return a.refill(st, exists, now).Count
 }
 
-func (s *tokenBucket) TakeBlocked(count int) (requestAt time.Time) {
-	requestAt = time.Now().UTC()
-	ok := s.take(count)
-	for !ok {
-		time.Sleep(time.Duration(s.rate - (1000 - 1)))
-		ok = s.take(count)
+func (a algorithm) Reset(st store.State, exists bool, now int64) time.Duration {
+	st = a.refill(st, exists, now)
+	if st.Count >= a.maximal {
+		return 0
 	}
-	// time.Sleep(time.Duration(s.rate-int64(time.Now().Sub(requestAt))) - time.Millisecond)
+	return time.Duration((a.maximal-st.Count)*a.rate - (now - st.Stamp))
+}
+
+// tokenBucket is a store limiter on a private in-memory store, it adds
+// TakeAbove for the priority limiters.
+type tokenBucket struct {
+	rateapi.Limiter
+	state *store.Memory
+	alg   algorithm
+}
+
+// Count returns the tokens available
+func (s *tokenBucket) Count() int32 { return int32(s.Available()) }
+
+// Snapshot implements rateapi.Snapshotter, the stamp of the state is the
+// time the last token was built, so the tokens built while down are added
+// on restore.
+func (s *tokenBucket) Snapshot() ([]byte, error) {
+	return s.Limiter.(rateapi.Snapshotter).Snapshot()
+}
+
+// Restore implements rateapi.Snapshotter
+func (s *tokenBucket) Restore(data []byte) error {
+	return s.Limiter.(rateapi.Snapshotter).Restore(data)
+}
+
+// TakeAbove assigns count of allows only if reserve tokens at least are
+// still available after taking, it's the building block of the priority
+// limiters.
+func (s *tokenBucket) TakeAbove(count int, reserve int64) (ok bool) {
+	now := time.Now().UnixNano()
+	_, _ = s.state.Update(name, func(st store.State, exists bool) store.State {
+		st = s.alg.refill(st, exists, now)
+		if ok = st.Count-int64(count) >= reserve; ok {
+			st.Count -= int64(count)
+		}
+		return st
+	})
 	return
 }
@@ -10,6 +10,7 @@ import (
 
 	"github.com/hedzr/rate/internal/randomizer"
 	"github.com/hedzr/rate/rateapi"
+	"github.com/hedzr/rate/store"
 	"github.com/hedzr/rate/tokenbucket"
 )
 
@@ -97,3 +98,57 @@ func safeRandNumber(rand randomizer.Randomizer, min, max int) int {
 }
 
 var mu sync.Mutex
+
+func TestTokenBucketAlgorithm(t *testing.T) {
+	a := tokenbucket.NewAlgorithm(10, time.Second) // one token per 100ms
+	now := time.Now().UnixNano()
+	st, ok, _ := a.Decide(store.State{}, false, now, 10)
+	if !ok || st.Count != 0 {
+		t.Fatalf("a new bucket should be full, got %+v", st)
+	}
+	if _, ok, wait := a.Decide(st, true, now+int64(50*time.Millisecond), 1); ok || wait != 50*time.Millisecond {
+		t.Fatalf("expecting to wait 50ms for the next token, got %v", wait)
+	}
+	st, ok, _ = a.Decide(st, true, now+int64(250*time.Millisecond), 2)
+	if !ok || st.Count != 0 || st.Stamp != now+int64(200*time.Millisecond) {
+		t.Fatalf("two tokens should be refilled and the remainder kept, got %+v", st)
+	}
+	if n := a.Available(st, true, now+int64(time.Hour)); n != 10 {
+		t.Fatalf("the bucket should be full again, got %v", n)
+	}
+}
+
+func TestTokenBucketWithStore(t *testing.T) {
+	l := tokenbucket.NewWithStore(100, time.Second, store.NewMemory(), "k")
+	prev := time.Now()
+	for i := 0; i < 105; i++ {
+		l.TakeBlocked(1)
+	}
+	if elapsed := time.Since(prev); elapsed < 40*time.Millisecond {
+		t.Fatalf("the last 5 takes should wait for the refilling, elapsed %v", elapsed)
+	}
+}
+
+func TestTokenBucketSnapshot(t *testing.T) {
+	l := tokenbucket.New(10, time.Hour)
+	defer l.Close()
+	l.Take(10)
+	data, err := l.(rateapi.Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2 := tokenbucket.New(10, time.Hour)
+	defer l2.Close()
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil || l2.Available() != 0 {
+		t.Fatalf("expecting the empty bucket restored, got %v, %v", l2.Available(), err)
+	}
+
+	// 30 minutes of downtime refill 5 tokens
+	data = store.MarshalStates("token-bucket", store.State{Count: 2, Stamp: time.Now().Add(-30 * time.Minute).UnixNano()})
+	if err = l2.(rateapi.Snapshotter).Restore(data); err != nil || l2.Available() != 7 {
+		t.Fatalf("expecting the downtime credited, got %v, %v", l2.Available(), err)
+	}
+	if err = l2.(rateapi.Snapshotter).Restore(data[:3]); err == nil {
+		t.Fatal("expecting a bad snapshot")
+	}
+}
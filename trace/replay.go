@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/store"
+)
+
+// KeyReport is how many requests of a key each candidate rejected
+type KeyReport struct {
+	Key      string
+	Requests int
+	Rejected []int // by the candidates, in their order
+}
+
+// Report is the outcome of Replay
+type Report struct {
+	Candidates []string
+	Keys       []KeyReport // the most requests first
+	Requests   int
+	Rejected   []int // by the candidates, of all keys
+	Start, End time.Time
+}
+
+// Replay feeds the events through a limiter per key of each candidate, on
+// a clock simulated by the times of the events, so that a trace of days
+// is replayed in seconds. The events should be sorted by time, such as
+// the result of ReadAll, they are sorted if not.
+//
+// The algorithms of the candidates must run on a store, see
+// rate.NewAlgorithm.
+func Replay(events []Event, candidates []plan.Plan) (*Report, error) {
+	algs := make([]store.Algorithm, len(candidates))
+	rep := &Report{Requests: len(events), Rejected: make([]int, len(candidates))}
+	for i, c := range candidates {
+		if c.MaxCount < 1 || c.Period <= 0 {
+			return nil, fmt.Errorf("candidate %q: the max count and the period must be positive", c.Name)
+		}
+		if algs[i] = rate.NewAlgorithm(c.Algorithm, c.MaxCount, c.Period); algs[i] == nil {
+			return nil, fmt.Errorf("candidate %q: algorithm %q cannot run on a store", c.Name, c.Algorithm)
+		}
+		rep.Candidates = append(rep.Candidates, c.Name)
+	}
+	if !sort.SliceIsSorted(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) }) {
+		events = append([]Event(nil), events...)
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	}
+	if len(events) > 0 {
+		rep.Start, rep.End = events[0].Time, events[len(events)-1].Time
+	}
+
+	states := store.NewMemory()
+	byKey := make(map[string]*KeyReport)
+	for _, ev := range events {
+		kr := byKey[ev.Key]
+		if kr == nil {
+			kr = &KeyReport{Key: ev.Key, Rejected: make([]int, len(candidates))}
+			byKey[ev.Key] = kr
+		}
+		kr.Requests++
+		now := ev.Time.UnixNano()
+		for i, alg := range algs {
+			var ok bool
+			_, _ = states.Update(strconv.Itoa(i)+"|"+ev.Key, func(st store.State, exists bool) (next store.State) {
+				next, ok, _ = alg.Decide(st, exists, now, 1)
+				return
+			})
+			if !ok {
+				kr.Rejected[i]++
+				rep.Rejected[i]++
+			}
+		}
+	}
+
+	for _, kr := range byKey {
+		rep.Keys = append(rep.Keys, *kr)
+	}
+	sort.Slice(rep.Keys, func(i, j int) bool {
+		a, b := &rep.Keys[i], &rep.Keys[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Key < b.Key
+	})
+	return rep, nil
+}
+
+// WriteText writes the top keys of the most requests and the totals as a
+// table, all keys if top is not positive.
+func (rep *Report) WriteText(w io.Writer, top int) error {
+	keys := rep.Keys
+	if top > 0 && top < len(keys) {
+		keys = keys[:top]
+	}
+	width := len("total")
+	for _, kr := range keys {
+		if len(kr.Key) > width {
+			width = len(kr.Key)
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d requests of %d keys in %v\n\n", rep.Requests, len(rep.Keys), rep.End.Sub(rep.Start))
+	fmt.Fprintf(&sb, "%-*s %9s", width, "key", "requests")
+	for _, c := range rep.Candidates {
+		fmt.Fprintf(&sb, " %18s", c)
+	}
+	sb.WriteString("\n")
+	row := func(key string, requests int, rejected []int) {
+		fmt.Fprintf(&sb, "%-*s %9d", width, key, requests)
+		for _, n := range rejected {
+			fmt.Fprintf(&sb, " %18s", fmt.Sprintf("%d (%.1f%%)", n, 100*float64(n)/float64(requests)))
+		}
+		sb.WriteString("\n")
+	}
+	for _, kr := range keys {
+		row(kr.Key, kr.Requests, kr.Rejected)
+	}
+	if rep.Requests > 0 {
+		row("total", rep.Requests, rep.Rejected)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteCSV writes a row of the rejections per key, the header is "key",
+// "requests" and the names of the candidates.
+func (rep *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write(append([]string{"key", "requests"}, rep.Candidates...))
+	for _, kr := range rep.Keys {
+		rec := []string{kr.Key, strconv.Itoa(kr.Requests)}
+		for _, n := range kr.Rejected {
+			rec = append(rec, strconv.Itoa(n))
+		}
+		_ = cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
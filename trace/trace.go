@@ -0,0 +1,258 @@
+// Package trace reads the access logs into the time-ordered requests, and
+// replays them against the candidate limits to tell how many requests of
+// each key they would have rejected:
+//
+//	events, err := trace.ReadAll(f, trace.Nginx)
+//	if err != nil {
+//		return err
+//	}
+//	report, err := trace.Replay(events, []plan.Plan{
+//		{Name: "100/min", Algorithm: rate.TokenBucket, MaxCount: 100, Period: time.Minute},
+//		{Name: "1000/h", Algorithm: rate.Counter, MaxCount: 1000, Period: time.Hour},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return report.WriteText(os.Stdout, 20)
+//
+// The formats are the combined log of nginx (and Apache), and the JSON
+// lines with a timestamp and a key.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the format of an access log
+type Format string
+
+const (
+	// Nginx is the combined log format of nginx and Apache:
+	//
+	//	$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"
+	//
+	// Its fields are remote_addr, remote_user, method, path, status,
+	// referer and user_agent, the key is remote_addr by default.
+	Nginx Format = "nginx"
+	// JSONLines is a JSON object per line. The time is a string in RFC
+	// 3339 or in the time_local of nginx, or a number of the unix seconds
+	// (or milliseconds if it is greater than 1e12). The fields are found
+	// by their names or the dotted paths such as "request.key".
+	JSONLines Format = "jsonl"
+)
+
+// Event is a request in an access log
+type Event struct {
+	Time time.Time
+	Key  string
+}
+
+// Option configures a Reader
+type Option func(r *Reader)
+
+// WithKeyField sets the field of the key, default is "remote_addr" for
+// Nginx and "key" for JSONLines.
+func WithKeyField(name string) Option {
+	return func(r *Reader) { r.keyField = name }
+}
+
+// WithTimeField sets the field of the time of JSONLines, default is the
+// first found of "time", "timestamp", "ts" and "@timestamp".
+func WithTimeField(name string) Option {
+	return func(r *Reader) { r.timeFields = []string{name} }
+}
+
+// WithLenient skips the lines which cannot be parsed rather than failing,
+// see Reader.Skipped.
+func WithLenient() Option {
+	return func(r *Reader) { r.lenient = true }
+}
+
+// Reader reads the events of an access log in the order of the lines
+type Reader struct {
+	sc         *bufio.Scanner
+	format     Format
+	keyField   string
+	timeFields []string
+	lenient    bool
+	line       int
+	skipped    int
+}
+
+// NewReader returns a Reader of r in format
+func NewReader(r io.Reader, format Format, opts ...Option) (*Reader, error) {
+	tr := &Reader{sc: bufio.NewScanner(r), format: format}
+	tr.sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	switch format {
+	case Nginx:
+		tr.keyField = "remote_addr"
+	case JSONLines:
+		tr.keyField = "key"
+		tr.timeFields = []string{"time", "timestamp", "ts", "@timestamp"}
+	default:
+		return nil, fmt.Errorf("unknown format %q, should be nginx or jsonl", format)
+	}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	if format == Nginx && nginxFields[tr.keyField] == 0 {
+		return nil, fmt.Errorf("unknown field %q of nginx", tr.keyField)
+	}
+	return tr, nil
+}
+
+// Next returns the next event, or io.EOF at the end
+func (r *Reader) Next() (ev Event, err error) {
+	for r.sc.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.sc.Text())
+		if line == "" {
+			continue
+		}
+		if r.format == Nginx {
+			ev, err = r.parseNginx(line)
+		} else {
+			ev, err = r.parseJSON(line)
+		}
+		if err == nil {
+			return
+		}
+		if !r.lenient {
+			return ev, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		r.skipped++
+	}
+	if err = r.sc.Err(); err == nil {
+		err = io.EOF
+	}
+	return
+}
+
+// Skipped returns the count of the lines skipped by WithLenient
+func (r *Reader) Skipped() int { return r.skipped }
+
+// ReadAll reads all events of r and sorts them by time, the events of the
+// same time keep their order.
+func ReadAll(r io.Reader, format Format, opts ...Option) ([]Event, error) {
+	tr, err := NewReader(r, format, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for {
+		ev, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// nginxLine matches the combined log format
+var nginxLine = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) \S+ "([^"]*)" "([^"]*)"`)
+
+// nginxFields are the submatch indexes of nginxLine
+var nginxFields = map[string]int{"remote_addr": 1, "remote_user": 2, "method": 4, "path": 5, "status": 6, "referer": 7, "user_agent": 8}
+
+// timeLocal is the layout of $time_local
+const timeLocal = "02/Jan/2006:15:04:05 -0700"
+
+func (r *Reader) parseNginx(line string) (ev Event, err error) {
+	m := nginxLine.FindStringSubmatch(line)
+	if m == nil {
+		return ev, errors.New("not in the combined log format")
+	}
+	if ev.Time, err = time.Parse(timeLocal, m[3]); err != nil {
+		return
+	}
+	ev.Key = m[nginxFields[r.keyField]]
+	return
+}
+
+func (r *Reader) parseJSON(line string) (ev Event, err error) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	if err = d.Decode(&obj); err != nil {
+		return
+	}
+	for _, name := range r.timeFields {
+		if v, ok := lookup(obj, name); ok {
+			ev.Time, err = timeOf(v)
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		return ev, fmt.Errorf("no time field %v", strings.Join(r.timeFields, ", "))
+	}
+	v, ok := lookup(obj, r.keyField)
+	if !ok {
+		return ev, fmt.Errorf("no key field %q", r.keyField)
+	}
+	if s, ok := v.(string); ok {
+		ev.Key = s
+	} else {
+		ev.Key = fmt.Sprint(v)
+	}
+	return
+}
+
+// lookup finds the field by its name, or its dotted path
+func lookup(obj map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for {
+		head, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			v, found := obj[name]
+			return v, found
+		}
+		if obj, ok = obj[head].(map[string]interface{}); !ok {
+			return nil, false
+		}
+		name = rest
+	}
+}
+
+func timeOf(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case string:
+		if tm, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return tm, nil
+		}
+		if tm, err := time.Parse(timeLocal, t); err == nil {
+			return tm, nil
+		}
+		return time.Time{}, fmt.Errorf("time %q is neither in RFC 3339 nor in time_local", t)
+	case json.Number:
+		f, err := strconv.ParseFloat(string(t), 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if f > 1e12 {
+			f /= 1e3
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("time %v is neither a string nor a number", v)
+}
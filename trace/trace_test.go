@@ -0,0 +1,128 @@
+package trace_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/rate"
+	"github.com/hedzr/rate/plan"
+	"github.com/hedzr/rate/trace"
+)
+
+const nginxLog = `192.0.2.1 - alice [10/Oct/2026:13:55:36 +0000] "GET /v1/users HTTP/1.1" 200 2326 "-" "curl/8.0"
+192.0.2.2 - - [10/Oct/2026:13:55:35 +0000] "POST /v1/upload HTTP/1.1" 201 0 "https://example.com/" "Mozilla/5.0 (X11)"
+
+192.0.2.1 - alice [10/Oct/2026:13:55:36 +0000] "GET /v1/users/1 HTTP/1.1" 404 12 "-" "curl/8.0"
+`
+
+func TestNginx(t *testing.T) {
+	events, err := trace.ReadAll(strings.NewReader(nginxLog), trace.Nginx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Key != "192.0.2.2" || events[1].Key != "192.0.2.1" {
+		t.Fatalf("expecting the events sorted by time, got %v", events)
+	}
+	if want := time.Date(2026, 10, 10, 13, 55, 35, 0, time.UTC); !events[0].Time.Equal(want) {
+		t.Fatalf("expecting %v, got %v", want, events[0].Time)
+	}
+
+	events, err = trace.ReadAll(strings.NewReader(nginxLog), trace.Nginx, trace.WithKeyField("path"))
+	if err != nil || events[0].Key != "/v1/upload" {
+		t.Fatalf("expecting the path as the key, got %v, %v", events, err)
+	}
+	if _, err = trace.NewReader(strings.NewReader(""), trace.Nginx, trace.WithKeyField("cookie")); err == nil {
+		t.Fatal("expecting an unknown field rejected")
+	}
+
+	_, err = trace.ReadAll(strings.NewReader(nginxLog+"garbage\n"), trace.Nginx)
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Fatalf("expecting the bad line reported, got %v", err)
+	}
+	r, _ := trace.NewReader(strings.NewReader(nginxLog+"garbage\n"), trace.Nginx, trace.WithLenient())
+	n := 0
+	for _, err = r.Next(); err == nil; _, err = r.Next() {
+		n++
+	}
+	if n != 3 || r.Skipped() != 1 {
+		t.Fatalf("expecting 3 events and 1 skipped, got %v and %v", n, r.Skipped())
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	log := `{"time":"2026-10-10T13:55:36.5Z","key":"k1"}
+{"ts":1791640535.25,"key":"k2"}
+{"timestamp":1791640537000,"key":7}
+{"@timestamp":"10/Oct/2026:13:55:38 +0000","key":"k1"}
+`
+	events, err := trace.ReadAll(strings.NewReader(log), trace.JSONLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ""
+	for _, ev := range events {
+		keys += ev.Key + " "
+	}
+	if keys != "k2 k1 7 k1 " {
+		t.Fatalf("expecting the events sorted by time, got %v", keys)
+	}
+	if want := time.Unix(1791640535, 250000000); !events[0].Time.Equal(want) {
+		t.Fatalf("expecting %v, got %v", want, events[0].Time)
+	}
+
+	events, err = trace.ReadAll(strings.NewReader(`{"at":"2026-10-10T13:55:36Z","req":{"headers":{"x-api-key":"k9"}}}`),
+		trace.JSONLines, trace.WithTimeField("at"), trace.WithKeyField("req.headers.x-api-key"))
+	if err != nil || events[0].Key != "k9" {
+		t.Fatalf("expecting the nested key, got %v, %v", events, err)
+	}
+
+	for _, bad := range []string{`{"key":"k1"}`, `{"time":"yesterday","key":"k1"}`, `{"time":1,"user":"k1"}`, `{`} {
+		if _, err = trace.ReadAll(strings.NewReader(bad), trace.JSONLines); err == nil {
+			t.Fatalf("expecting %v rejected", bad)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+	var events []trace.Event
+	for i := 0; i < 60; i++ { // k1 sends 1/s, k2 sends 10/s in the first 6s
+		events = append(events, trace.Event{Time: start.Add(time.Duration(i) * time.Second), Key: "k1"})
+		events = append(events, trace.Event{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Key: "k2"})
+	}
+	rep, err := trace.Replay(events, []plan.Plan{
+		{Name: "5/s", Algorithm: rate.TokenBucket, MaxCount: 5, Period: time.Second},
+		{Name: "30/min", Algorithm: rate.Counter, MaxCount: 30, Period: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Requests != 120 || len(rep.Keys) != 2 {
+		t.Fatalf("expecting 120 requests of 2 keys, got %+v", rep)
+	}
+	k1, k2 := rep.Keys[0], rep.Keys[1]
+	if k1.Key != "k1" || k1.Rejected[0] != 0 || k1.Rejected[1] != 30 {
+		t.Fatalf("unexpected k1: %+v", k1)
+	}
+	if k2.Key != "k2" || k2.Rejected[0] < 25 || k2.Rejected[0] > 30 || k2.Rejected[1] != 30 {
+		t.Fatalf("unexpected k2: %+v", k2)
+	}
+	if rep.Rejected[1] != 60 {
+		t.Fatalf("expecting 60 rejected by 30/min, got %v", rep.Rejected[1])
+	}
+
+	var buf bytes.Buffer
+	if err = rep.WriteText(&buf, 1); err != nil || !strings.Contains(buf.String(), "k1") || strings.Contains(buf.String(), "k2") || !strings.Contains(buf.String(), "total") {
+		t.Fatalf("unexpected text:\n%v", buf.String())
+	}
+	buf.Reset()
+	if err = rep.WriteCSV(&buf); err != nil || !strings.HasPrefix(buf.String(), "key,requests,5/s,30/min\nk1,60,0,30\n") {
+		t.Fatalf("unexpected csv:\n%v", buf.String())
+	}
+
+	if _, err = trace.Replay(events, []plan.Plan{{Name: "x", Algorithm: rate.PriorityTokenBucket, MaxCount: 1, Period: time.Second}}); err == nil {
+		t.Fatal("expecting an algorithm without store rejected")
+	}
+}